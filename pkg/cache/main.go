@@ -10,8 +10,17 @@ type Cache[T any] struct {
 	lock sync.Mutex
 }
 
+// Meta contains the metadata of a cache entry.
+type Meta struct {
+	// Created is the time the value has been set.
+	Created time.Time
+	// Expiration is the time the value expires.
+	Expiration time.Time
+}
+
 type cacheValue[T any] struct {
 	value      *T
+	created    time.Time
 	expiration time.Time
 }
 
@@ -25,14 +34,32 @@ func (c *Cache[T]) Set(key string, value *T, expiration time.Duration) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	expirationTime := time.Now().Add(expiration)
+	now := time.Now()
 	c.data[key] = cacheValue[T]{
 		value:      value,
-		expiration: expirationTime,
+		created:    now,
+		expiration: now.Add(expiration),
 	}
 }
 
 func (c *Cache[T]) Get(key string) (*T, bool) {
+	value, _, ok := c.GetWithMeta(key)
+
+	return value, ok
+}
+
+// GetWithAge returns the value and the time since the value has been set.
+func (c *Cache[T]) GetWithAge(key string) (*T, time.Duration, bool) {
+	value, meta, ok := c.GetWithMeta(key)
+	if !ok {
+		return nil, 0, false
+	}
+
+	return value, time.Since(meta.Created), true
+}
+
+// GetWithMeta returns the value together with the time it has been set and its expiration.
+func (c *Cache[T]) GetWithMeta(key string) (*T, Meta, bool) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -40,8 +67,44 @@ func (c *Cache[T]) Get(key string) (*T, bool) {
 	if !ok || time.Now().After(value.expiration) {
 		delete(c.data, key)
 
-		return nil, false
+		return nil, Meta{}, false
+	}
+
+	return value.value, Meta{Created: value.created, Expiration: value.expiration}, true
+}
+
+// Len returns the number of entries, which are not expired.
+func (c *Cache[T]) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	count := 0
+
+	for _, value := range c.data {
+		if !now.After(value.expiration) {
+			count++
+		}
 	}
 
-	return value.value, true
+	return count
+}
+
+// Clear removes all entries and returns the number of removed entries, which were not expired.
+func (c *Cache[T]) Clear() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	count := 0
+
+	for _, value := range c.data {
+		if !now.After(value.expiration) {
+			count++
+		}
+	}
+
+	clear(c.data)
+
+	return count
 }
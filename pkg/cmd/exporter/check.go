@@ -0,0 +1,46 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jkroepke/azure-monitor-exporter/pkg/probe"
+)
+
+// checkTimeout is the timeout of all steps of --check.
+const checkTimeout = time.Minute
+
+// printCheckResult prints a single step of --check and reports whether the step passed.
+func printCheckResult(w io.Writer, result probe.CheckResult) bool {
+	if result.Err != nil {
+		_, _ = fmt.Fprintf(w, "[FAIL] %s: %v\n       %s\n", result.Step, result.Err, result.Hint)
+
+		return false
+	}
+
+	_, _ = fmt.Fprintf(w, "[PASS] %s: %s\n", result.Step, result.Detail)
+
+	return true
+}
+
+// runCheck runs the checks of the probe and prints a report. It returns the exit code of --check.
+func runCheck(ctx context.Context, w io.Writer, probeCollector *probe.Probe, subscriptions []string, discoverSubscriptions bool) int {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	if discoverSubscriptions {
+		printCheckResult(w, probe.CheckResult{Step: "subscription discovery", Detail: fmt.Sprintf("found %d subscriptions", len(subscriptions))})
+	} else {
+		printCheckResult(w, probe.CheckResult{Step: "subscription discovery", Detail: "skipped, disabled by --azure.discover-subscriptions=false"})
+	}
+
+	for _, result := range probeCollector.Check(ctx) {
+		if !printCheckResult(w, result) {
+			return 1
+		}
+	}
+
+	return 0
+}
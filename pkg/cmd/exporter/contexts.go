@@ -0,0 +1,155 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/jkroepke/azure-monitor-exporter/pkg/probe"
+	"gopkg.in/yaml.v3"
+)
+
+// contextsFile is the file format of --azure.contexts-file.
+type contextsFile struct {
+	Contexts []contextConfig `yaml:"contexts"`
+	// SubscriptionCredentials override the credential used to query the metrics of matching subscriptions.
+	// The subscriptions of a subscription credential are patterns, e.g. 00000000-*.
+	SubscriptionCredentials []contextConfig `yaml:"subscriptionCredentials"`
+}
+
+// contextConfig describes the credential and subscriptions of a single context.
+type contextConfig struct {
+	Name     string `yaml:"name"`
+	TenantID string `yaml:"tenantID"`
+	ClientID string `yaml:"clientID"`
+	// ClientSecretFile contains the client secret. Secrets are not accepted inline to keep them out of the config file.
+	ClientSecretFile string   `yaml:"clientSecretFile"`
+	Subscriptions    []string `yaml:"subscriptions"`
+}
+
+// readContextsFile reads and validates the contexts file.
+func readContextsFile(path string) (*contextsFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading contexts file: %w", err)
+	}
+
+	var file contextsFile
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	if err = decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("error parsing contexts file: %w", err)
+	}
+
+	for _, contextConfig := range slices.Concat(file.Contexts, file.SubscriptionCredentials) {
+		switch {
+		case contextConfig.Name == "":
+			return nil, errors.New("error parsing contexts file: context without name")
+		case contextConfig.TenantID == "":
+			return nil, fmt.Errorf("error parsing contexts file: context %q must set tenantID", contextConfig.Name)
+		case (contextConfig.ClientID == "") != (contextConfig.ClientSecretFile == ""):
+			return nil, fmt.Errorf("error parsing contexts file: context %q must set both clientID and clientSecretFile or none of them", contextConfig.Name)
+		}
+	}
+
+	for _, contextConfig := range file.SubscriptionCredentials {
+		if len(contextConfig.Subscriptions) == 0 {
+			return nil, fmt.Errorf("error parsing contexts file: subscription credential %q must set subscriptions", contextConfig.Name)
+		}
+	}
+
+	return &file, nil
+}
+
+// newContextCredential returns the credential of a context. Without client secret, the DefaultAzureCredential of the tenant is used.
+func newContextCredential(contextConfig contextConfig, httpClient *http.Client) (azcore.TokenCredential, error) {
+	clientOptions := azcore.ClientOptions{
+		Transport: httpClient,
+	}
+
+	if contextConfig.ClientID == "" {
+		cred, err := azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions: clientOptions,
+			TenantID:      contextConfig.TenantID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error obtain azure credentials of context %q: %w", contextConfig.Name, err)
+		}
+
+		return cred, nil
+	}
+
+	clientSecret, err := os.ReadFile(contextConfig.ClientSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client secret of context %q: %w", contextConfig.Name, err)
+	}
+
+	cred, err := azidentity.NewClientSecretCredential(contextConfig.TenantID, contextConfig.ClientID, strings.TrimSpace(string(clientSecret)),
+		&azidentity.ClientSecretCredentialOptions{
+			ClientOptions: clientOptions,
+		})
+	if err != nil {
+		return nil, fmt.Errorf("error obtain azure credentials of context %q: %w", contextConfig.Name, err)
+	}
+
+	return cred, nil
+}
+
+// addContexts registers all contexts and subscription credentials of the contexts file at the probe.
+// Contexts without subscriptions use all subscriptions discovered with the credential of the context.
+func addContexts(ctx context.Context, logger log.Logger, probeCollector *probe.Probe, discovery *subscriptionDiscovery, path string) error {
+	file, err := readContextsFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, contextConfig := range file.SubscriptionCredentials {
+		cred, err := newContextCredential(contextConfig, discovery.httpClient)
+		if err != nil {
+			return err
+		}
+
+		for _, pattern := range contextConfig.Subscriptions {
+			if err = probeCollector.AddSubscriptionCredential(contextConfig.Name, pattern, cred); err != nil {
+				return fmt.Errorf("error adding subscription credential: %w", err)
+			}
+		}
+
+		_ = level.Info(logger).Log("msg", "added subscription credential", "name", contextConfig.Name,
+			"subscriptions", strings.Join(contextConfig.Subscriptions, ","))
+	}
+
+	for _, contextConfig := range file.Contexts {
+		cred, err := newContextCredential(contextConfig, discovery.httpClient)
+		if err != nil {
+			return err
+		}
+
+		subscriptions := contextConfig.Subscriptions
+		if len(subscriptions) == 0 {
+			subscriptions, err = discovery.discover(ctx, contextConfig.Name, cred)
+			if err != nil {
+				return fmt.Errorf("error discovering subscriptions of context %q: %w", contextConfig.Name, err)
+			}
+		}
+
+		if err = probeCollector.AddContext(contextConfig.Name, cred, subscriptions); err != nil {
+			return fmt.Errorf("error adding context: %w", err)
+		}
+
+		_ = level.Info(logger).Log("msg", "added context", "context", contextConfig.Name, "subscriptions", strings.Join(subscriptions, ","))
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/subscription/armsubscription"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errSubscriptionDiscoveryDisabled is returned by subscriptionDiscovery.discover, if --azure.discover-subscriptions is disabled.
+var errSubscriptionDiscoveryDisabled = errors.New(
+	"subscription discovery is disabled by --azure.discover-subscriptions=false, configure the subscriptions explicitly")
+
+// subscriptionDiscovery discovers the subscriptions accessible by a credential and exposes metrics about the discovery.
+type subscriptionDiscovery struct {
+	logger     log.Logger
+	httpClient *http.Client
+	// armCloud contains the Azure Resource Manager endpoint of the subscription discovery.
+	armCloud cloud.Configuration
+
+	// disabled rejects all discoveries, subscriptions must be configured explicitly.
+	disabled bool
+	// allStates includes subscriptions in all states. By default, only enabled subscriptions are discovered.
+	allStates bool
+	attempts  int
+	delay     time.Duration
+
+	subscriptionsDiscovered *prometheus.GaugeVec
+	discoveryDuration       *prometheus.GaugeVec
+}
+
+func newSubscriptionDiscovery(
+	reg prometheus.Registerer, logger log.Logger, httpClient *http.Client, armCloud cloud.Configuration, disabled, allStates bool, attempts int,
+	delay time.Duration,
+) *subscriptionDiscovery {
+	discovery := &subscriptionDiscovery{
+		logger:     logger,
+		httpClient: httpClient,
+		armCloud:   armCloud,
+		disabled:   disabled,
+		allStates:  allStates,
+		attempts:   attempts,
+		delay:      delay,
+
+		subscriptionsDiscovered: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "azure_monitor",
+			Name:      "subscriptions_discovered",
+			Help:      "azure_monitor_exporter: Number of subscriptions found by the last subscription discovery.",
+		}, []string{"context"}),
+		discoveryDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "azure_monitor",
+			Name:      "subscription_discovery_duration_seconds",
+			Help:      "azure_monitor_exporter: Duration of the last subscription discovery, including retries.",
+		}, []string{"context"}),
+	}
+
+	reg.MustRegister(discovery.subscriptionsDiscovered, discovery.discoveryDuration)
+
+	return discovery
+}
+
+// discover returns the subscriptions of the credential. The contextName is used as label of the discovery metrics.
+func (d *subscriptionDiscovery) discover(ctx context.Context, contextName string, cred azcore.TokenCredential) ([]string, error) {
+	if d.disabled {
+		return nil, errSubscriptionDiscoveryDisabled
+	}
+
+	startTime := time.Now()
+
+	subscriptions, err := d.discoverWithRetry(ctx, cred)
+
+	d.discoveryDuration.WithLabelValues(contextName).Set(time.Since(startTime).Seconds())
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.subscriptionsDiscovered.WithLabelValues(contextName).Set(float64(len(subscriptions)))
+
+	return subscriptions, nil
+}
+
+// discoverWithRetry calls discoverSubscriptions until it succeeds or all attempts failed.
+// The delay between the attempts doubles after each failed attempt.
+func (d *subscriptionDiscovery) discoverWithRetry(ctx context.Context, cred azcore.TokenCredential) ([]string, error) {
+	var err error
+
+	delay := d.delay
+
+	for attempt := 1; ; attempt++ {
+		var subscriptions []string
+
+		subscriptions, err = discoverSubscriptions(ctx, d.logger, cred, d.httpClient, d.armCloud, d.allStates)
+		if err == nil {
+			return subscriptions, nil
+		}
+
+		if attempt >= d.attempts {
+			return nil, err
+		}
+
+		_ = level.Warn(d.logger).Log("msg", "Error discovering subscriptions, retrying", "attempt", attempt, "attempts", d.attempts, "delay", delay, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("subscription discovery canceled: %w", ctx.Err())
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+// discoverSubscriptions returns the IDs of all subscriptions accessible by the credential.
+// Unless allStates is set, only enabled subscriptions are returned.
+func discoverSubscriptions(
+	ctx context.Context, logger log.Logger, cred azcore.TokenCredential, httpClient *http.Client, armCloud cloud.Configuration, allStates bool,
+) ([]string, error) {
+	subscriptionClient, err := armsubscription.NewSubscriptionsClient(cred, &arm.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Transport: httpClient,
+			Cloud:     armCloud,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create subscription client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	subscriptions := make([]string, 0)
+	filtered := 0
+
+	pager := subscriptionClient.NewListPager(nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to advance page: %w", err)
+		}
+
+		for _, v := range page.Value {
+			if !allStates && (v.State == nil || *v.State != armsubscription.SubscriptionStateEnabled) {
+				filtered++
+
+				continue
+			}
+
+			subscriptions = append(subscriptions, *v.SubscriptionID)
+		}
+	}
+
+	if filtered > 0 {
+		_ = level.Info(logger).Log("msg", "ignored subscriptions which are not enabled", "count", filtered)
+	}
+
+	return subscriptions, nil
+}
@@ -0,0 +1,166 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errMockCredential = errors.New("mock credential error")
+
+// failingCredential is a credential, which fails to acquire a token and counts the attempts.
+type failingCredential struct {
+	calls      atomic.Int32
+	onGetToken func()
+}
+
+func (c *failingCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls.Add(1)
+
+	if c.onGetToken != nil {
+		c.onGetToken()
+	}
+
+	return azcore.AccessToken{}, errMockCredential
+}
+
+// mockCredential is a credential, which always returns a token.
+type mockCredential struct{}
+
+func (mockCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "mock_access_token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// mockSubscriptionsTransport returns a subscription list with a subscription in each state.
+func mockSubscriptionsTransport(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != "management.azure.com" || req.URL.Path != "/subscriptions" {
+		return nil, fmt.Errorf("unexpected request: %s", req.URL)
+	}
+
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("Content-Type", "application/json")
+	recorder.WriteHeader(http.StatusOK)
+
+	//language=JSON
+	_, _ = recorder.WriteString(`{"value": [
+	  {"subscriptionId": "00000000-0000-0000-0000-000000000001", "state": "Enabled"},
+	  {"subscriptionId": "00000000-0000-0000-0000-000000000002", "state": "Disabled"},
+	  {"subscriptionId": "00000000-0000-0000-0000-000000000003", "state": "Warned"},
+	  {"subscriptionId": "00000000-0000-0000-0000-000000000004"}
+	]}`)
+
+	return recorder.Result(), nil
+}
+
+func TestDiscoverSubscriptionStates(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name          string
+		allStates     bool
+		subscriptions []string
+	}{
+		{
+			name:          "enabled only",
+			allStates:     false,
+			subscriptions: []string{"00000000-0000-0000-0000-000000000001"},
+		},
+		{
+			name:      "all states",
+			allStates: true,
+			subscriptions: []string{
+				"00000000-0000-0000-0000-000000000001",
+				"00000000-0000-0000-0000-000000000002",
+				"00000000-0000-0000-0000-000000000003",
+				"00000000-0000-0000-0000-000000000004",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			httpClient := &http.Client{Transport: promhttp.RoundTripperFunc(mockSubscriptionsTransport)}
+
+			discovery := newSubscriptionDiscovery(prometheus.NewRegistry(), log.NewNopLogger(), httpClient, cloud.AzurePublic,
+				false, tc.allStates, 1, time.Millisecond)
+
+			subscriptions, err := discovery.discover(context.Background(), "default", mockCredential{})
+			require.NoError(t, err)
+			assert.Equal(t, tc.subscriptions, subscriptions)
+			assert.InDelta(t, float64(len(tc.subscriptions)), testutil.ToFloat64(discovery.subscriptionsDiscovered.WithLabelValues("default")), 0)
+		})
+	}
+}
+
+func TestDiscoverWithRetry(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		attempts int
+		// minDuration is the sum of the delays between the attempts, the delay doubles after each attempt.
+		minDuration time.Duration
+	}{
+		{name: "single attempt", attempts: 1, minDuration: 0},
+		{name: "multiple attempts", attempts: 3, minDuration: 20*time.Millisecond + 40*time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			discovery := newSubscriptionDiscovery(prometheus.NewRegistry(), log.NewNopLogger(), http.DefaultClient, cloud.AzurePublic,
+				false, false, tc.attempts, 20*time.Millisecond)
+
+			cred := &failingCredential{}
+
+			subscriptions, err := discovery.discover(context.Background(), "default", cred)
+			require.ErrorIs(t, err, errMockCredential)
+			assert.Nil(t, subscriptions)
+			assert.Equal(t, int32(tc.attempts), cred.calls.Load())
+			assert.Zero(t, testutil.ToFloat64(discovery.subscriptionsDiscovered.WithLabelValues("default")))
+			assert.GreaterOrEqual(t, testutil.ToFloat64(discovery.discoveryDuration.WithLabelValues("default")), tc.minDuration.Seconds())
+		})
+	}
+}
+
+func TestDiscoverWithRetryCanceled(t *testing.T) {
+	t.Parallel()
+
+	discovery := newSubscriptionDiscovery(prometheus.NewRegistry(), log.NewNopLogger(), http.DefaultClient, cloud.AzurePublic,
+		false, false, 10, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cred := &failingCredential{onGetToken: cancel}
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := discovery.discover(ctx, "default", cred)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(10 * time.Second):
+		t.Fatal("subscription discovery has not been stopped by the canceled context")
+	}
+
+	assert.Equal(t, int32(1), cred.calls.Load())
+}
@@ -7,28 +7,32 @@ import (
 	stdlog "log"
 	"net/http"
 	_ "net/http/pprof" //nolint:gosec // pprof is a debugging tool
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	azlog "github.com/Azure/azure-sdk-for-go/sdk/azcore/log"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
-	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/subscription/armsubscription"
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/jkroepke/azure-monitor-exporter/pkg/cache"
 	"github.com/jkroepke/azure-monitor-exporter/pkg/probe"
+	"github.com/jkroepke/azure-monitor-exporter/pkg/remotewrite"
 	"github.com/jkroepke/azure-monitor-exporter/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	versionCollector "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
@@ -43,7 +47,156 @@ func Run() int {
 	kingpin.Version(version.Print("azure-monitor-exporter"))
 
 	webConfig := webflag.AddFlags(kingpin.CommandLine, ":8080")
+	trustProxyHeaders := kingpin.Flag("web.trust-proxy-headers",
+		"Use the X-Forwarded-For and X-Real-IP headers to log the client address. Enable only behind a trusted reverse proxy").
+		Default("false").Envar("AZURE_MONITOR_EXPORTER_WEB_TRUST_PROXY_HEADERS").Bool()
+	routePrefix := kingpin.Flag("web.route-prefix",
+		"Prefix for all HTTP endpoints, e.g. /azure-monitor. Useful, if the exporter is served under a sub-path by a reverse proxy. "+
+			"Defaults to the path of --web.external-url").
+		Default("").Envar("AZURE_MONITOR_EXPORTER_WEB_ROUTE_PREFIX").String()
+	externalURL := kingpin.Flag("web.external-url",
+		"The URL under which the exporter is externally reachable, e.g. if it is served behind a reverse proxy. Used for the links of the landing page").
+		Default("").Envar("AZURE_MONITOR_EXPORTER_WEB_EXTERNAL_URL").String()
+	webConstLabels := kingpin.Flag("web.const-labels",
+		"Comma separated list of labels in the form name=value, which are added to the metrics of the exporter and the scrape metrics of the probes, "+
+			"e.g. cluster=prod").
+		Default("").Envar("AZURE_MONITOR_EXPORTER_WEB_CONST_LABELS").String()
+	disableRuntimeMetrics := kingpin.Flag("web.disable-runtime-metrics",
+		"Exclude the Go runtime and process metrics from the /metrics endpoint").
+		Default("false").Envar("AZURE_MONITOR_EXPORTER_WEB_DISABLE_RUNTIME_METRICS").Bool()
+	shutdownTimeout := kingpin.Flag("web.shutdown-timeout",
+		"Time to wait for in-flight requests, e.g. running probes, on SIGTERM or SIGINT before the web server is stopped").
+		Default("10s").Envar("AZURE_MONITOR_EXPORTER_WEB_SHUTDOWN_TIMEOUT").Duration()
+	enableAdminAPI := kingpin.Flag("web.enable-admin-api",
+		"Enable the admin endpoint POST /-/cache/flush, which clears the query and metric caches").
+		Default("false").Envar("AZURE_MONITOR_EXPORTER_WEB_ENABLE_ADMIN_API").Bool()
 	logRetries := kingpin.Flag("log.retries", "Log Azure REST API retries").Default("false").Envar("AZURE_MONITOR_EXPORTER_LOG_RETRIES").Bool()
+	logAzureRequests := kingpin.Flag("log.azure-requests",
+		"Log method, API, status and duration of each Azure REST API request at debug level").
+		Default("false").Envar("AZURE_MONITOR_EXPORTER_LOG_AZURE_REQUESTS").Bool()
+	metricsEndpointTemplate := kingpin.Flag("azure.metrics-endpoint-template",
+		"Format string of the Azure Monitor metrics endpoint. %s is replaced by the region of the resource").
+		Default(probe.DefaultMetricsEndpointTemplate).Envar("AZURE_MONITOR_EXPORTER_AZURE_METRICS_ENDPOINT_TEMPLATE").String()
+	metricsAudience := kingpin.Flag("azure.metrics-audience",
+		"Audience of the token of the Azure Monitor metrics endpoint. Must match the cloud of --azure.metrics-endpoint-template").
+		Default(probe.DefaultMetricsAudience).Envar("AZURE_MONITOR_EXPORTER_AZURE_METRICS_AUDIENCE").String()
+	logsEndpoint := kingpin.Flag("azure.logs-endpoint",
+		"Log Analytics query endpoint of the /logs probes").
+		Default(probe.DefaultLogsEndpoint).Envar("AZURE_MONITOR_EXPORTER_AZURE_LOGS_ENDPOINT").String()
+	logsAudience := kingpin.Flag("azure.logs-audience",
+		"Audience of the token of the Log Analytics query endpoint. Must match the cloud of --azure.logs-endpoint").
+		Default(probe.DefaultLogsAudience).Envar("AZURE_MONITOR_EXPORTER_AZURE_LOGS_AUDIENCE").String()
+	resourceManagerEndpoint := kingpin.Flag("azure.resource-manager-endpoint",
+		"Azure Resource Manager endpoint of the subscription discovery, Resource Graph and the per-resource metrics API").
+		Default(cloud.AzurePublic.Services[cloud.ResourceManager].Endpoint).Envar("AZURE_MONITOR_EXPORTER_AZURE_RESOURCE_MANAGER_ENDPOINT").String()
+	resourceManagerAudience := kingpin.Flag("azure.resource-manager-audience",
+		"Audience of the token of the Azure Resource Manager endpoint. Must match the cloud of --azure.resource-manager-endpoint").
+		Default(cloud.AzurePublic.Services[cloud.ResourceManager].Audience).Envar("AZURE_MONITOR_EXPORTER_AZURE_RESOURCE_MANAGER_AUDIENCE").String()
+	globalMetricsRegion := kingpin.Flag("azure.global-metrics-region",
+		"Region used to query the metrics of resources with the location global, e.g. Traffic Manager or Front Door").
+		Default(probe.DefaultGlobalMetricsRegion).Envar("AZURE_MONITOR_EXPORTER_AZURE_GLOBAL_METRICS_REGION").String()
+	discoveryAttempts := kingpin.Flag("azure.subscription-discovery-attempts",
+		"Number of attempts of the subscription discovery at startup").
+		Default("5").Envar("AZURE_MONITOR_EXPORTER_AZURE_SUBSCRIPTION_DISCOVERY_ATTEMPTS").Int()
+	discoveryRetryDelay := kingpin.Flag("azure.subscription-discovery-retry-delay",
+		"Initial delay between attempts of the subscription discovery. The delay doubles after each attempt").
+		Default("1s").Envar("AZURE_MONITOR_EXPORTER_AZURE_SUBSCRIPTION_DISCOVERY_RETRY_DELAY").Duration()
+	discoverSubscriptions := kingpin.Flag("azure.discover-subscriptions",
+		"Discover the subscriptions accessible by the credential at startup. If disabled, probes must set the 'subscriptionID' parameter "+
+			"and the list subscriptions permission is not required").
+		Default("true").Envar("AZURE_MONITOR_EXPORTER_AZURE_DISCOVER_SUBSCRIPTIONS").Bool()
+	discoverAllSubscriptionStates := kingpin.Flag("azure.discover-all-subscription-states",
+		"Include subscriptions in all states in the subscription discovery. By default, only enabled subscriptions are used").
+		Default("false").Envar("AZURE_MONITOR_EXPORTER_AZURE_DISCOVER_ALL_SUBSCRIPTION_STATES").Bool()
+	probeWarmup := kingpin.Flag("probe.warmup",
+		"Probe parameters in URL query format, executed once at startup to populate the query cache. Can be repeated").
+		Envar("AZURE_MONITOR_EXPORTER_PROBE_WARMUP").Strings()
+	probeWarmupTimeout := kingpin.Flag("probe.warmup-timeout",
+		"Timeout of each warmup probe").
+		Default("30s").Envar("AZURE_MONITOR_EXPORTER_PROBE_WARMUP_TIMEOUT").Duration()
+	probeQueryCacheJitter := kingpin.Flag("probe.query-cache-jitter",
+		"Randomize the query cache expiration by up to the given percentage to avoid simultaneous expirations").
+		Default("0").Envar("AZURE_MONITOR_EXPORTER_PROBE_QUERY_CACHE_JITTER").Float64()
+	probeDefaultInterval := kingpin.Flag("probe.default-interval",
+		"ISO 8601 metric interval used, if a probe does not define the 'interval' parameter").
+		Envar("AZURE_MONITOR_EXPORTER_PROBE_DEFAULT_INTERVAL").String()
+	probeDefaultAggregation := kingpin.Flag("probe.default-aggregation",
+		"Comma separated aggregations requested, if a probe does not define the 'aggregation' parameter, e.g. average,total,count,minimum,maximum. "+
+			"By default, Azure returns the primary aggregation of each metric").
+		Envar("AZURE_MONITOR_EXPORTER_PROBE_DEFAULT_AGGREGATION").String()
+	probeMetricNamesPerRequest := kingpin.Flag("probe.metric-names-per-request",
+		"Maximum number of metric names queried by a single Azure Monitor request. Probes with more metric names are split into multiple requests").
+		Default(strconv.Itoa(probe.DefaultMetricNamesPerRequest)).Envar("AZURE_MONITOR_EXPORTER_PROBE_METRIC_NAMES_PER_REQUEST").Int()
+	probeTimeoutHeader := kingpin.Flag("probe.timeout-header",
+		"Request header containing the scrape timeout in seconds. Without the header, the 'timeout' parameter of the probe is used").
+		Default(probe.DefaultTimeoutHeader).Envar("AZURE_MONITOR_EXPORTER_PROBE_TIMEOUT_HEADER").String()
+	probeMaxLabelValueLength := kingpin.Flag("probe.max-label-value-length",
+		"Maximum length of resource and dimension label values. Longer values are truncated and end with '...'. 0 means unlimited").
+		Default("0").Envar("AZURE_MONITOR_EXPORTER_PROBE_MAX_LABEL_VALUE_LENGTH").Int()
+	probeUseAzureTimestamps := kingpin.Flag("probe.use-azure-timestamps",
+		"Emit metrics with the timestamp of the Azure data point instead of the scrape time. Can be overridden by the 'useAzureTimestamps' parameter").
+		Default("false").Envar("AZURE_MONITOR_EXPORTER_PROBE_USE_AZURE_TIMESTAMPS").Bool()
+	probeMaxPages := kingpin.Flag("probe.max-pages",
+		"Maximum number of Resource Graph pages fetched by a probe. 0 means unlimited").
+		Default("100").Envar("AZURE_MONITOR_EXPORTER_PROBE_MAX_PAGES").Int()
+	probeMaxSubscriptionIDs := kingpin.Flag("probe.max-subscription-ids",
+		"Maximum number of values of the 'subscriptionID' parameter. Probes exceeding the limit are rejected with 400. 0 means unlimited").
+		Default(strconv.Itoa(probe.DefaultMaxSubscriptionIDs)).Envar("AZURE_MONITOR_EXPORTER_PROBE_MAX_SUBSCRIPTION_IDS").Int()
+	probeMaxSeries := kingpin.Flag("probe.max-series",
+		"Maximum number of samples emitted by a probe. Probes exceeding the limit return the samples emitted so far and "+
+			"azure_monitor_scrape_series_limit_exceeded 1. 0 means unlimited").
+		Default(strconv.Itoa(probe.DefaultMaxSeries)).Envar("AZURE_MONITOR_EXPORTER_PROBE_MAX_SERIES").Int()
+	probeMaxSubscriptions := kingpin.Flag("probe.max-subscriptions-per-probe",
+		"Maximum number of subscriptions covered by a probe. Probes exceeding the limit are rejected with 400. 0 means unlimited").
+		Default("0").Envar("AZURE_MONITOR_EXPORTER_PROBE_MAX_SUBSCRIPTIONS_PER_PROBE").Int()
+	subscriptionsPerQuery := kingpin.Flag("azure.resourcegraph-subscriptions-per-query",
+		"Maximum number of subscriptions queried by a single Resource Graph request. Larger subscription lists are split into multiple requests").
+		Default(strconv.Itoa(probe.DefaultSubscriptionsPerQuery)).Envar("AZURE_MONITOR_EXPORTER_AZURE_RESOURCEGRAPH_SUBSCRIPTIONS_PER_QUERY").Int()
+	allowPartialScopes := kingpin.Flag("azure.resourcegraph-allow-partial-scopes",
+		"Allow Resource Graph to return partial results, if the number of subscriptions exceeds the limit of a single query").
+		Default("false").Envar("AZURE_MONITOR_EXPORTER_AZURE_RESOURCEGRAPH_ALLOW_PARTIAL_SCOPES").Bool()
+	maxResponseBytes := kingpin.Flag("azure.max-response-bytes",
+		"Maximum size of an Azure API response body. Larger responses are aborted with an error to protect the exporter from memory exhaustion. 0 means unlimited").
+		Default("128MiB").Envar("AZURE_MONITOR_EXPORTER_AZURE_MAX_RESPONSE_BYTES").Bytes()
+	maxIdleConns := kingpin.Flag("azure.max-idle-conns",
+		"Maximum number of idle connections to Azure APIs across all hosts. 0 means unlimited").
+		Default("100").Envar("AZURE_MONITOR_EXPORTER_AZURE_MAX_IDLE_CONNS").Int()
+	maxIdleConnsPerHost := kingpin.Flag("azure.max-idle-conns-per-host",
+		"Maximum number of idle connections to a single Azure API host, e.g. the metrics endpoint of a region").
+		Default("10").Envar("AZURE_MONITOR_EXPORTER_AZURE_MAX_IDLE_CONNS_PER_HOST").Int()
+	idleConnTimeout := kingpin.Flag("azure.idle-conn-timeout",
+		"Duration an idle connection to an Azure API is kept open. 0 means no limit").
+		Default("90s").Envar("AZURE_MONITOR_EXPORTER_AZURE_IDLE_CONN_TIMEOUT").Duration()
+	check := kingpin.Flag("check",
+		"Validate the credentials and permissions by a subscription discovery, a Resource Graph query and a metrics query, then exit").
+		Default("false").Bool()
+	otelEndpoint := kingpin.Flag("tracing.otel-endpoint",
+		"OTLP/HTTP endpoint receiving OpenTelemetry spans of the probes and Azure API requests, e.g. http://localhost:4318. Tracing is disabled, if empty").
+		Default("").Envar("AZURE_MONITOR_EXPORTER_TRACING_OTEL_ENDPOINT").String()
+	pushRemoteWriteURL := kingpin.Flag("push.remote-write-url",
+		"Prometheus remote write endpoint receiving the metrics of the push probes, e.g. for environments, where Prometheus can't reach the exporter. "+
+			"Push mode is disabled, if empty").
+		Default("").Envar("AZURE_MONITOR_EXPORTER_PUSH_REMOTE_WRITE_URL").String()
+	pushProbes := kingpin.Flag("push.probe",
+		"Probe parameters in URL query format, executed every --push.interval and sent to --push.remote-write-url. Can be repeated").
+		Envar("AZURE_MONITOR_EXPORTER_PUSH_PROBE").Strings()
+	pushInterval := kingpin.Flag("push.interval",
+		"Interval of the push probes. It is also the timeout of each push probe").
+		Default("1m").Envar("AZURE_MONITOR_EXPORTER_PUSH_INTERVAL").Duration()
+	contextsFile := kingpin.Flag("azure.contexts-file",
+		"Path to a YAML file with named credential contexts. A probe selects a context by the 'context' parameter").
+		Default("").Envar("AZURE_MONITOR_EXPORTER_AZURE_CONTEXTS_FILE").String()
+	probeResourceFile := kingpin.Flag("probe.resource-file",
+		"Path to a YAML file with named resource lists. A probe scrapes a list instead of querying Resource Graph by the 'resourceFile' parameter. "+
+			"The file is reloaded on change").
+		Default("").Envar("AZURE_MONITOR_EXPORTER_PROBE_RESOURCE_FILE").String()
+	probeDeduplicateResources := kingpin.Flag("probe.deduplicate-resources",
+		"Scrape a resource only once, even if it appears under multiple subscriptions").
+		Default("false").Envar("AZURE_MONITOR_EXPORTER_PROBE_DEDUPLICATE_RESOURCES").Bool()
+	probeLegacyMetricsFallback := kingpin.Flag("probe.legacy-metrics-fallback",
+		"Query metric namespaces, which are not supported by the batch metrics API, by the per-resource metrics API. "+
+			"The per-resource API requires one request per resource").
+		Default("false").Envar("AZURE_MONITOR_EXPORTER_PROBE_LEGACY_METRICS_FALLBACK").Bool()
 
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
@@ -52,7 +205,22 @@ func Run() int {
 
 	logger := promlog.New(promlogConfig)
 
-	exporterTracing := tracing.New(reg, http.DefaultTransport)
+	constLabels, err := parseConstLabels(*webConstLabels)
+	if err != nil {
+		_ = level.Error(logger).Log("msg", "Error parsing --web.const-labels", "err", err)
+
+		return 1
+	}
+
+	// registerer adds the const labels to the metrics of the exporter. The Go runtime and build metrics are not labeled.
+	registerer := prometheus.WrapRegistererWith(constLabels, reg)
+
+	transport := limitResponseBody(int64(*maxResponseBytes), newTransport(*maxIdleConns, *maxIdleConnsPerHost, *idleConnTimeout))
+	if *logAzureRequests {
+		transport = logRequests(logger, transport)
+	}
+
+	exporterTracing := tracing.New(registerer, transport)
 	httpClient := &http.Client{
 		Transport: exporterTracing.Transport,
 	}
@@ -87,46 +255,184 @@ func Run() int {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	subscriptions, err := discoverSubscriptions(ctx, cred, httpClient)
+	resourceManagerCloud := cloud.Configuration{
+		Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+			cloud.ResourceManager: {Endpoint: *resourceManagerEndpoint, Audience: *resourceManagerAudience},
+		},
+	}
+
+	discovery := newSubscriptionDiscovery(registerer, logger, httpClient, resourceManagerCloud, !*discoverSubscriptions,
+		*discoverAllSubscriptionStates, *discoveryAttempts, *discoveryRetryDelay)
+
+	var subscriptions []string
+
+	if *discoverSubscriptions {
+		subscriptions, err = discovery.discover(ctx, "", cred)
+	}
+
+	if err != nil && *check {
+		printCheckResult(os.Stdout, probe.CheckResult{
+			Step: "subscription discovery",
+			Err:  err,
+			Hint: "Check the credentials of the exporter and assign the Reader role on at least one subscription.",
+		})
+
+		return 1
+	}
+
 	if err != nil {
 		_ = level.Error(logger).Log("msg", "Error obtain azure credentials", "err", err)
 
 		return 1
 	}
 
-	_ = level.Info(logger).Log("msg", "discovered subscriptions", "subscriptions", strings.Join(subscriptions, ","))
+	if *discoverSubscriptions {
+		_ = level.Info(logger).Log("msg", "discovered subscriptions", "subscriptions", strings.Join(subscriptions, ","))
+	} else {
+		_ = level.Info(logger).Log("msg", "subscription discovery disabled, probes must set the subscriptionID parameter")
+	}
+
+	reg.MustRegister(versionCollector.NewCollector("azure_monitor_exporter"))
 
 	// Add go runtime metrics and process collectors.
-	reg.MustRegister(
-		collectors.NewGoCollector(),
-		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
-		versionCollector.NewCollector("azure_monitor_exporter"),
-	)
+	if !*disableRuntimeMetrics {
+		reg.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
+	tracerProvider, shutdownTracerProvider, err := tracing.NewTracerProvider(ctx, *otelEndpoint)
+	if err != nil {
+		_ = level.Error(logger).Log("msg", "Error creating tracer provider", "err", err)
+
+		return 1
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracerProvider(ctx); err != nil {
+			_ = level.Warn(logger).Log("msg", "Error flushing spans", "err", err)
+		}
+	}()
 
 	queryCache := cache.NewCache[probe.Resources]()
 	metricsClientCache := cache.NewCache[azmetrics.Client]()
 
-	probeCollector, err := probe.New(logger, httpClient, cred, subscriptions, queryCache, metricsClientCache)
+	probeCollector, err := probe.New(logger, httpClient, cred, subscriptions, queryCache, metricsClientCache, probe.Options{
+		MaxPages:                 *probeMaxPages,
+		MaxSubscriptionsPerProbe: *probeMaxSubscriptions,
+		MaxSeries:                *probeMaxSeries,
+		MaxSubscriptionIDs:       *probeMaxSubscriptionIDs,
+		DeduplicateResources:     *probeDeduplicateResources,
+		LegacyMetricsFallback:    *probeLegacyMetricsFallback,
+		AllowPartialScopes:       *allowPartialScopes,
+		SubscriptionsPerQuery:    *subscriptionsPerQuery,
+		MetricsEndpointTemplate:  *metricsEndpointTemplate,
+		MetricsAudience:          *metricsAudience,
+		LogsEndpoint:             *logsEndpoint,
+		LogsAudience:             *logsAudience,
+		ResourceManagerEndpoint:  *resourceManagerEndpoint,
+		ResourceManagerAudience:  *resourceManagerAudience,
+		GlobalMetricsRegion:      *globalMetricsRegion,
+		QueryCacheJitter:         *probeQueryCacheJitter,
+		DefaultInterval:          *probeDefaultInterval,
+		DefaultAggregation:       *probeDefaultAggregation,
+		TrustProxyHeaders:        *trustProxyHeaders,
+		MetricNamesPerRequest:    *probeMetricNamesPerRequest,
+		TimeoutHeader:            *probeTimeoutHeader,
+		MaxLabelValueLength:      *probeMaxLabelValueLength,
+		UseAzureTimestamps:       *probeUseAzureTimestamps,
+		TracerProvider:           tracerProvider,
+		ConstLabels:              constLabels,
+		ResourceFile:             *probeResourceFile,
+		RequireSubscriptionIDs:   !*discoverSubscriptions,
+	})
 	if err != nil {
 		_ = level.Error(logger).Log("msg", "Error creating probe collector", "err", err)
 
 		return 1
 	}
 
-	http.HandleFunc("/probe", probeCollector.ServeHTTP(reg))
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{
-		Registry: reg,
-		ErrorLog: stdlog.New(log.NewStdlibAdapter(logger), "ERROR: ", stdlog.LstdFlags),
-	}))
+	if *check {
+		return runCheck(ctx, os.Stdout, probeCollector, subscriptions, *discoverSubscriptions)
+	}
+
+	probeCollector.RegisterMetrics(registerer)
+
+	if *contextsFile != "" {
+		if err = addContexts(ctx, logger, probeCollector, discovery, *contextsFile); err != nil {
+			_ = level.Error(logger).Log("msg", "Error adding contexts", "err", err)
+
+			return 1
+		}
+	}
+
+	for _, warmup := range *probeWarmup {
+		warmupProbe(ctx, logger, probeCollector, warmup, *probeWarmupTimeout)
+	}
+
+	if *pushRemoteWriteURL != "" {
+		if len(*pushProbes) == 0 {
+			_ = level.Error(logger).Log("msg", "--push.remote-write-url requires at least one --push.probe")
+
+			return 1
+		}
+
+		if err = parsePushProbes(*pushProbes); err != nil {
+			_ = level.Error(logger).Log("msg", "Error parsing --push.probe", "err", err)
+
+			return 1
+		}
+
+		remoteWriteClient := remotewrite.New(*pushRemoteWriteURL, &http.Client{
+			Transport: newTransport(*maxIdleConns, *maxIdleConnsPerHost, *idleConnTimeout),
+		})
 
-	landingPage, err := newLandingPage()
+		go runPush(ctx, logger, probeCollector, remoteWriteClient, *pushProbes, *pushInterval)
+	}
+
+	landingPageURL, err := parseExternalURL(*externalURL)
+	if err != nil {
+		_ = level.Error(logger).Log("msg", "Error parsing external URL", "err", err)
+
+		return 1
+	}
+
+	if *routePrefix == "" {
+		*routePrefix = landingPageURL.Path
+	}
+
+	prefix := normalizeRoutePrefix(*routePrefix)
+
+	// Without an external URL, the landing page links are relative to the route prefix.
+	if landingPageURL.Host == "" {
+		landingPageURL.Path = prefix
+	}
+
+	http.HandleFunc(prefix+"/probe", probeCollector.ServeHTTP(registerer))
+	http.HandleFunc(prefix+"/logs", probeCollector.ServeLogsHTTP(registerer))
+	http.HandleFunc(prefix+"/config", probeCollector.ServeConfigHTTP())
+	http.Handle(prefix+"/metrics", promhttp.HandlerFor(reg, probe.HandlerOpts(logger, registerer)))
+
+	if *enableAdminAPI {
+		http.HandleFunc(prefix+"/-/cache/flush", probeCollector.ServeCacheFlushHTTP())
+	}
+
+	landingPage, err := newLandingPage(strings.TrimSuffix(landingPageURL.String(), "/"))
 	if err != nil {
 		_ = level.Error(logger).Log("err", err)
 
 		return 1
 	}
 
-	http.Handle("/", landingPage)
+	http.Handle(prefix+"/", landingPage)
+
+	if prefix != "" {
+		http.Handle("/", http.RedirectHandler(prefix+"/", http.StatusFound))
+	}
 
 	srv := &http.Server{
 		ReadHeaderTimeout: time.Second * 3,
@@ -139,7 +445,7 @@ func Run() int {
 		signal.Notify(termCh, os.Interrupt, syscall.SIGTERM)
 		<-termCh
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 		defer cancel()
 
 		_ = srv.Shutdown(ctx)
@@ -148,6 +454,15 @@ func Run() int {
 	return startWebServer(srv, webConfig, logger)
 }
 
+func warmupProbe(ctx context.Context, logger log.Logger, probeCollector *probe.Probe, warmup string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := probeCollector.Warmup(ctx, warmup); err != nil {
+		_ = level.Warn(logger).Log("msg", "Error running warmup probe", "query", warmup, "err", err)
+	}
+}
+
 func startWebServer(srv *http.Server, webConfig *web.FlagConfig, logger log.Logger) int {
 	if err := web.ListenAndServe(srv, webConfig, logger); err != nil {
 		if errors.Is(err, http.ErrServerClosed) {
@@ -162,13 +477,49 @@ func startWebServer(srv *http.Server, webConfig *web.FlagConfig, logger log.Logg
 	return 0
 }
 
-func newLandingPage() (*web.LandingPageHandler, error) {
+// normalizeRoutePrefix returns the route prefix with a leading and without a trailing slash.
+// The root prefix results in an empty string.
+func normalizeRoutePrefix(routePrefix string) string {
+	routePrefix = strings.Trim(routePrefix, "/")
+	if routePrefix == "" {
+		return ""
+	}
+
+	return "/" + routePrefix
+}
+
+// parseExternalURL parses and validates the external URL. An empty URL results in an empty *url.URL.
+func parseExternalURL(externalURL string) (*url.URL, error) {
+	if externalURL == "" {
+		return &url.URL{}, nil
+	}
+
+	parsedURL, err := url.Parse(externalURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external URL %q: %w", externalURL, err)
+	}
+
+	if (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return nil, fmt.Errorf("invalid external URL %q: must be an absolute http or https URL", externalURL)
+	}
+
+	if parsedURL.RawQuery != "" || parsedURL.Fragment != "" {
+		return nil, fmt.Errorf("invalid external URL %q: must not contain a query or fragment", externalURL)
+	}
+
+	parsedURL.Path = normalizeRoutePrefix(parsedURL.Path)
+
+	return parsedURL, nil
+}
+
+// newLandingPage returns the landing page. The links are relative to the given base URL.
+func newLandingPage(baseURL string) (*web.LandingPageHandler, error) {
 	landingPage, err := web.NewLandingPage(web.LandingConfig{
 		Name:        "azure-monitor-exporter",
 		Description: "Prometheus Exporter for Azure Monitor",
 		Version:     version.Info(),
 		Form: web.LandingForm{
-			Action: "/probe",
+			Action: baseURL + "/probe",
 			Inputs: []web.LandingFormInput{
 				{
 					Label:       "Resource Graph Query",
@@ -210,7 +561,7 @@ func newLandingPage() (*web.LandingPageHandler, error) {
 		},
 		Links: []web.LandingLinks{
 			{
-				Address: "/metrics",
+				Address: baseURL + "/metrics",
 				Text:    "Metrics",
 			},
 		},
@@ -222,32 +573,39 @@ func newLandingPage() (*web.LandingPageHandler, error) {
 	return landingPage, nil
 }
 
-func discoverSubscriptions(ctx context.Context, cred azcore.TokenCredential, httpClient *http.Client) ([]string, error) {
-	subscriptionClient, err := armsubscription.NewSubscriptionsClient(cred, &arm.ClientOptions{
-		ClientOptions: azcore.ClientOptions{
-			Transport: httpClient,
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create subscription client: %w", err)
-	}
+// reservedConstLabels are label names of the metrics of the exporter, which cannot be used as const labels.
+var reservedConstLabels = []string{
+	"cloud", "code", "context", "endpoint", "instance", "le", "location", "method", "metric", "phase", "quantile", "reason", "scope",
+	"subscription_id", "target", "type",
+}
 
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+// parseConstLabels parses the --web.const-labels flag in the form name=value,name=value.
+func parseConstLabels(constLabels string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
 
-	subscriptions := make([]string, 0)
+	for _, constLabel := range strings.Split(constLabels, ",") {
+		if strings.TrimSpace(constLabel) == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(constLabel, "=")
+		name = strings.TrimSpace(name)
 
-	pager := subscriptionClient.NewListPager(nil)
-	for pager.More() {
-		page, err := pager.NextPage(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to advance page: %w", err)
+		switch {
+		case !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__"):
+			return nil, fmt.Errorf("invalid label name %q", name)
+		case value == "":
+			return nil, fmt.Errorf("label %q must have a value", name)
+		case slices.Contains(reservedConstLabels, name):
+			return nil, fmt.Errorf("label %q is used by the metrics of the exporter", name)
 		}
 
-		for _, v := range page.Value {
-			subscriptions = append(subscriptions, *v.SubscriptionID)
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("label %q is defined twice", name)
 		}
+
+		labels[name] = value
 	}
 
-	return subscriptions, nil
+	return labels, nil
 }
@@ -0,0 +1,81 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/jkroepke/azure-monitor-exporter/pkg/probe"
+	"github.com/jkroepke/azure-monitor-exporter/pkg/remotewrite"
+)
+
+// parsePushProbes validates the probe parameters of --push.probe. The configurations are parsed again on every run,
+// because the time span of a probe is relative to the time the configuration is parsed.
+func parsePushProbes(pushProbes []string) error {
+	for _, pushProbe := range pushProbes {
+		query, err := url.ParseQuery(pushProbe)
+		if err != nil {
+			return fmt.Errorf("error parsing push probe %q: %w", pushProbe, err)
+		}
+
+		if _, err = probe.NewConfigFromValues(query); err != nil {
+			return fmt.Errorf("error parsing push probe %q: %w", pushProbe, err)
+		}
+	}
+
+	return nil
+}
+
+// runPush runs the push probes every interval and sends their metrics to the remote write endpoint until ctx is done.
+// The timeout of each probe is the interval.
+func runPush(ctx context.Context, logger log.Logger, probeCollector *probe.Probe, client *remotewrite.Client, pushProbes []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, pushProbe := range pushProbes {
+			if err := runPushProbe(ctx, probeCollector, client, pushProbe, interval); err != nil {
+				_ = level.Warn(logger).Log("msg", "Error running push probe", "query", pushProbe, "err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runPushProbe runs a single push probe and sends the collected metrics to the remote write endpoint.
+// Like a scrape, the metrics collected until an error are sent together with the scrape metrics of the probe.
+func runPushProbe(ctx context.Context, probeCollector *probe.Probe, client *remotewrite.Client, pushProbe string, timeout time.Duration) error {
+	query, err := url.ParseQuery(pushProbe)
+	if err != nil {
+		return fmt.Errorf("error parsing push probe: %w", err)
+	}
+
+	config, err := probe.NewConfigFromValues(query)
+	if err != nil {
+		return fmt.Errorf("error parsing push probe: %w", err)
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	timestamp := time.Now()
+
+	metrics, probeErr := probeCollector.Run(probeCtx, config)
+	if len(metrics) == 0 {
+		return probeErr
+	}
+
+	if err = client.Write(ctx, metrics, timestamp); err != nil {
+		return err //nolint:wrapcheck // error is wrapped by the remote write client
+	}
+
+	return probeErr
+}
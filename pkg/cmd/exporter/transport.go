@@ -0,0 +1,131 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newTransport returns a clone of http.DefaultTransport with the given connection pool settings.
+// A probe queries the metrics endpoints of many regions concurrently, the default of 2 idle connections per host
+// results in additional TLS handshakes under load.
+func newTransport(maxIdleConns, maxIdleConnsPerHost int, idleConnTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert // http.DefaultTransport is a *http.Transport
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = idleConnTimeout
+
+	return transport
+}
+
+// responseTooLargeError is returned, if an Azure API response exceeds --azure.max-response-bytes.
+type responseTooLargeError struct {
+	url      string
+	maxBytes int64
+}
+
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("response of %s exceeds the limit of %d bytes", e.url, e.maxBytes)
+}
+
+// NonRetriable prevents the retry policy of the Azure SDK from requesting the same response again.
+func (e *responseTooLargeError) NonRetriable() {}
+
+// limitedBody returns an error instead of io.EOF, once more than maxBytes have been read.
+type limitedBody struct {
+	io.ReadCloser
+
+	err       error
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, b.err
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+
+	if b.remaining <= 0 {
+		return n, b.err
+	}
+
+	return n, err //nolint:wrapcheck // io.Reader errors must not be wrapped
+}
+
+// limitResponseBody limits the response bodies of the transport to maxBytes. Responses with a larger Content-Length
+// are rejected before the body is read. 0 disables the limit.
+func limitResponseBody(maxBytes int64, next http.RoundTripper) http.RoundTripper {
+	if maxBytes <= 0 {
+		return next
+	}
+
+	return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return resp, err //nolint:wrapcheck
+		}
+
+		tooLargeErr := &responseTooLargeError{url: req.URL.Host + req.URL.Path, maxBytes: maxBytes}
+
+		if resp.ContentLength > maxBytes {
+			_ = resp.Body.Close()
+
+			return nil, tooLargeErr
+		}
+
+		// Allow one byte more than maxBytes to distinguish a body of exactly maxBytes from a larger one.
+		resp.Body = &limitedBody{ReadCloser: resp.Body, err: tooLargeErr, remaining: maxBytes + 1}
+
+		return resp, nil
+	})
+}
+
+// azureHostType classifies the Azure API of a request for the request log.
+func azureHostType(req *http.Request) string {
+	host := strings.ToLower(req.URL.Hostname())
+
+	switch {
+	case strings.HasSuffix(host, ".metrics.monitor.azure.com"):
+		return "metrics"
+	case strings.HasPrefix(host, "login."):
+		return "login"
+	case strings.Contains(strings.ToLower(req.URL.Path), "/providers/microsoft.resourcegraph/"):
+		return "resourcegraph"
+	case strings.HasPrefix(host, "management."):
+		return "management"
+	default:
+		return host
+	}
+}
+
+// logRequests logs the method, API, status and duration of each request of the transport at debug level.
+func logRequests(logger log.Logger, next http.RoundTripper) http.RoundTripper {
+	return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		startTime := time.Now()
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			_ = level.Debug(logger).Log("msg", "azure request failed", "method", req.Method, "host_type", azureHostType(req),
+				"duration", time.Since(startTime), "err", err)
+
+			return resp, err //nolint:wrapcheck
+		}
+
+		_ = level.Debug(logger).Log("msg", "azure request", "method", req.Method, "host_type", azureHostType(req),
+			"status", resp.StatusCode, "duration", time.Since(startTime))
+
+		return resp, nil
+	})
+}
@@ -0,0 +1,156 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// trackedBody records, whether a response body has been read and closed.
+type trackedBody struct {
+	io.Reader
+
+	read, closed bool
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	b.read = true
+
+	return b.Reader.Read(p) //nolint:wrapcheck
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+
+	return nil
+}
+
+func TestLimitResponseBody(t *testing.T) {
+	t.Parallel()
+
+	const maxBytes = 1024
+
+	for _, tc := range []struct {
+		name          string
+		maxBytes      int64
+		bodyLength    int
+		contentLength int64
+		tooLarge      bool
+		rejected      bool
+	}{
+		{name: "body of exactly maxBytes", maxBytes: maxBytes, bodyLength: maxBytes, contentLength: -1},
+		{name: "body of maxBytes+1", maxBytes: maxBytes, bodyLength: maxBytes + 1, contentLength: -1, tooLarge: true},
+		{name: "Content-Length of maxBytes", maxBytes: maxBytes, bodyLength: maxBytes, contentLength: maxBytes},
+		{name: "Content-Length over the limit", maxBytes: maxBytes, bodyLength: maxBytes + 1, contentLength: maxBytes + 1, rejected: true},
+		{name: "no limit", maxBytes: 0, bodyLength: 16 * maxBytes, contentLength: 16 * maxBytes},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			body := &trackedBody{Reader: bytes.NewReader(bytes.Repeat([]byte{'a'}, tc.bodyLength))}
+
+			transport := limitResponseBody(tc.maxBytes, promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: body, ContentLength: tc.contentLength, Request: req}, nil
+			}))
+
+			resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "https://management.azure.com/subscriptions", nil))
+
+			var tooLargeErr *responseTooLargeError
+
+			// A Content-Length over the limit is rejected before the body is read.
+			if tc.rejected {
+				require.ErrorAs(t, err, &tooLargeErr)
+				assert.EqualError(t, err, "response of management.azure.com/subscriptions exceeds the limit of 1024 bytes")
+				assert.Nil(t, resp)
+				assert.False(t, body.read)
+				assert.True(t, body.closed)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, resp.Body.Close())
+			assert.True(t, body.closed)
+
+			if tc.tooLarge {
+				require.ErrorAs(t, err, &tooLargeErr)
+				assert.Len(t, data, int(tc.maxBytes)+1)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Len(t, data, tc.bodyLength)
+		})
+	}
+}
+
+// BenchmarkTransport measures the connection reuse of bursts of concurrent requests to a single host, like a probe
+// querying the metrics endpoint of a region. newConns/op reports the number of new TLS connections per burst.
+func BenchmarkTransport(b *testing.B) {
+	const concurrency = 16
+
+	for _, maxIdleConnsPerHost := range []int{http.DefaultMaxIdleConnsPerHost, concurrency} {
+		b.Run(fmt.Sprintf("max-idle-conns-per-host=%d", maxIdleConnsPerHost), func(b *testing.B) {
+			var newConns atomic.Int64
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte(`{"value":[]}`))
+			}))
+			server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					newConns.Add(1)
+				}
+			}
+			server.StartTLS()
+			b.Cleanup(server.Close)
+
+			transport := newTransport(100, maxIdleConnsPerHost, 90*time.Second)
+			transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone() //nolint:forcetypeassert
+			b.Cleanup(transport.CloseIdleConnections)
+
+			client := &http.Client{Transport: transport}
+
+			b.ResetTimer()
+
+			for range b.N {
+				var wg sync.WaitGroup
+
+				for range concurrency {
+					wg.Add(1)
+
+					go func() {
+						defer wg.Done()
+
+						resp, err := client.Get(server.URL) //nolint:noctx
+						if err != nil {
+							b.Error(err)
+
+							return
+						}
+
+						_, _ = io.Copy(io.Discard, resp.Body)
+						_ = resp.Body.Close()
+					}()
+				}
+
+				wg.Wait()
+			}
+
+			b.ReportMetric(float64(newConns.Load())/float64(b.N), "newConns/op")
+		})
+	}
+}
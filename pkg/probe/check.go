@@ -0,0 +1,125 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
+)
+
+// checkQuery returns a single resource of a resource type, which is known to provide metrics.
+const checkQuery = `Resources
+| where type in~ ('microsoft.compute/virtualmachines', 'microsoft.storage/storageaccounts', 'microsoft.network/publicipaddresses',
+	'microsoft.network/loadbalancers', 'microsoft.keyvault/vaults', 'microsoft.web/sites', 'microsoft.sql/servers/databases')
+| project id, type, subscriptionId, location
+| take 1`
+
+// CheckResult is the result of a single step of Probe.Check.
+type CheckResult struct {
+	Step string
+	// Detail describes the result of a successful step.
+	Detail string
+	Err    error
+	// Hint describes how to fix a failed step.
+	Hint string
+}
+
+// Check validates the credential and the permissions of the default context. It runs a Resource Graph query and
+// queries the metric definitions and metrics of the returned resource. Steps after a failed step are not run.
+func (p *Probe) Check(ctx context.Context) []CheckResult {
+	credentials := p.defaultContext
+	results := make([]CheckResult, 0, 3)
+
+	response, err := credentials.resourceGraphClient.Resources(ctx, armresourcegraph.QueryRequest{
+		Query:         to.Ptr(checkQuery),
+		Subscriptions: to.SliceOfPtrs(credentials.subscriptions...),
+	}, nil)
+	if err != nil {
+		return append(results, CheckResult{
+			Step: "resource graph query",
+			Err:  fmt.Errorf("error querying resource graph: %w", err),
+			Hint: "Assign the Reader role on the subscriptions to the identity of the exporter.",
+		})
+	}
+
+	resource, err := parseCheckResource(response.Data)
+	if err != nil {
+		return append(results, CheckResult{
+			Step: "resource graph query",
+			Err:  err,
+			Hint: "Ensure that the identity of the exporter has the Reader role on subscriptions containing resources.",
+		})
+	}
+
+	results = append(results, CheckResult{Step: "resource graph query", Detail: "found resource " + resource.id})
+
+	metricNames, err := metricDefinitions(ctx, credentials, resource.id, resource.resourceType)
+	if err != nil {
+		return append(results, CheckResult{
+			Step: "metric definitions",
+			Err:  err,
+			Hint: "Assign the Monitoring Reader role on the subscriptions to the identity of the exporter.",
+		})
+	}
+
+	results = append(results, CheckResult{Step: "metric definitions", Detail: fmt.Sprintf("found %d metrics of %s", len(metricNames), resource.resourceType)})
+
+	client, err := p.getMetricsClient(credentials, resource.subscriptionID, resource.location)
+	if err == nil {
+		_, err = client.QueryResources(ctx, resource.subscriptionID, resource.resourceType, metricNames[:1],
+			azmetrics.ResourceIDList{ResourceIDs: []string{resource.id}}, nil)
+	}
+
+	if err != nil {
+		return append(results, CheckResult{
+			Step: "metrics query",
+			Err:  fmt.Errorf("error querying metrics: %w", err),
+			Hint: "Assign the Monitoring Reader role on the subscriptions to the identity of the exporter and check the metrics endpoint of the region.",
+		})
+	}
+
+	return append(results, CheckResult{Step: "metrics query", Detail: fmt.Sprintf("queried %s of %s", metricNames[0], resource.id)})
+}
+
+// checkResource is the resource returned by checkQuery.
+type checkResource struct {
+	id             string
+	resourceType   string
+	subscriptionID string
+	location       string
+}
+
+// parseCheckResource returns the resource of the checkQuery response.
+func parseCheckResource(data any) (checkResource, error) {
+	rows, ok := data.([]any)
+	if !ok {
+		return checkResource{}, fmt.Errorf("unexpected resource graph response: %+v", data)
+	}
+
+	if len(rows) == 0 {
+		return checkResource{}, errors.New("no resource with metrics found")
+	}
+
+	row, ok := rows[0].(map[string]any)
+	if !ok {
+		return checkResource{}, fmt.Errorf("unexpected resource graph row: %+v", rows[0])
+	}
+
+	values := make(map[string]string, 4)
+
+	for _, column := range []string{"id", "type", "subscriptionId", "location"} {
+		if values[column], ok = row[column].(string); !ok {
+			return checkResource{}, fmt.Errorf("unexpected resource graph row: missing column %s", column)
+		}
+	}
+
+	return checkResource{
+		id:             values["id"],
+		resourceType:   values["type"],
+		subscriptionID: values["subscriptionId"],
+		location:       values["location"],
+	}, nil
+}
@@ -3,19 +3,124 @@ package probe
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/sosodev/duration"
 )
 
-//nolint:cyclop
+// allMetricNames is the value of the metricName parameter, which queries all available metrics of the metric namespace.
+const allMetricNames = "*"
+
+// multiValueParameters contains the parameters, which accept multiple values in the form "name" or "name[]".
+var multiValueParameters = []string{
+	"subscriptionID", "metricName", "aggregation", "preferredAggregation", "dimension", "booleanMetrics", "valueScale", "constLabel",
+	"metricType",
+}
+
+// headerParameterPrefix is the prefix of request headers, which supply probe parameters, e.g. X-Azure-Monitor-ResourceType.
+const headerParameterPrefix = "X-Azure-Monitor-"
+
+// probeParameters contains all probe parameters. Each parameter can also be supplied as header with headerParameterPrefix.
+var probeParameters = []string{
+	"subscriptionID", "resourceType", "metricName", "metricNamespace", "metricPrefix", "nameCase", "aggregation", "preferredAggregation",
+	"dimension", "filter", "top", "orderBy", "interval", "timespan", "round", "query", "queryCacheExpiration", "context", "resultFormat",
+	"booleanMetrics", "booleanThreshold", "regionLabel", "includeMetricID", "includeInterval", "emitResourceCount",
+	"dropSingleValueDimensions", "skipNullMetrics", "useAzureTimestamps", "target", "region", "labelCollision", "valueScale",
+	"constLabel", "noCache", "includeTimeWindow", "metricType", "noContentOnEmpty", "resourceFile",
+	"useConfiguredNamespace", "scope", "includeCacheKey", "rollUpBy", "instanceFormat",
+	"emitResourceInfo", "metricCacheExpiration", "maxAge", "timeout",
+}
+
+// regionRegexp matches the names of Azure regions, which are part of the metrics endpoint.
+var regionRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// parameterDependencies contains parameters, which have no effect without at least one of the required parameters.
+// Multi-value parameters are also accepted in the form "name[]".
+var parameterDependencies = []struct {
+	parameter string
+	requires  []string
+}{
+	{parameter: "booleanThreshold", requires: []string{"booleanMetrics"}},
+	{parameter: "top", requires: []string{"filter", "dimension"}},
+	{parameter: "orderBy", requires: []string{"filter", "dimension"}},
+	{parameter: "rollUpBy", requires: []string{"filter", "dimension"}},
+}
+
+const (
+	// rawAggregation is the value of the aggregation parameter, which emits the raw time series.
+	rawAggregation = "none"
+	// rawMetricSuffix replaces the aggregation in the metric name of raw time series.
+	rawMetricSuffix = "raw"
+)
+
+const (
+	// metricTypeGauge is the default value of the metricType parameter.
+	metricTypeGauge = "gauge"
+	// metricTypeCounter emits metrics as counter, e.g. monotonic totals.
+	metricTypeCounter = "counter"
+)
+
+// aggregationTypes contains all aggregation types supported by Azure Monitor in the default order of preference.
+var aggregationTypes = []string{"average", "total", "maximum", "minimum", "count"}
+
+// GetConfigFromRequest returns the probe configuration from the query parameters of the request.
+// Parameters absent from the query string are read from the request headers.
 func GetConfigFromRequest(request *http.Request) (*Config, error) {
+	config, err := NewConfigFromValues(parametersFromRequest(request))
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache-Control: no-cache is an alternative to noCache=true for clients, which cannot change the query string.
+	for _, cacheControl := range request.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				config.NoCache = true
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// parametersFromRequest returns the probe parameters of the request.
+// If a parameter is absent from the query string, the values of the header X-Azure-Monitor-<parameter> are used.
+// Query parameters take precedence over headers.
+func parametersFromRequest(request *http.Request) url.Values {
 	query := request.URL.Query()
 
+	for _, parameter := range probeParameters {
+		if query.Has(parameter) || query.Has(parameter+"[]") {
+			continue
+		}
+
+		if values := request.Header.Values(headerParameterPrefix + parameter); len(values) != 0 {
+			query[parameter] = values
+		}
+	}
+
+	return query
+}
+
+// NewConfigFromValues returns the probe configuration from the given probe parameters.
+//
+//nolint:cyclop
+func NewConfigFromValues(query url.Values) (*Config, error) {
+	if err := validateParameterCombinations(query); err != nil {
+		return nil, err
+	}
+
 	probeConfig := &Config{}
 	if len(query["subscriptionID"]) != 0 {
 		probeConfig.Subscriptions = query["subscriptionID"]
@@ -37,11 +142,46 @@ func GetConfigFromRequest(request *http.Request) (*Config, error) {
 		return nil, errors.New("'metricName' parameter must be specified")
 	}
 
+	if len(probeConfig.MetricNames) > 1 && slices.Contains(probeConfig.MetricNames, allMetricNames) {
+		return nil, errors.New("'metricName' parameter must not combine * with other metric names")
+	}
+
+	probeConfig.NameCase = nameCaseLower
+
+	if len(query["nameCase"]) == 1 {
+		probeConfig.NameCase = query.Get("nameCase")
+		if !slices.Contains(nameCases, probeConfig.NameCase) {
+			return nil, fmt.Errorf("'nameCase' parameter must be one of %s", strings.Join(nameCases, ", "))
+		}
+	} else if len(query["nameCase"]) > 1 {
+		return nil, errors.New("'nameCase' parameter must be specified once")
+	}
+
+	probeConfig.ResultFormat = armresourcegraph.ResultFormatObjectArray
+
+	if len(query["resultFormat"]) == 1 {
+		probeConfig.ResultFormat = armresourcegraph.ResultFormat(query.Get("resultFormat"))
+		if !slices.Contains(armresourcegraph.PossibleResultFormatValues(), probeConfig.ResultFormat) {
+			return nil, errors.New("'resultFormat' parameter must be one of objectArray, table")
+		}
+	} else if len(query["resultFormat"]) > 1 {
+		return nil, errors.New("'resultFormat' parameter must be specified once")
+	}
+
 	probeConfig.Query = "Resources"
 	if len(query["query"]) == 1 {
 		probeConfig.Query = query.Get("query")
 	}
 
+	if len(query["resourceFile"]) == 1 {
+		probeConfig.ResourceFile = query.Get("resourceFile")
+		if query.Has("query") {
+			return nil, errors.New("'resourceFile' and 'query' parameters are mutually exclusive")
+		}
+	} else if len(query["resourceFile"]) > 1 {
+		return nil, errors.New("'resourceFile' parameter must be specified once")
+	}
+
 	switch {
 	case len(query["aggregation"]) == 1:
 		probeConfig.Aggregation = to.Ptr(query.Get("aggregation"))
@@ -53,6 +193,59 @@ func GetConfigFromRequest(request *http.Request) (*Config, error) {
 		probeConfig.Aggregation = to.Ptr(strings.Join(query["aggregation[]"], ","))
 	}
 
+	// Without aggregation, Azure returns the primary aggregation of each metric.
+	if probeConfig.Aggregation != nil && strings.EqualFold(strings.TrimSpace(*probeConfig.Aggregation), rawAggregation) {
+		probeConfig.Aggregation = nil
+		probeConfig.RawTimeSeries = true
+	}
+
+	if probeConfig.Aggregation != nil {
+		aggregation, metricAggregations, err := parseAggregation(*probeConfig.Aggregation, probeConfig.MetricNames)
+		if err != nil {
+			return nil, err
+		}
+
+		probeConfig.Aggregation = nil
+		if aggregation != "" {
+			probeConfig.Aggregation = to.Ptr(aggregation)
+		}
+
+		probeConfig.MetricAggregations = metricAggregations
+	}
+
+	var preferredAggregations []string
+
+	switch {
+	case len(query["preferredAggregation"]) != 0:
+		preferredAggregations = query["preferredAggregation"]
+	case len(query["preferredAggregation[]"]) != 0:
+		preferredAggregations = query["preferredAggregation[]"]
+	}
+
+	for _, preferredAggregation := range strings.Split(strings.Join(preferredAggregations, ","), ",") {
+		if preferredAggregation == "" {
+			continue
+		}
+
+		preferredAggregation = strings.ToLower(strings.TrimSpace(preferredAggregation))
+		if !slices.Contains(aggregationTypes, preferredAggregation) {
+			return nil, fmt.Errorf("'preferredAggregation' parameter must be one of %s", strings.Join(aggregationTypes, ", "))
+		}
+
+		probeConfig.PreferredAggregations = append(probeConfig.PreferredAggregations, preferredAggregation)
+	}
+
+	if probeConfig.RawTimeSeries && len(probeConfig.PreferredAggregations) != 0 {
+		return nil, fmt.Errorf("'preferredAggregation' parameter must not be combined with aggregation=%s", rawAggregation)
+	}
+
+	// An explicit aggregation is authoritative. Otherwise, request all aggregations to be able to fall back.
+	if probeConfig.Aggregation != nil {
+		probeConfig.PreferredAggregations = nil
+	} else if len(probeConfig.PreferredAggregations) != 0 {
+		probeConfig.Aggregation = to.Ptr(strings.Join(aggregationTypes, ","))
+	}
+
 	if len(query["interval"]) == 1 {
 		probeConfig.Interval = to.Ptr(query.Get("interval"))
 	} else if len(query["interval"]) > 1 {
@@ -80,6 +273,35 @@ func GetConfigFromRequest(request *http.Request) (*Config, error) {
 		return nil, errors.New("'filter' parameter must be specified once")
 	}
 
+	var dimensions []string
+
+	switch {
+	case len(query["dimension"]) != 0:
+		dimensions = query["dimension"]
+	case len(query["dimension[]"]) != 0:
+		dimensions = query["dimension[]"]
+	}
+
+	if len(dimensions) != 0 {
+		dimensionFilter := buildDimensionFilter(dimensions)
+
+		if probeConfig.Filter == nil {
+			probeConfig.Filter = to.Ptr(dimensionFilter)
+		} else {
+			// The parentheses keep the meaning of filters combining clauses with "or".
+			probeConfig.Filter = to.Ptr("(" + *probeConfig.Filter + ") and " + dimensionFilter)
+		}
+	}
+
+	if probeConfig.Filter != nil {
+		filter, err := normalizeFilter(*probeConfig.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("'filter' parameter is invalid: %w", err)
+		}
+
+		probeConfig.Filter = to.Ptr(filter)
+	}
+
 	if len(query["metricPrefix"]) == 1 {
 		probeConfig.MetricPrefix = query.Get("metricPrefix")
 	} else if len(query["metricPrefix"]) > 1 {
@@ -90,6 +312,98 @@ func GetConfigFromRequest(request *http.Request) (*Config, error) {
 		probeConfig.MetricPrefix = "azure_monitor"
 	}
 
+	probeConfig.LabelCollision = labelCollisionPrefixDimension
+
+	if len(query["labelCollision"]) == 1 {
+		probeConfig.LabelCollision = query.Get("labelCollision")
+		if !slices.Contains(labelCollisions, probeConfig.LabelCollision) {
+			return nil, fmt.Errorf("'labelCollision' parameter must be one of %s", strings.Join(labelCollisions, ", "))
+		}
+	} else if len(query["labelCollision"]) > 1 {
+		return nil, errors.New("'labelCollision' parameter must be specified once")
+	}
+
+	probeConfig.InstanceFormat = instanceFormatFullID
+
+	if len(query["instanceFormat"]) == 1 {
+		probeConfig.InstanceFormat = query.Get("instanceFormat")
+		if !slices.Contains(instanceFormats, probeConfig.InstanceFormat) {
+			return nil, fmt.Errorf("'instanceFormat' parameter must be one of %s", strings.Join(instanceFormats, ", "))
+		}
+	} else if len(query["instanceFormat"]) > 1 {
+		return nil, errors.New("'instanceFormat' parameter must be specified once")
+	}
+
+	if len(query["region"]) == 1 {
+		probeConfig.Region = strings.ToLower(query.Get("region"))
+		if !regionRegexp.MatchString(probeConfig.Region) {
+			return nil, errors.New("'region' parameter must be an Azure region name, e.g. westeurope")
+		}
+	} else if len(query["region"]) > 1 {
+		return nil, errors.New("'region' parameter must be specified once")
+	}
+
+	probeConfig.Scope = scopeResource
+
+	if len(query["scope"]) == 1 {
+		probeConfig.Scope = query.Get("scope")
+		if !slices.Contains(scopes, probeConfig.Scope) {
+			return nil, fmt.Errorf("'scope' parameter must be one of %s", strings.Join(scopes, ", "))
+		}
+	} else if len(query["scope"]) > 1 {
+		return nil, errors.New("'scope' parameter must be specified once")
+	}
+
+	if probeConfig.Scope == scopeSubscription {
+		switch {
+		case probeConfig.Region == "":
+			return nil, errors.New("'scope' parameter subscription requires the 'region' parameter")
+		case query.Has("query"), query.Has("resourceFile"):
+			return nil, errors.New("'scope' parameter subscription is mutually exclusive with the 'query' and 'resourceFile' parameters")
+		case probeConfig.AllMetricNames():
+			return nil, errors.New("'scope' parameter subscription requires explicit metric names, metricName=* is not supported")
+		}
+	}
+
+	if len(query["target"]) == 1 {
+		probeConfig.Target = query.Get("target")
+	} else if len(query["target"]) > 1 {
+		return nil, errors.New("'target' parameter must be specified once")
+	}
+
+	if len(query["context"]) == 1 {
+		probeConfig.Context = query.Get("context")
+	} else if len(query["context"]) > 1 {
+		return nil, errors.New("'context' parameter must be specified once")
+	}
+
+	probeConfig.RegionLabel = "region"
+
+	if len(query["regionLabel"]) == 1 {
+		probeConfig.RegionLabel = query.Get("regionLabel")
+		if !model.LabelName(probeConfig.RegionLabel).IsValid() || strings.HasPrefix(probeConfig.RegionLabel, "__") {
+			return nil, errors.New("'regionLabel' parameter must be a valid Prometheus label name")
+		}
+
+		if probeConfig.RegionLabel == "instance" || probeConfig.RegionLabel == "subscription_id" {
+			return nil, fmt.Errorf("'regionLabel' parameter must not be %q", probeConfig.RegionLabel)
+		}
+	} else if len(query["regionLabel"]) > 1 {
+		return nil, errors.New("'regionLabel' parameter must be specified once")
+	}
+
+	constLabels := query["constLabel"]
+	if len(constLabels) == 0 {
+		constLabels = query["constLabel[]"]
+	}
+
+	constLabelsConfig, err := parseConstLabels(constLabels, probeConfig.RegionLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.ConstLabels = constLabelsConfig
+
 	probeConfig.MetricNamespace = query.Get("metricNamespace")
 
 	if len(query["metricNamespace"]) > 1 {
@@ -111,6 +425,152 @@ func GetConfigFromRequest(request *http.Request) (*Config, error) {
 		probeConfig.Top = to.Ptr(int32(1000))
 	}
 
+	if len(query["orderBy"]) == 1 {
+		probeConfig.OrderBy = to.Ptr(query.Get("orderBy"))
+	} else if len(query["orderBy"]) > 1 {
+		return nil, errors.New("'orderBy' parameter must be specified once")
+	}
+
+	if len(query["rollUpBy"]) == 1 {
+		probeConfig.RollUpBy = to.Ptr(query.Get("rollUpBy"))
+	} else if len(query["rollUpBy"]) > 1 {
+		return nil, errors.New("'rollUpBy' parameter must be specified once")
+	}
+
+	dropSingleValueDimensions, err := getBoolParameter(query, "dropSingleValueDimensions")
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.DropSingleValueDimensions = dropSingleValueDimensions
+
+	probeConfig.EmitResourceCount, err = getBoolParameter(query, "emitResourceCount")
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.EmitResourceInfo, err = getBoolParameter(query, "emitResourceInfo")
+	if err != nil {
+		return nil, err
+	}
+
+	if probeConfig.EmitResourceInfo && probeConfig.Scope == scopeSubscription {
+		return nil, errors.New("'emitResourceInfo' parameter is not supported with scope=subscription")
+	}
+
+	probeConfig.IncludeMetricID, err = getBoolParameter(query, "includeMetricID")
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.IncludeInterval, err = getBoolParameter(query, "includeInterval")
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.IncludeTimeWindow, err = getBoolParameter(query, "includeTimeWindow")
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.SkipNullMetrics, err = getBoolParameter(query, "skipNullMetrics")
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.NoCache, err = getBoolParameter(query, "noCache")
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.IncludeCacheKey, err = getBoolParameter(query, "includeCacheKey")
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.NoContentOnEmpty, err = getBoolParameter(query, "noContentOnEmpty")
+	if err != nil {
+		return nil, err
+	}
+
+	probeConfig.UseConfiguredNamespace, err = getBoolParameter(query, "useConfiguredNamespace")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(query["useAzureTimestamps"]) != 0 {
+		useAzureTimestamps, err := getBoolParameter(query, "useAzureTimestamps")
+		if err != nil {
+			return nil, err
+		}
+
+		probeConfig.UseAzureTimestamps = &useAzureTimestamps
+	}
+
+	var booleanMetrics []string
+
+	switch {
+	case len(query["booleanMetrics"]) != 0:
+		booleanMetrics = query["booleanMetrics"]
+	case len(query["booleanMetrics[]"]) != 0:
+		booleanMetrics = query["booleanMetrics[]"]
+	}
+
+	for _, booleanMetric := range strings.Split(strings.Join(booleanMetrics, ","), ",") {
+		booleanMetric = strings.TrimSpace(booleanMetric)
+		if booleanMetric == "" {
+			continue
+		}
+
+		if !containsMetricName(probeConfig.MetricNames, booleanMetric) {
+			return nil, fmt.Errorf("'booleanMetrics' parameter references metric %q, which is not part of the 'metricName' parameter", booleanMetric)
+		}
+
+		probeConfig.BooleanMetrics = append(probeConfig.BooleanMetrics, strings.ToLower(booleanMetric))
+	}
+
+	probeConfig.BooleanThreshold = 1
+
+	if len(query["booleanThreshold"]) == 1 {
+		probeConfig.BooleanThreshold, err = strconv.ParseFloat(query.Get("booleanThreshold"), 64)
+		if err != nil {
+			return nil, errors.New("'booleanThreshold' parameter must be a number")
+		}
+	} else if len(query["booleanThreshold"]) > 1 {
+		return nil, errors.New("'booleanThreshold' parameter must be specified once")
+	}
+
+	valueScales := query["valueScale"]
+	if len(valueScales) == 0 {
+		valueScales = query["valueScale[]"]
+	}
+
+	probeConfig.ValueScale, probeConfig.MetricValueScales, err = parseValueScale(strings.Join(valueScales, ","), probeConfig.MetricNames)
+	if err != nil {
+		return nil, err
+	}
+
+	metricTypes := query["metricType"]
+	if len(metricTypes) == 0 {
+		metricTypes = query["metricType[]"]
+	}
+
+	probeConfig.MetricType, probeConfig.MetricTypes, err = parseMetricType(strings.Join(metricTypes, ","), probeConfig.MetricNames)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(query["round"]) == 1 {
+		round, err := strconv.Atoi(query.Get("round"))
+		if err != nil || round < 0 {
+			return nil, errors.New("'round' parameter must be a non-negative integer")
+		}
+
+		probeConfig.Round = &round
+	} else if len(query["round"]) > 1 {
+		return nil, errors.New("'round' parameter must be specified once")
+	}
+
 	if len(query["queryCacheExpiration"]) == 1 {
 		var err error
 
@@ -122,5 +582,358 @@ func GetConfigFromRequest(request *http.Request) (*Config, error) {
 		return nil, errors.New("'queryCacheExpiration' parameter must be specified once")
 	}
 
+	if len(query["metricCacheExpiration"]) == 1 {
+		var err error
+
+		probeConfig.MetricCacheExpiration, err = time.ParseDuration(query.Get("metricCacheExpiration"))
+		if err != nil || probeConfig.MetricCacheExpiration < 0 {
+			return nil, errors.New("'metricCacheExpiration' parameter must be a non-negative duration")
+		}
+	} else if len(query["metricCacheExpiration"]) > 1 {
+		return nil, errors.New("'metricCacheExpiration' parameter must be specified once")
+	}
+
+	if len(query["maxAge"]) == 1 {
+		var err error
+
+		probeConfig.MaxAge, err = time.ParseDuration(query.Get("maxAge"))
+		if err != nil || probeConfig.MaxAge <= 0 {
+			return nil, errors.New("'maxAge' parameter must be a positive duration")
+		}
+	} else if len(query["maxAge"]) > 1 {
+		return nil, errors.New("'maxAge' parameter must be specified once")
+	}
+
+	probeConfig.Timeout, err = parseTimeout(query)
+	if err != nil {
+		return nil, err
+	}
+
 	return probeConfig, nil
 }
+
+// parseTimeout returns the 'timeout' parameter in seconds, or 0 if the parameter is absent.
+func parseTimeout(query url.Values) (float64, error) {
+	switch len(query["timeout"]) {
+	case 0:
+		return 0, nil
+	case 1:
+		timeout, err := strconv.ParseFloat(query.Get("timeout"), 64)
+		if err != nil || math.IsNaN(timeout) || math.IsInf(timeout, 0) || timeout <= 0 {
+			return 0, errors.New("'timeout' parameter must be a positive number of seconds")
+		}
+
+		return timeout, nil
+	default:
+		return 0, errors.New("'timeout' parameter must be specified once")
+	}
+}
+
+// parseAggregation splits the aggregation parameter into the global aggregations and the per-metric overrides.
+// An override has the form "<metricName>:<aggregation>", e.g. "Percentage CPU:Average". The keys of the overrides are lower-case.
+func parseAggregation(aggregation string, metricNames []string) (string, map[string]string, error) {
+	var (
+		globalAggregations []string
+		metricAggregations map[string]string
+	)
+
+	for _, item := range strings.Split(aggregation, ",") {
+		metricName, metricAggregation, ok := strings.Cut(item, ":")
+		if !ok {
+			if strings.EqualFold(strings.TrimSpace(item), rawAggregation) {
+				return "", nil, fmt.Errorf("'aggregation' parameter must not combine %s with other aggregations", rawAggregation)
+			}
+
+			globalAggregations = append(globalAggregations, item)
+
+			continue
+		}
+
+		metricName = strings.TrimSpace(metricName)
+		metricAggregation = strings.ToLower(strings.TrimSpace(metricAggregation))
+
+		if !slices.Contains(aggregationTypes, metricAggregation) {
+			return "", nil, fmt.Errorf("'aggregation' parameter of metric %q must be one of %s", metricName, strings.Join(aggregationTypes, ", "))
+		}
+
+		if !containsMetricName(metricNames, metricName) {
+			return "", nil, fmt.Errorf("'aggregation' parameter references metric %q, which is not part of the 'metricName' parameter", metricName)
+		}
+
+		if metricAggregations == nil {
+			metricAggregations = make(map[string]string)
+		}
+
+		metricAggregations[strings.ToLower(metricName)] = metricAggregation
+	}
+
+	return strings.Join(globalAggregations, ","), metricAggregations, nil
+}
+
+// validateSubscriptionIDs rejects probes with more than maxSubscriptionIDs values of the subscriptionID parameter.
+// 0 means unlimited.
+func validateSubscriptionIDs(subscriptions []string, maxSubscriptionIDs int) error {
+	if maxSubscriptionIDs > 0 && len(subscriptions) > maxSubscriptionIDs {
+		return fmt.Errorf("'subscriptionID' parameter must not contain more than %d subscriptions, got %d. "+
+			"Split the probe into multiple probes or omit the parameter to use the subscriptions of the credential", maxSubscriptionIDs, len(subscriptions))
+	}
+
+	return nil
+}
+
+// parseConstLabels parses the constLabel parameter. Each value has the form <name>=<value>.
+// Labels set by the exporter itself, e.g. instance, cannot be overridden.
+func parseConstLabels(constLabels []string, regionLabel string) (map[string]string, error) {
+	if len(constLabels) == 0 {
+		return nil, nil //nolint:nilnil // no const labels
+	}
+
+	labels := make(map[string]string, len(constLabels))
+
+	for _, constLabel := range constLabels {
+		name, value, _ := strings.Cut(constLabel, "=")
+
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("'constLabel' parameter must have the form <name>=<value> with a valid Prometheus label name, got %q", constLabel)
+		}
+
+		if value == "" {
+			return nil, fmt.Errorf("'constLabel' parameter must not have an empty value, got %q", constLabel)
+		}
+
+		if slices.Contains([]string{"instance", "subscription_id", "interval", "metric_id", regionLabel}, name) {
+			return nil, fmt.Errorf("'constLabel' parameter must not set the label %q", name)
+		}
+
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("'constLabel' parameter must not set the label %q twice", name)
+		}
+
+		labels[name] = value
+	}
+
+	return labels, nil
+}
+
+// parseMetricType parses the metricType parameter. It contains a comma separated list of types in the form <type> or
+// <metricName>:<type>. It returns the type of all metrics and the types per lower-case metric name.
+func parseMetricType(metricType string, metricNames []string) (string, map[string]string, error) {
+	var metricTypes map[string]string
+
+	defaultType := metricTypeGauge
+
+	for _, item := range strings.Split(metricType, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		metricName, valueType, ok := strings.Cut(item, ":")
+		if !ok {
+			metricName, valueType = "", item
+		}
+
+		valueType = strings.ToLower(strings.TrimSpace(valueType))
+		if valueType != metricTypeGauge && valueType != metricTypeCounter {
+			return "", nil, fmt.Errorf("'metricType' parameter must be one of %s, %s, got %q", metricTypeGauge, metricTypeCounter, valueType)
+		}
+
+		if !ok {
+			defaultType = valueType
+
+			continue
+		}
+
+		metricName = strings.TrimSpace(metricName)
+		if !containsMetricName(metricNames, metricName) {
+			return "", nil, fmt.Errorf("'metricType' parameter references metric %q, which is not part of the 'metricName' parameter", metricName)
+		}
+
+		if metricTypes == nil {
+			metricTypes = make(map[string]string)
+		}
+
+		metricTypes[strings.ToLower(metricName)] = valueType
+	}
+
+	return defaultType, metricTypes, nil
+}
+
+// parseValueScale parses the valueScale parameter. It contains a comma separated list of scales in the form <scale> or
+// <metricName>:<scale>. It returns the scale of all metrics and the scales per lower-case metric name.
+func parseValueScale(valueScale string, metricNames []string) (float64, map[string]float64, error) {
+	var metricValueScales map[string]float64
+
+	scale := 1.0
+
+	for _, item := range strings.Split(valueScale, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		metricName, metricScale, ok := strings.Cut(item, ":")
+		if !ok {
+			metricName, metricScale = "", item
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimSpace(metricScale), 64)
+		if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+			return 0, nil, fmt.Errorf("'valueScale' parameter must be a finite number, got %q", metricScale)
+		}
+
+		if !ok {
+			scale = value
+
+			continue
+		}
+
+		metricName = strings.TrimSpace(metricName)
+		if !containsMetricName(metricNames, metricName) {
+			return 0, nil, fmt.Errorf("'valueScale' parameter references metric %q, which is not part of the 'metricName' parameter", metricName)
+		}
+
+		if metricValueScales == nil {
+			metricValueScales = make(map[string]float64)
+		}
+
+		metricValueScales[strings.ToLower(metricName)] = value
+	}
+
+	return scale, metricValueScales, nil
+}
+
+// containsMetricName reports whether metricName is part of metricNames. With metricName=*, every metric name is accepted.
+func containsMetricName(metricNames []string, metricName string) bool {
+	if slices.Equal(metricNames, []string{allMetricNames}) {
+		return true
+	}
+
+	return slices.ContainsFunc(metricNames, func(name string) bool { return strings.EqualFold(name, metricName) })
+}
+
+// AllMetricNames reports whether the probe queries all available metrics of the metric namespace (metricName=*).
+func (c *Config) AllMetricNames() bool {
+	return slices.Equal(c.MetricNames, []string{allMetricNames})
+}
+
+// scrapeLabels returns the constant labels of the scrape metrics.
+func (c *Config) scrapeLabels() prometheus.Labels {
+	if c.Target == "" {
+		return nil
+	}
+
+	return prometheus.Labels{"target": c.Target}
+}
+
+// scrapeLabels returns the constant labels of the scrape metrics of the logs probe.
+func (c *LogsConfig) scrapeLabels() prometheus.Labels {
+	if c.Target == "" {
+		return nil
+	}
+
+	return prometheus.Labels{"target": c.Target}
+}
+
+// validateParameterCombinations rejects parameters, which conflict with each other or have no effect on their own.
+func validateParameterCombinations(query url.Values) error {
+	for _, name := range multiValueParameters {
+		if query.Has(name) && query.Has(name+"[]") {
+			return fmt.Errorf("'%s' and '%s[]' parameters are mutually exclusive", name, name)
+		}
+	}
+
+	for _, dependency := range parameterDependencies {
+		if !query.Has(dependency.parameter) {
+			continue
+		}
+
+		if !slices.ContainsFunc(dependency.requires, func(name string) bool { return query.Has(name) || query.Has(name+"[]") }) {
+			return fmt.Errorf("'%s' parameter requires the '%s' parameter", dependency.parameter, strings.Join(dependency.requires, "' or '"))
+		}
+	}
+
+	return nil
+}
+
+// probeErrorReason classifies a parameter error by the parameter it refers to, e.g. invalid_resourceType.
+// All parameter errors start with the quoted name of the parameter.
+func probeErrorReason(err error) string {
+	message := err.Error()
+	if !strings.HasPrefix(message, "'") {
+		return "unknown"
+	}
+
+	parameter, _, ok := strings.Cut(message[1:], "'")
+	if !ok || parameter == "" {
+		return "unknown"
+	}
+
+	return "invalid_" + strings.TrimSuffix(parameter, "[]")
+}
+
+// getBoolParameter returns the boolean value of an optional parameter. If the parameter is absent, false is returned.
+func getBoolParameter(query url.Values, name string) (bool, error) {
+	switch len(query[name]) {
+	case 0:
+		return false, nil
+	case 1:
+		value, err := strconv.ParseBool(query.Get(name))
+		if err != nil {
+			return false, fmt.Errorf("'%s' parameter must be a boolean", name)
+		}
+
+		return value, nil
+	default:
+		return false, fmt.Errorf("'%s' parameter must be specified once", name)
+	}
+}
+
+func GetLogsConfigFromRequest(request *http.Request) (*LogsConfig, error) {
+	query := request.URL.Query()
+
+	logsConfig := &LogsConfig{}
+
+	logsConfig.WorkspaceID = query.Get("workspaceID")
+	if len(query["workspaceID"]) != 1 || logsConfig.WorkspaceID == "" {
+		return nil, errors.New("'workspaceID' parameter must be specified once")
+	}
+
+	logsConfig.Query = query.Get("query")
+	if len(query["query"]) != 1 || logsConfig.Query == "" {
+		return nil, errors.New("'query' parameter must be specified once")
+	}
+
+	if len(query["timespan"]) == 1 {
+		if _, err := duration.Parse(query.Get("timespan")); err != nil {
+			return nil, fmt.Errorf("'timespan' parameter must be a ISO8601 duration: %w", err)
+		}
+
+		logsConfig.Timespan = query.Get("timespan")
+	} else if len(query["timespan"]) > 1 {
+		return nil, errors.New("'timespan' parameter must be specified once")
+	}
+
+	if len(query["metricPrefix"]) == 1 {
+		logsConfig.MetricPrefix = query.Get("metricPrefix")
+	} else if len(query["metricPrefix"]) > 1 {
+		return nil, errors.New("'metricPrefix' parameter must be specified once")
+	}
+
+	if logsConfig.MetricPrefix == "" {
+		logsConfig.MetricPrefix = "azure_monitor_logs"
+	}
+
+	if len(query["target"]) == 1 {
+		logsConfig.Target = query.Get("target")
+	} else if len(query["target"]) > 1 {
+		return nil, errors.New("'target' parameter must be specified once")
+	}
+
+	timeout, err := parseTimeout(query)
+	if err != nil {
+		return nil, err
+	}
+
+	logsConfig.Timeout = timeout
+
+	return logsConfig, nil
+}
@@ -0,0 +1,663 @@
+package probe_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
+	"github.com/go-kit/log"
+	"github.com/jkroepke/azure-monitor-exporter/pkg/cache"
+	"github.com/jkroepke/azure-monitor-exporter/pkg/probe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetConfigFromRequestFilter(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		request        string
+		expectedFilter string
+		expectedErr    string
+	}{
+		{
+			name:           "filter",
+			request:        "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=LUN%20eq%20'1'",
+			expectedFilter: "LUN eq '1'",
+		},
+		{
+			name:           "filter with whitespace",
+			request:        "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=%20(LUN%20%20eq%20'1'%20or%20LUN%20eq%20'2')%20",
+			expectedFilter: "(LUN eq '1' or LUN eq '2')",
+		},
+		{
+			name:           "dimension",
+			request:        "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&dimension=LUN&dimension=Region",
+			expectedFilter: "LUN eq '*' and Region eq '*'",
+		},
+		{
+			name:           "filter with dimension",
+			request:        "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=LUN%20eq%20'1'&dimension[]=Region",
+			expectedFilter: "(LUN eq '1') and Region eq '*'",
+		},
+		{
+			name:           "or filter with dimension",
+			request:        "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=LUN%20eq%20'1'%20or%20LUN%20eq%20'2'&dimension=Region",
+			expectedFilter: "(LUN eq '1' or LUN eq '2') and Region eq '*'",
+		},
+		{
+			name:           "filter with nested parentheses",
+			request:        "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=((LUN%20eq%20'1'))%20and%20(Region%20eq%20'*')",
+			expectedFilter: "((LUN eq '1')) and (Region eq '*')",
+		},
+		{
+			name:           "filter with escaped quote",
+			request:        "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=Owner%20eq%20'O''Brien'%20or%20Owner%20eq%20''''",
+			expectedFilter: "Owner eq 'O''Brien' or Owner eq ''''",
+		},
+		{
+			name:        "filter with empty parentheses",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=LUN%20eq%20'1'%20and%20()",
+			expectedErr: "'filter' parameter is invalid: filter contains an empty clause",
+		},
+		{
+			name:        "filter with operator before closing parenthesis",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=(LUN%20eq%20'1'%20or)",
+			expectedErr: "'filter' parameter is invalid: filter contains an empty clause",
+		},
+		{
+			name:        "filter without operator",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=LUN",
+			expectedErr: `'filter' parameter is invalid: filter clause "LUN" has no operator, use "LUN eq '*'" to split by a dimension`,
+		},
+		{
+			name:        "filter with unquoted value",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=LUN%20eq%20*",
+			expectedErr: `'filter' parameter is invalid: filter clause "LUN eq *" must have a single-quoted value`,
+		},
+		{
+			name:        "filter with unsupported operator",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=LUN%20gt%20'1'",
+			expectedErr: `'filter' parameter is invalid: filter clause "LUN gt '1'" has an unsupported operator "gt"`,
+		},
+		{
+			name:        "filter with unterminated quote",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=LUN%20eq%20'1",
+			expectedErr: "'filter' parameter is invalid: filter has an unterminated quoted value",
+		},
+		{
+			name:        "filter with unbalanced parentheses",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=(LUN%20eq%20'1'",
+			expectedErr: "'filter' parameter is invalid: filter has unbalanced parentheses",
+		},
+		{
+			name:        "filter with trailing operator",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&filter=LUN%20eq%20'1'%20and",
+			expectedErr: "'filter' parameter is invalid: filter contains an empty clause",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet, tc.request, nil))
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotNil(t, config.Filter)
+			assert.Equal(t, tc.expectedFilter, *config.Filter)
+		})
+	}
+}
+
+func TestGetConfigFromRequestParameterCombinations(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		request     string
+		expectedErr string
+	}{
+		{
+			name:        "metricName and metricName[]",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&metricName[]=Network%20In",
+			expectedErr: "'metricName' and 'metricName[]' parameters are mutually exclusive",
+		},
+		{
+			name:        "subscriptionID and subscriptionID[]",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&subscriptionID=a&subscriptionID[]=b",
+			expectedErr: "'subscriptionID' and 'subscriptionID[]' parameters are mutually exclusive",
+		},
+		{
+			name:        "aggregation and aggregation[]",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&aggregation=average&aggregation[]=total",
+			expectedErr: "'aggregation' and 'aggregation[]' parameters are mutually exclusive",
+		},
+		{
+			name:        "preferredAggregation and preferredAggregation[]",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&preferredAggregation=average&preferredAggregation[]=total",
+			expectedErr: "'preferredAggregation' and 'preferredAggregation[]' parameters are mutually exclusive",
+		},
+		{
+			name:        "dimension and dimension[]",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&dimension=LUN&dimension[]=Region",
+			expectedErr: "'dimension' and 'dimension[]' parameters are mutually exclusive",
+		},
+		{
+			name:        "booleanMetrics and booleanMetrics[]",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&booleanMetrics=Percentage%20CPU&booleanMetrics[]=Percentage%20CPU",
+			expectedErr: "'booleanMetrics' and 'booleanMetrics[]' parameters are mutually exclusive",
+		},
+		{
+			name:        "booleanThreshold without booleanMetrics",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&booleanThreshold=0.5",
+			expectedErr: "'booleanThreshold' parameter requires the 'booleanMetrics' parameter",
+		},
+		{
+			name:        "top without filter",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&top=5",
+			expectedErr: "'top' parameter requires the 'filter' or 'dimension' parameter",
+		},
+		{
+			name:        "orderBy without filter",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&orderBy=average%20desc",
+			expectedErr: "'orderBy' parameter requires the 'filter' or 'dimension' parameter",
+		},
+		{
+			name:        "rollUpBy without filter",
+			request:     "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&rollUpBy=LUN",
+			expectedErr: "'rollUpBy' parameter requires the 'filter' or 'dimension' parameter",
+		},
+		{
+			name:    "top with dimension",
+			request: "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&top=5&dimension[]=LUN",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet, tc.request, nil))
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+
+				return
+			}
+
+			require.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestServeConfigHTTP(t *testing.T) {
+	t.Parallel()
+
+	probeHandler, err := probe.New(log.NewNopLogger(), http.DefaultClient, nil, []string{"00000000-0000-0000-0000-000000000000"},
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{DefaultInterval: "PT1M"})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/config?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&queryCacheExpiration=1m", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeConfigHTTP()(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var config map[string]any
+
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&config))
+	assert.Equal(t, "Microsoft.Compute/virtualMachines", config["MetricNamespace"])
+	assert.Equal(t, "PT1M", config["Interval"])
+	assert.Equal(t, "1m0s", config["QueryCacheExpiration"])
+	assert.Equal(t, "9.5s", config["Timeout"])
+	assert.Equal(t, []any{"00000000-0000-0000-0000-000000000000"}, config["Subscriptions"])
+	assert.NotEmpty(t, config["CacheKey"])
+	assert.NotContains(t, config, "CacheCreated")
+}
+
+func TestServeConfigHTTPTimeout(t *testing.T) {
+	t.Parallel()
+
+	probeHandler, err := probe.New(log.NewNopLogger(), http.DefaultClient, nil, []string{"00000000-0000-0000-0000-000000000000"},
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{TimeoutHeader: "X-Scrape-Timeout"})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		header          string
+		query           string
+		expectedTimeout string
+	}{
+		{expectedTimeout: "9.5s"},
+		{header: "30", expectedTimeout: "29.5s"},
+		{header: "30", query: "&timeout=60", expectedTimeout: "29.5s"},
+		{query: "&timeout=60", expectedTimeout: "59.5s"},
+		{query: "&timeout=0.5", expectedTimeout: "250ms"},
+		{header: "1", expectedTimeout: "500ms"},
+		{header: "0.2", expectedTimeout: "100ms"},
+		{header: "invalid", query: "&timeout=60", expectedTimeout: "9.5s"},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/config?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric"+tc.query, nil)
+		request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "5")
+
+		if tc.header != "" {
+			request.Header.Set("X-Scrape-Timeout", tc.header)
+		}
+
+		recorder := httptest.NewRecorder()
+
+		probeHandler.ServeConfigHTTP()(recorder, request)
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var config map[string]any
+
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(&config))
+		assert.Equal(t, tc.expectedTimeout, config["Timeout"], tc)
+	}
+}
+
+func TestGetConfigFromRequestPreferredAggregation(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&preferredAggregation=Total,average", nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"total", "average"}, config.PreferredAggregations)
+	require.NotNil(t, config.Aggregation)
+	assert.Equal(t, "average,total,maximum,minimum,count", *config.Aggregation)
+
+	config, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&preferredAggregation=total&aggregation=average", nil))
+	require.NoError(t, err)
+	assert.Empty(t, config.PreferredAggregations)
+	require.NotNil(t, config.Aggregation)
+	assert.Equal(t, "average", *config.Aggregation)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&preferredAggregation=median", nil))
+	require.EqualError(t, err, "'preferredAggregation' parameter must be one of average, total, maximum, minimum, count")
+}
+
+func TestGetConfigFromRequestRawTimeSeries(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&aggregation=None", nil))
+	require.NoError(t, err)
+	assert.True(t, config.RawTimeSeries)
+	assert.Nil(t, config.Aggregation)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&aggregation=none,average", nil))
+	require.EqualError(t, err, "'aggregation' parameter must not combine none with other aggregations")
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&aggregation=none&preferredAggregation=total", nil))
+	require.EqualError(t, err, "'preferredAggregation' parameter must not be combined with aggregation=none")
+}
+
+func TestGetConfigFromRequestResultFormat(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil))
+	require.NoError(t, err)
+	assert.Equal(t, armresourcegraph.ResultFormatObjectArray, config.ResultFormat)
+
+	config, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&resultFormat=table", nil))
+	require.NoError(t, err)
+	assert.Equal(t, armresourcegraph.ResultFormatTable, config.ResultFormat)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&resultFormat=csv", nil))
+	require.EqualError(t, err, "'resultFormat' parameter must be one of objectArray, table")
+}
+
+func TestGetConfigFromRequestNameCase(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "lower", config.NameCase)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&nameCase=upper", nil))
+	require.EqualError(t, err, "'nameCase' parameter must be one of lower, snake, preserve")
+}
+
+func TestGetConfigFromRequestInstanceFormat(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "full-id", config.InstanceFormat)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&instanceFormat=id", nil))
+	require.EqualError(t, err, "'instanceFormat' parameter must be one of full-id, name, rg/name")
+}
+
+func TestGetConfigFromRequestRound(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil))
+	require.NoError(t, err)
+	assert.Nil(t, config.Round)
+
+	config, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&round=2", nil))
+	require.NoError(t, err)
+	require.NotNil(t, config.Round)
+	assert.Equal(t, 2, *config.Round)
+
+	for _, round := range []string{"-1", "1.5", "two"} {
+		_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&round="+round, nil))
+		require.EqualError(t, err, "'round' parameter must be a non-negative integer")
+	}
+}
+
+func TestGetConfigFromRequestMaxAge(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil))
+	require.NoError(t, err)
+	assert.Zero(t, config.MaxAge)
+
+	config, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&maxAge=30m", nil))
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, config.MaxAge)
+
+	for _, maxAge := range []string{"0s", "-5m", "PT30M"} {
+		_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&maxAge="+maxAge, nil))
+		require.EqualError(t, err, "'maxAge' parameter must be a positive duration")
+	}
+}
+
+func TestGetConfigFromRequestTimeout(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&timeout=2.5", nil))
+	require.NoError(t, err)
+	assert.InDelta(t, 2.5, config.Timeout, 0)
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil)
+	request.Header.Set("X-Azure-Monitor-Timeout", "30")
+
+	config, err = probe.GetConfigFromRequest(request)
+	require.NoError(t, err)
+	assert.InDelta(t, 30.0, config.Timeout, 0)
+
+	for _, timeout := range []string{"abc", "0", "-1", "NaN", "Inf"} {
+		_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&timeout="+timeout, nil))
+		require.EqualError(t, err, "'timeout' parameter must be a positive number of seconds", timeout)
+	}
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&timeout=10&timeout=20", nil))
+	require.EqualError(t, err, "'timeout' parameter must be specified once")
+}
+
+func TestGetConfigFromRequestConstLabel(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&constLabel[]=team=platform&constLabel[]=query=a=b", nil))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "platform", "query": "a=b"}, config.ConstLabels)
+
+	for constLabel, expectedErr := range map[string]string{
+		"team":          `'constLabel' parameter must not have an empty value, got "team"`,
+		"team=":         `'constLabel' parameter must not have an empty value, got "team="`,
+		"1team=a":       `'constLabel' parameter must have the form <name>=<value> with a valid Prometheus label name, got "1team=a"`,
+		"__name__=a":    `'constLabel' parameter must have the form <name>=<value> with a valid Prometheus label name, got "__name__=a"`,
+		"instance=vm0":  `'constLabel' parameter must not set the label "instance"`,
+		"region=europe": `'constLabel' parameter must not set the label "region"`,
+	} {
+		_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&constLabel="+constLabel, nil))
+		require.EqualError(t, err, expectedErr)
+	}
+}
+
+func TestGetConfigFromRequestMetricType(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "gauge", config.MetricType)
+	assert.Nil(t, config.MetricTypes)
+
+	config, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&metricName=Network%20In&metricType[]=Counter&metricType[]=Percentage%20CPU:gauge", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "counter", config.MetricType)
+	assert.Equal(t, map[string]string{"percentage cpu": "gauge"}, config.MetricTypes)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&metricType=histogram", nil))
+	require.EqualError(t, err, `'metricType' parameter must be one of gauge, counter, got "histogram"`)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&metricType=Network%20In:counter", nil))
+	require.EqualError(t, err, `'metricType' parameter references metric "Network In", which is not part of the 'metricName' parameter`)
+}
+
+func TestGetConfigFromRequestValueScale(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil))
+	require.NoError(t, err)
+	assert.InDelta(t, 1.0, config.ValueScale, 0)
+	assert.Nil(t, config.MetricValueScales)
+
+	config, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&metricName=Network%20In&valueScale=0.01,Network%20In:8", nil))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.01, config.ValueScale, 0)
+	assert.Equal(t, map[string]float64{"network in": 8}, config.MetricValueScales)
+
+	for _, valueScale := range []string{"Inf", "NaN", "ten"} {
+		_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&valueScale="+valueScale, nil))
+		require.EqualError(t, err, fmt.Sprintf("'valueScale' parameter must be a finite number, got %q", valueScale))
+	}
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&valueScale=Network%20In:8", nil))
+	require.EqualError(t, err, `'valueScale' parameter references metric "Network In", which is not part of the 'metricName' parameter`)
+}
+
+func TestGetConfigFromRequestAggregationOverrides(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&metricName=Network%20In&metricName=Disk%20Read%20Bytes"+
+			"&aggregation=average,Network%20In:Total,disk%20read%20bytes:maximum", nil))
+	require.NoError(t, err)
+	require.NotNil(t, config.Aggregation)
+	assert.Equal(t, "average", *config.Aggregation)
+	assert.Equal(t, map[string]string{"network in": "total", "disk read bytes": "maximum"}, config.MetricAggregations)
+
+	config, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&metricName=Network%20In&aggregation=Network%20In:Total", nil))
+	require.NoError(t, err)
+	assert.Nil(t, config.Aggregation)
+	assert.Equal(t, map[string]string{"network in": "total"}, config.MetricAggregations)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Network%20In&aggregation=Network%20In:median", nil))
+	require.EqualError(t, err, `'aggregation' parameter of metric "Network In" must be one of average, total, maximum, minimum, count`)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Network%20In&aggregation=Network%20Out:total", nil))
+	require.EqualError(t, err, `'aggregation' parameter references metric "Network Out", which is not part of the 'metricName' parameter`)
+}
+
+func TestGetConfigFromRequestBooleanMetrics(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&booleanMetrics=vmAvailabilityMetric", nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vmavailabilitymetric"}, config.BooleanMetrics)
+	assert.InDelta(t, 1.0, config.BooleanThreshold, 0)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&booleanMetrics=Percentage%20CPU", nil))
+	require.EqualError(t, err, `'booleanMetrics' parameter references metric "Percentage CPU", which is not part of the 'metricName' parameter`)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&booleanMetrics=VmAvailabilityMetric&booleanThreshold=high", nil))
+	require.EqualError(t, err, "'booleanThreshold' parameter must be a number")
+}
+
+func TestGetConfigFromRequestRegionLabel(t *testing.T) {
+	t.Parallel()
+
+	for regionLabel, expectedErr := range map[string]string{
+		"location":        "",
+		"1region":         "'regionLabel' parameter must be a valid Prometheus label name",
+		"__region":        "'regionLabel' parameter must be a valid Prometheus label name",
+		"instance":        `'regionLabel' parameter must not be "instance"`,
+		"subscription_id": `'regionLabel' parameter must not be "subscription_id"`,
+	} {
+		config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&regionLabel="+regionLabel, nil))
+		if expectedErr != "" {
+			require.EqualError(t, err, expectedErr)
+
+			continue
+		}
+
+		require.NoError(t, err)
+		assert.Equal(t, regionLabel, config.RegionLabel)
+	}
+}
+
+func TestGetConfigFromRequestAllMetricNames(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=*&aggregation=average,Percentage%20CPU:maximum", nil))
+	require.NoError(t, err)
+	assert.True(t, config.AllMetricNames())
+	assert.Equal(t, map[string]string{"percentage cpu": "maximum"}, config.MetricAggregations)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=*&metricName=VmAvailabilityMetric", nil))
+	require.EqualError(t, err, "'metricName' parameter must not combine * with other metric names")
+}
+
+func TestGetConfigFromRequestHeaders(t *testing.T) {
+	t.Parallel()
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?metricName=VmAvailabilityMetric", nil)
+	request.Header.Set("X-Azure-Monitor-ResourceType", "Microsoft.Compute/virtualMachines")
+	request.Header.Add("X-Azure-Monitor-SubscriptionID", "00000000-0000-0000-0000-000000000000")
+	request.Header.Add("X-Azure-Monitor-SubscriptionID", "11111111-1111-1111-1111-111111111111")
+	request.Header.Set("X-Azure-Monitor-MetricName", "Percentage CPU")
+	request.Header.Set("x-azure-monitor-namecase", "snake")
+
+	config, err := probe.GetConfigFromRequest(request)
+	require.NoError(t, err)
+	assert.Equal(t, "Microsoft.Compute/virtualMachines", config.ResourceType)
+	assert.Equal(t, []string{"00000000-0000-0000-0000-000000000000", "11111111-1111-1111-1111-111111111111"}, config.Subscriptions)
+	assert.Equal(t, []string{"VmAvailabilityMetric"}, config.MetricNames)
+	assert.Equal(t, "snake", config.NameCase)
+}
+
+func TestGetConfigFromRequestRegion(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&region=WestEurope", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "westeurope", config.Region)
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&region=evil.example.com%2F", nil))
+	require.EqualError(t, err, "'region' parameter must be an Azure region name, e.g. westeurope")
+}
+
+func TestGetConfigFromRequestScope(t *testing.T) {
+	t.Parallel()
+
+	config, err := probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "resource", config.Scope)
+
+	config, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&scope=subscription&region=westeurope", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "subscription", config.Scope)
+
+	for request, expectedErr := range map[string]string{
+		"&scope=tenant":       "'scope' parameter must be one of resource, subscription",
+		"&scope=subscription": "'scope' parameter subscription requires the 'region' parameter",
+		"&scope=subscription&region=westeurope&query=Resources":       "'scope' parameter subscription is mutually exclusive with the 'query' and 'resourceFile' parameters",
+		"&scope=subscription&region=westeurope&emitResourceInfo=true": "'emitResourceInfo' parameter is not supported with scope=subscription",
+	} {
+		_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU"+request, nil))
+		require.EqualError(t, err, expectedErr, request)
+	}
+
+	_, err = probe.GetConfigFromRequest(httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=*&scope=subscription&region=westeurope", nil))
+	require.EqualError(t, err, "'scope' parameter subscription requires explicit metric names, metricName=* is not supported")
+}
+
+func TestServeConfigHTTPContext(t *testing.T) {
+	t.Parallel()
+
+	probeHandler, err := probe.New(log.NewNopLogger(), http.DefaultClient, nil, []string{"00000000-0000-0000-0000-000000000000"},
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	require.NoError(t, probeHandler.AddContext("tenant-b", nil, []string{"11111111-1111-1111-1111-111111111111"}))
+	require.EqualError(t, probeHandler.AddContext("tenant-b", nil, nil), `context "tenant-b" already exists`)
+
+	recorder := httptest.NewRecorder()
+	probeHandler.ServeConfigHTTP()(recorder, httptest.NewRequest(http.MethodGet,
+		"/config?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&context=tenant-b", nil))
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var config map[string]any
+
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&config))
+	assert.Equal(t, "tenant-b", config["Context"])
+	assert.Equal(t, []any{"11111111-1111-1111-1111-111111111111"}, config["Subscriptions"])
+
+	recorder = httptest.NewRecorder()
+	probeHandler.ServeConfigHTTP()(recorder, httptest.NewRequest(http.MethodGet,
+		"/config?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&context=tenant-c", nil))
+
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `'context' parameter references unknown context "tenant-c"`)
+}
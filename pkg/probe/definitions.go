@@ -0,0 +1,111 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	metricDefinitionsAPIVersion = "2018-01-01"
+
+	// metricDefinitionsCacheExpiration is the lifetime of cached metric definitions.
+	// The available metrics of a resource type rarely change.
+	metricDefinitionsCacheExpiration = time.Hour
+)
+
+type metricDefinitionsResponse struct {
+	Value []metricDefinition `json:"value"`
+}
+
+type metricDefinition struct {
+	Name struct {
+		Value string `json:"value"`
+	} `json:"name"`
+}
+
+// expandMetricNames returns all metric names available for the metric namespace of the probe.
+// The metric definitions are requested for the given resource and cached per credential context and metric namespace.
+func (r *Request) expandMetricNames(ctx context.Context, resourceID string) ([]string, error) {
+	cacheKey := strings.ToLower(r.credentials.name + "/" + r.config.MetricNamespace)
+
+	if metricNames, ok := r.probe.metricDefinitionsCache.Get(cacheKey); ok {
+		return *metricNames, nil
+	}
+
+	metricNames, err := metricDefinitions(ctx, r.credentials, resourceID, r.config.MetricNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = level.Warn(r).Log("msg", "metricName=* expanded to all available metrics, this may result in high cardinality and API costs",
+		"metric_namespace", r.config.MetricNamespace, "metrics", len(metricNames))
+
+	r.probe.metricDefinitionsCache.Set(cacheKey, &metricNames, metricDefinitionsCacheExpiration)
+
+	return metricNames, nil
+}
+
+// metricDefinitions returns the names of all metrics available for the resource and metric namespace.
+func metricDefinitions(ctx context.Context, credentials *credentialContext, resourceID, metricNamespace string) ([]string, error) {
+	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(credentials.armEndpoint, resourceID, "providers/Microsoft.Insights/metricDefinitions"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating metric definitions request: %w", err)
+	}
+
+	query := req.Raw().URL.Query()
+	query.Set("api-version", metricDefinitionsAPIVersion)
+	query.Set("metricnamespace", metricNamespace)
+	req.Raw().URL.RawQuery = query.Encode()
+
+	resp, err := credentials.armPipeline.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error querying metric definitions: %w", err)
+	}
+
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return nil, fmt.Errorf("error querying metric definitions: %w", runtime.NewResponseError(resp))
+	}
+
+	var result metricDefinitionsResponse
+	if err = runtime.UnmarshalAsJSON(resp, &result); err != nil {
+		return nil, fmt.Errorf("error querying metric definitions: %w", err)
+	}
+
+	metricNames := make([]string, 0, len(result.Value))
+
+	for _, definition := range result.Value {
+		if definition.Name.Value != "" {
+			metricNames = append(metricNames, definition.Name.Value)
+		}
+	}
+
+	if len(metricNames) == 0 {
+		return nil, fmt.Errorf("error querying metric definitions: no metrics available for metric namespace %s", metricNamespace)
+	}
+
+	return metricNames, nil
+}
+
+// anyResourceID returns a resource ID of the resources, used to query the metric definitions of the resource type.
+// The resource ID is chosen deterministically to keep the results of subsequent probes stable.
+func (r *Resources) anyResourceID() string {
+	var resourceID string
+
+	for _, subscriptions := range r.Resources {
+		for _, resourceIDs := range subscriptions {
+			for _, id := range resourceIDs {
+				if resourceID == "" || id < resourceID {
+					resourceID = id
+				}
+			}
+		}
+	}
+
+	return resourceID
+}
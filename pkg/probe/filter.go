@@ -0,0 +1,179 @@
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// filterOperators contains the comparison operators supported by the Azure Monitor metrics filter.
+var filterOperators = map[string]struct{}{
+	"eq": {},
+	"ne": {},
+	"sw": {},
+}
+
+// buildDimensionFilter returns a filter which splits the metrics by all given dimensions.
+func buildDimensionFilter(dimensions []string) string {
+	clauses := make([]string, 0, len(dimensions))
+
+	for _, dimension := range dimensions {
+		clauses = append(clauses, fmt.Sprintf("%s eq '*'", dimension))
+	}
+
+	return strings.Join(clauses, " and ")
+}
+
+// normalizeFilter validates an Azure Monitor metrics filter and returns it with normalized whitespace.
+// A clause is expected to have the form "<dimension> <operator> '<value>'".
+// Clauses can be combined with "and" and "or" and grouped with parentheses.
+//
+//nolint:cyclop
+func normalizeFilter(filter string) (string, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return "", err
+	}
+
+	if len(tokens) == 0 {
+		return "", errors.New("filter is empty")
+	}
+
+	var (
+		depth  int
+		clause []string
+	)
+
+	checkClause := func() error {
+		switch {
+		case len(clause) == 0:
+			return errors.New("filter contains an empty clause")
+		case len(clause) == 1:
+			return fmt.Errorf("filter clause %q has no operator, use \"%s eq '*'\" to split by a dimension", clause[0], clause[0])
+		case len(clause) != 3:
+			return fmt.Errorf("filter clause %q must have the form \"<dimension> <operator> '<value>'\"", strings.Join(clause, " "))
+		}
+
+		if _, ok := filterOperators[strings.ToLower(clause[1])]; !ok {
+			return fmt.Errorf("filter clause %q has an unsupported operator %q", strings.Join(clause, " "), clause[1])
+		}
+
+		if !strings.HasPrefix(clause[2], "'") {
+			return fmt.Errorf("filter clause %q must have a single-quoted value", strings.Join(clause, " "))
+		}
+
+		clause = clause[:0]
+
+		return nil
+	}
+
+	for i, token := range tokens {
+		// A clause is empty after a closing parenthesis only, e.g. "((a eq 'x'))" or "(a eq 'x') and b eq 'y'".
+		afterGroup := i > 0 && tokens[i-1] == ")"
+
+		switch strings.ToLower(token) {
+		case "(":
+			if len(clause) != 0 {
+				return "", fmt.Errorf("filter has an unexpected '(' after %q", strings.Join(clause, " "))
+			}
+
+			depth++
+		case ")":
+			if len(clause) != 0 || !afterGroup {
+				if err = checkClause(); err != nil {
+					return "", err
+				}
+			}
+
+			depth--
+			if depth < 0 {
+				return "", errors.New("filter has unbalanced parentheses")
+			}
+		case "and", "or":
+			if len(clause) != 0 || !afterGroup {
+				if err = checkClause(); err != nil {
+					return "", err
+				}
+			}
+		default:
+			clause = append(clause, token)
+		}
+	}
+
+	if len(clause) != 0 || tokens[len(tokens)-1] != ")" {
+		if err = checkClause(); err != nil {
+			return "", err
+		}
+	}
+
+	if depth != 0 {
+		return "", errors.New("filter has unbalanced parentheses")
+	}
+
+	return strings.ReplaceAll(strings.ReplaceAll(strings.Join(tokens, " "), "( ", "("), " )", ")"), nil
+}
+
+// tokenizeFilter splits a filter into tokens. Quoted values and parentheses are separate tokens.
+// Quotes within a quoted value are escaped by doubling them.
+func tokenizeFilter(filter string) ([]string, error) {
+	var (
+		tokens  []string
+		current strings.Builder
+		quoted  bool
+	)
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	chars := []rune(filter)
+
+	for i := 0; i < len(chars); i++ {
+		char := chars[i]
+
+		switch {
+		case quoted:
+			current.WriteRune(char)
+
+			if char != '\'' {
+				continue
+			}
+
+			// A doubled quote within a quoted value is an escaped quote, e.g. 'O''Brien'.
+			if i+1 < len(chars) && chars[i+1] == '\'' {
+				current.WriteRune(chars[i+1])
+				i++
+
+				continue
+			}
+
+			quoted = false
+
+			flush()
+		case char == '\'':
+			flush()
+			current.WriteRune(char)
+
+			quoted = true
+		case char == '(' || char == ')':
+			flush()
+
+			tokens = append(tokens, string(char))
+		case char == ' ' || char == '\t' || char == '\n':
+			flush()
+		default:
+			current.WriteRune(char)
+		}
+	}
+
+	if quoted {
+		return nil, errors.New("filter has an unterminated quoted value")
+	}
+
+	flush()
+
+	return tokens, nil
+}
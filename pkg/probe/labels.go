@@ -0,0 +1,77 @@
+package probe
+
+import (
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+)
+
+const (
+	// labelCollisionPrefixDimension adds dimensionLabelPrefix to dimensions colliding with a label of the resource. This is the default.
+	labelCollisionPrefixDimension = "prefix-dimension"
+	// labelCollisionPrefixLabel adds resourceLabelPrefix to labels of the resource colliding with a dimension.
+	labelCollisionPrefixLabel = "prefix-label"
+	// labelCollisionError fails the probe, if a dimension collides with a label of the resource.
+	labelCollisionError = "error"
+
+	dimensionLabelPrefix = "dim_"
+	resourceLabelPrefix  = "label_"
+)
+
+// labelCollisions contains the supported values of the labelCollision parameter.
+var labelCollisions = []string{labelCollisionPrefixDimension, labelCollisionPrefixLabel, labelCollisionError}
+
+const (
+	// instanceFormatFullID uses the resource ID as instance label. This is the default.
+	instanceFormatFullID = "full-id"
+	// instanceFormatName uses the name of the resource as instance label.
+	instanceFormatName = "name"
+	// instanceFormatResourceGroupName uses the resource group and the name of the resource as instance label.
+	instanceFormatResourceGroupName = "rg/name"
+)
+
+// instanceFormats contains the supported values of the instanceFormat parameter.
+var instanceFormats = []string{instanceFormatFullID, instanceFormatName, instanceFormatResourceGroupName}
+
+// instanceLabel returns the value of the instance label of the resource. Resource IDs, which can not be parsed, are kept.
+func (r *Request) instanceLabel(resourceID string) string {
+	if r.config.InstanceFormat == "" || r.config.InstanceFormat == instanceFormatFullID {
+		return resourceID
+	}
+
+	parsedID, err := arm.ParseResourceID(resourceID)
+	if err != nil {
+		return resourceID
+	}
+
+	// Subscriptions have no resource group, their name is the subscription ID.
+	if r.config.InstanceFormat == instanceFormatResourceGroupName && parsedID.ResourceGroupName != "" {
+		return parsedID.ResourceGroupName + "/" + parsedID.Name
+	}
+
+	return parsedID.Name
+}
+
+// setDimensionLabel adds the dimension to the labels of the metric. resourceLabels contains the labels of the resource,
+// e.g. instance, region and the label_* columns of the query. Collisions are resolved by Config.LabelCollision.
+func (r *Request) setDimensionLabel(labels, resourceLabels map[string]string, name, value string) error {
+	resourceValue, collides := resourceLabels[name]
+	if !collides {
+		labels[name] = value
+
+		return nil
+	}
+
+	switch r.config.LabelCollision {
+	case labelCollisionError:
+		return fmt.Errorf("dimension %q collides with a label of the resource %s. Use the 'labelCollision' parameter to rename one of them",
+			name, labels["instance"])
+	case labelCollisionPrefixLabel:
+		labels[resourceLabelPrefix+name] = resourceValue
+		labels[name] = value
+	default:
+		labels[dimensionLabelPrefix+name] = value
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
+	"github.com/go-kit/log/level"
+)
+
+// legacyMetricsAPIVersion is the API version of the per-resource metrics API of Azure Resource Manager.
+const legacyMetricsAPIVersion = "2023-10-01"
+
+// legacyMetricsResponse is the response of the per-resource metrics API. The metrics have the same format as the
+// metrics of the batch API, but the resource ID is not part of the response.
+type legacyMetricsResponse struct {
+	Timespan       string             `json:"timespan"`
+	Interval       *string            `json:"interval"`
+	Namespace      *string            `json:"namespace"`
+	ResourceRegion *string            `json:"resourceregion"`
+	Value          []azmetrics.Metric `json:"value"`
+}
+
+// isUnsupportedNamespaceError reports, whether the batch metrics API rejected the metric namespace of the request.
+func isUnsupportedNamespaceError(err error) bool {
+	var azErr *azcore.ResponseError
+	if !errors.As(err, &azErr) || azErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	message := strings.ToLower(azErr.Error())
+
+	return strings.Contains(message, "namespace") && (strings.Contains(message, "not supported") || strings.Contains(message, "unsupported"))
+}
+
+// queryMetrics queries the metrics of the resources with the batch metrics API. With Options.LegacyMetricsFallback,
+// metric namespaces unsupported by the batch API are queried by the per-resource metrics API instead.
+// Once a fallback happened, the remaining resources of the probe are queried by the per-resource metrics API.
+func (r *Request) queryMetrics(
+	ctx context.Context, client *azmetrics.Client, subscriptionID, metricNamespace string, resourceIDs []string, metricQuery metricQuery,
+) ([]azmetrics.MetricData, error) {
+	if r.legacyMetricsAPI {
+		return r.queryLegacyMetrics(ctx, subscriptionID, metricNamespace, resourceIDs, metricQuery)
+	}
+
+	resp, err := client.QueryResources(
+		ctx,
+		subscriptionID,
+		metricNamespace,
+		metricQuery.metricNames,
+		azmetrics.ResourceIDList{ResourceIDs: resourceIDs},
+		metricQuery.options,
+	)
+	if err == nil {
+		return resp.Values, nil
+	}
+
+	if !r.probe.options.LegacyMetricsFallback || !isUnsupportedNamespaceError(err) {
+		return nil, err //nolint:wrapcheck // error is wrapped by the caller
+	}
+
+	_ = level.Warn(r).Log("msg", "metric namespace not supported by the batch metrics API, falling back to the per-resource metrics API",
+		"metric_namespace", metricNamespace, "err", err)
+
+	r.legacyMetricsAPI = true
+
+	return r.queryLegacyMetrics(ctx, subscriptionID, metricNamespace, resourceIDs, metricQuery)
+}
+
+// queryLegacyMetrics queries the metrics of each resource by the per-resource metrics API.
+// It accepts the same options as the batch metrics API, but requires one request per resource.
+func (r *Request) queryLegacyMetrics(
+	ctx context.Context, subscriptionID, metricNamespace string, resourceIDs []string, metricQuery metricQuery,
+) ([]azmetrics.MetricData, error) {
+	pipeline := r.probe.metricsPipeline(r.credentials, subscriptionID)
+	values := make([]azmetrics.MetricData, 0, len(resourceIDs))
+
+	for _, resourceID := range resourceIDs {
+		value, err := queryLegacyMetricsOfScope(ctx, pipeline, r.credentials.armEndpoint, resourceID, legacyMetricsQuery(metricNamespace, metricQuery))
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// queryLegacyMetricsOfScope queries the metrics of a single resource or subscription by the per-resource metrics API.
+// The scope is returned as resource ID of the metrics.
+func queryLegacyMetricsOfScope(
+	ctx context.Context, pipeline runtime.Pipeline, armEndpoint, resourceID string, query url.Values,
+) (azmetrics.MetricData, error) {
+	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(armEndpoint, resourceID, "providers/Microsoft.Insights/metrics"))
+	if err != nil {
+		return azmetrics.MetricData{}, fmt.Errorf("error creating metrics request: %w", err)
+	}
+
+	req.Raw().URL.RawQuery = query.Encode()
+
+	resp, err := pipeline.Do(req)
+	if err != nil {
+		return azmetrics.MetricData{}, fmt.Errorf("error querying metrics of %s: %w", resourceID, err)
+	}
+
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return azmetrics.MetricData{}, fmt.Errorf("error querying metrics of %s: %w", resourceID, runtime.NewResponseError(resp))
+	}
+
+	var result legacyMetricsResponse
+	if err = runtime.UnmarshalAsJSON(resp, &result); err != nil {
+		return azmetrics.MetricData{}, fmt.Errorf("error querying metrics of %s: %w", resourceID, err)
+	}
+
+	metricData := azmetrics.MetricData{
+		ResourceID:     to.Ptr(resourceID),
+		Interval:       result.Interval,
+		Namespace:      result.Namespace,
+		ResourceRegion: result.ResourceRegion,
+		Values:         result.Value,
+	}
+
+	if startTime, endTime, ok := strings.Cut(result.Timespan, "/"); ok {
+		metricData.StartTime = to.Ptr(startTime)
+		metricData.EndTime = to.Ptr(endTime)
+	}
+
+	return metricData, nil
+}
+
+// legacyMetricsQuery maps the options of the batch metrics API to the query parameters of the per-resource metrics API.
+func legacyMetricsQuery(metricNamespace string, metricQuery metricQuery) url.Values {
+	query := url.Values{
+		"api-version":     {legacyMetricsAPIVersion},
+		"metricnamespace": {metricNamespace},
+		"metricnames":     {strings.Join(metricQuery.metricNames, ",")},
+	}
+
+	options := metricQuery.options
+	if options == nil {
+		return query
+	}
+
+	if options.StartTime != nil && options.EndTime != nil {
+		query.Set("timespan", *options.StartTime+"/"+*options.EndTime)
+	}
+
+	for name, value := range map[string]*string{
+		"aggregation": options.Aggregation,
+		"interval":    options.Interval,
+		"$filter":     options.Filter,
+		"orderby":     options.OrderBy,
+		"rollupby":    options.RollUpBy,
+	} {
+		if value != nil {
+			query.Set(name, *value)
+		}
+	}
+
+	if options.Top != nil {
+		query.Set("top", strconv.FormatInt(int64(*options.Top), 10))
+	}
+
+	return query
+}
@@ -0,0 +1,228 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azlogs"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var invalidNameCharsRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// maxLogsServerTimeout is the maximum server timeout of a Log Analytics query in seconds.
+const maxLogsServerTimeout = 600
+
+// Describe returns no descriptors, the metrics of a logs probe depend on the columns of the query result.
+func (r *LogsRequest) Describe(_ chan<- *prometheus.Desc) {
+	// Return no descriptors to turn the collector into an unchecked collector.
+}
+
+// Collect runs the logs query and emits the numeric columns of the result together with the scrape metrics.
+func (r *LogsRequest) Collect(ch chan<- prometheus.Metric) {
+	timeout := r.probe.probeTimeout(&r.Request, r.config.Timeout)
+
+	ctx, cancel := context.WithDeadline(r.Context(), time.Now().Add(timeout))
+	defer cancel()
+
+	startTime := time.Now()
+
+	results, err := r.queryLogs(ctx, timeout)
+
+	ch <- prometheus.MustNewConstMetric(r.descs.scrapeDuration, prometheus.GaugeValue, time.Since(startTime).Seconds(), "query_logs")
+
+	if err == nil {
+		err = r.collectTables(results.Tables, ch)
+	}
+
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
+		ch <- prometheus.MustNewConstMetric(r.descs.scrapeSuccess, prometheus.GaugeValue, 0)
+
+		_ = level.Error(r).Log("msg", "Error querying logs", "err", err)
+
+		return
+	}
+
+	// On a partial error, e.g. an exceeded result size, Log Analytics returns incomplete tables.
+	// The metrics of the incomplete tables are returned, but the scrape is not successful.
+	if results.Error != nil {
+		_ = level.Warn(r).Log("msg", "Logs query returned a partial error, returning partial metrics", "err", results.Error)
+
+		ch <- prometheus.MustNewConstMetric(r.descs.scrapeSuccess, prometheus.GaugeValue, 0)
+
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(r.descs.scrapeSuccess, prometheus.GaugeValue, 1)
+}
+
+// queryLogs runs the KQL query against the Log Analytics workspace.
+// The server timeout of the query is aligned with the probe timeout, so Log Analytics stops queries which can't complete in time.
+func (r *LogsRequest) queryLogs(ctx context.Context, timeout time.Duration) (azlogs.QueryResults, error) {
+	body := azlogs.QueryBody{
+		Query: to.Ptr(r.config.Query),
+	}
+
+	if r.config.Timespan != "" {
+		body.Timespan = to.Ptr(azlogs.TimeInterval(r.config.Timespan))
+	}
+
+	serverTimeout := min(max(int(math.Ceil(timeout.Seconds())), 1), maxLogsServerTimeout)
+
+	resp, err := r.probe.logsClient.QueryWorkspace(ctx, r.config.WorkspaceID, body, &azlogs.QueryWorkspaceOptions{
+		Options: &azlogs.QueryOptions{Wait: to.Ptr(serverTimeout)},
+	})
+	if err != nil {
+		return azlogs.QueryResults{}, fmt.Errorf("error querying logs: %w", err)
+	}
+
+	return resp.QueryResults, nil
+}
+
+// collectTables emits every numeric column of the tables as metric. String columns are used as labels.
+//
+//nolint:cyclop
+func (r *LogsRequest) collectTables(tables []azlogs.Table, ch chan<- prometheus.Metric) error {
+	for _, table := range tables {
+		tableName := stringValue(table.Name)
+
+		var (
+			labelNames    []string
+			labelColumns  []int
+			metricColumns []int
+		)
+
+		for i, column := range table.Columns {
+			if column.Type == nil {
+				continue
+			}
+
+			switch *column.Type {
+			case azlogs.ColumnTypeString, azlogs.ColumnTypeGUID:
+				labelNames = append(labelNames, sanitizeName(stringValue(column.Name)))
+				labelColumns = append(labelColumns, i)
+			case azlogs.ColumnTypeInt, azlogs.ColumnTypeLong, azlogs.ColumnTypeReal, azlogs.ColumnTypeDecimal:
+				metricColumns = append(metricColumns, i)
+			}
+		}
+
+		if len(metricColumns) == 0 {
+			return fmt.Errorf("error querying logs: table %s has no numeric columns", tableName)
+		}
+
+		if err := validateLabelNames(table, labelNames, labelColumns); err != nil {
+			return err
+		}
+
+		descs := make(map[int]*prometheus.Desc, len(metricColumns))
+		for _, i := range metricColumns {
+			columnName := stringValue(table.Columns[i].Name)
+			descs[i] = prometheus.NewDesc(
+				prometheus.BuildFQName(r.config.MetricPrefix, "", sanitizeName(columnName)),
+				fmt.Sprintf("azure_monitor_exporter: column %s of the logs query", columnName),
+				labelNames,
+				nil,
+			)
+		}
+
+		for _, row := range table.Rows {
+			if len(row) != len(table.Columns) {
+				return errors.New("error querying logs: unexpected row length")
+			}
+
+			labelValues := make([]string, len(labelColumns))
+
+			for j, i := range labelColumns {
+				if value, ok := row[i].(string); ok {
+					labelValues[j] = value
+				}
+			}
+
+			for _, i := range metricColumns {
+				value, ok := logsValueToFloat(row[i])
+				if !ok {
+					continue
+				}
+
+				metric, err := prometheus.NewConstMetric(descs[i], prometheus.GaugeValue, value, labelValues...)
+				if err != nil {
+					return fmt.Errorf("error querying logs: column %s: %w", stringValue(table.Columns[i].Name), err)
+				}
+
+				ch <- metric
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateLabelNames rejects string columns, which are no valid Prometheus label names after sanitizing,
+// e.g. empty names, names with the reserved prefix __ or names like "a b" and "a_b", which collide.
+func validateLabelNames(table azlogs.Table, labelNames []string, labelColumns []int) error {
+	tableName := stringValue(table.Name)
+	seen := make(map[string]string, len(labelNames))
+
+	for j, labelName := range labelNames {
+		columnName := stringValue(table.Columns[labelColumns[j]].Name)
+
+		switch {
+		case labelName == "":
+			return fmt.Errorf("error querying logs: table %s has a string column without name", tableName)
+		case strings.HasPrefix(labelName, "__"):
+			return fmt.Errorf("error querying logs: string column %q of table %s uses the reserved label prefix __", columnName, tableName)
+		}
+
+		if otherColumnName, ok := seen[labelName]; ok {
+			return fmt.Errorf("error querying logs: string columns %q and %q of table %s result in the same label %s",
+				otherColumnName, columnName, tableName, labelName)
+		}
+
+		seen[labelName] = columnName
+	}
+
+	return nil
+}
+
+// logsValueToFloat converts a numeric cell into a float. Decimal values are returned as string by the API.
+func logsValueToFloat(value any) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case string:
+		floatValue, err := strconv.ParseFloat(value, 64)
+
+		return floatValue, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// stringValue returns the value of the optional string of the Log Analytics response, or an empty string.
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+
+	return *value
+}
+
+// sanitizeName replaces all characters which are not allowed in Prometheus metric or label names.
+func sanitizeName(name string) string {
+	name = invalidNameCharsRegexp.ReplaceAllString(name, "_")
+
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	return name
+}
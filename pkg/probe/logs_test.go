@@ -0,0 +1,252 @@
+package probe_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
+	"github.com/go-kit/log"
+	"github.com/jkroepke/azure-monitor-exporter/pkg/cache"
+	"github.com/jkroepke/azure-monitor-exporter/pkg/probe"
+	"github.com/jkroepke/azure-monitor-exporter/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogsProbe(t *testing.T) {
+	t.Parallel()
+
+	code, metricsText := logsProbe(t, "", `{"tables":[{"name":"PrimaryResult","columns":[`+
+		`{"name":"Computer","type":"string"},{"name":"count_","type":"long"},{"name":"avg CPU","type":"real"}`+
+		`],"rows":[["vm1",5,12.5],["vm2",3,null]]}]}`)
+
+	require.Equal(t, http.StatusOK, code)
+
+	assert.Contains(t, metricsText, "azure_monitor_logs_scrape_collector_success 1")
+	assert.NotContains(t, metricsText, "azure_monitor_scrape_")
+	assert.Contains(t, metricsText, `azure_monitor_logs_count_{Computer="vm1"} 5`)
+	assert.Contains(t, metricsText, `azure_monitor_logs_count_{Computer="vm2"} 3`)
+	assert.Contains(t, metricsText, `azure_monitor_logs_avg_CPU{Computer="vm1"} 12.5`)
+	assert.NotContains(t, metricsText, `azure_monitor_logs_avg_CPU{Computer="vm2"}`)
+}
+
+func TestLogsProbeScrapeMetrics(t *testing.T) {
+	t.Parallel()
+
+	code, metricsText := logsProbe(t, "&metricPrefix=custom&target=workspace1",
+		`{"tables":[{"name":"PrimaryResult","columns":[{"name":"count_","type":"long"}],"rows":[[5]]}]}`)
+
+	require.Equal(t, http.StatusOK, code)
+
+	assert.Contains(t, metricsText, "custom_count_ 5")
+	assert.Contains(t, metricsText, `custom_scrape_collector_success{target="workspace1"} 1`)
+	assert.Contains(t, metricsText, `custom_scrape_collector_duration_seconds{phase="query_logs",target="workspace1"}`)
+	assert.NotContains(t, metricsText, "azure_monitor_scrape_")
+	assert.NotContains(t, metricsText, "azure_monitor_logs_")
+}
+
+func TestLogsProbeInvalidLabelNames(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		columns string
+		err     string
+	}{
+		{
+			name:    "duplicate",
+			columns: `{"name":"a b","type":"string"},{"name":"a_b","type":"string"}`,
+			err:     `string columns "a b" and "a_b" of table PrimaryResult result in the same label a_b`,
+		},
+		{
+			name:    "reserved",
+			columns: `{"name":"__x","type":"string"},{"name":"b","type":"string"}`,
+			err:     `string column "__x" of table PrimaryResult uses the reserved label prefix __`,
+		},
+		{
+			name:    "empty",
+			columns: `{"name":"","type":"string"},{"name":"b","type":"string"}`,
+			err:     "table PrimaryResult has a string column without name",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			code, body := logsProbe(t, "", `{"tables":[{"name":"PrimaryResult","columns":[`+tc.columns+
+				`,{"name":"count_","type":"long"}],"rows":[["x","y",5]]}]}`)
+
+			require.Equal(t, http.StatusInternalServerError, code)
+			assert.Contains(t, body, tc.err)
+		})
+	}
+}
+
+func TestLogsProbeEndpoint(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu           sync.Mutex
+		scopes       []string
+		queriedHosts []string
+	)
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, armresourcegraph.QueryResponse{}, azmetrics.MetricResults{})
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			recorder := httptest.NewRecorder()
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case req.URL.Host == "login.microsoftonline.com" && req.Method == http.MethodPost:
+				if err := req.ParseForm(); err != nil {
+					return nil, err
+				}
+
+				scopes = append(scopes, req.PostForm.Get("scope"))
+
+				_, _ = recorder.WriteString(strings.ReplaceAll(testutil.MockTokenResponse, "api.loganalytics.io", "api.loganalytics.us"))
+			case req.URL.Path == "/v1/workspaces/00000000-0000-0000-0000-000000000000/query":
+				queriedHosts = append(queriedHosts, req.URL.Host)
+
+				_, _ = recorder.WriteString(`{"tables":[{"name":"PrimaryResult","columns":[{"name":"count_","type":"long"}],"rows":[[5]]}]}`)
+			default:
+				return mockTransport(req)
+			}
+
+			return recorder.Result(), nil
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{
+			LogsEndpoint: "https://api.loganalytics.us/v1/",
+			LogsAudience: "https://api.loganalytics.us/.default",
+		})
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	probeHandler.ServeLogsHTTP(prometheus.NewRegistry())(recorder,
+		httptest.NewRequest(http.MethodGet, "/logs?workspaceID=00000000-0000-0000-0000-000000000000&query=Perf", nil))
+
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_logs_count_ 5")
+	assert.Equal(t, []string{"api.loganalytics.us"}, queriedHosts)
+	assert.Contains(t, scopes, "https://api.loganalytics.us/.default openid offline_access profile")
+}
+
+func TestLogsProbePartialError(t *testing.T) {
+	t.Parallel()
+
+	code, metricsText := logsProbe(t, "", `{"tables":[{"name":"PrimaryResult","columns":[{"name":"count_","type":"long"}],"rows":[[5]]}],`+
+		`"error":{"code":"PartialError","message":"There were some errors when processing your query."}}`)
+
+	require.Equal(t, http.StatusOK, code)
+
+	assert.Contains(t, metricsText, "azure_monitor_logs_count_ 5")
+	assert.Contains(t, metricsText, "azure_monitor_logs_scrape_collector_success 0")
+}
+
+func TestLogsProbeServerTimeout(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		prefer string
+	}{
+		{name: "default", prefer: "wait=10"},
+		{name: "timeout", query: "&timeout=30", prefer: "wait=30"},
+		{name: "short timeout", query: "&timeout=0.2", prefer: "wait=1"},
+		{name: "long timeout", query: "&timeout=3600", prefer: "wait=600"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var prefer string
+
+			mockTransport := testutil.MockTransport(http.DefaultTransport, armresourcegraph.QueryResponse{}, azmetrics.MetricResults{})
+			httpClient := &http.Client{
+				Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					if req.URL.Host != "api.loganalytics.io" {
+						return mockTransport(req)
+					}
+
+					prefer = req.Header.Get("Prefer")
+
+					recorder := httptest.NewRecorder()
+					_, _ = recorder.WriteString(`{"tables":[{"name":"PrimaryResult","columns":[{"name":"count_","type":"long"}],"rows":[[5]]}]}`)
+
+					return recorder.Result(), nil
+				}),
+			}
+
+			probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+			require.NoError(t, err)
+
+			recorder := httptest.NewRecorder()
+			probeHandler.ServeLogsHTTP(prometheus.NewRegistry())(recorder,
+				httptest.NewRequest(http.MethodGet, "/logs?workspaceID=00000000-0000-0000-0000-000000000000&query=Perf"+tc.query, nil))
+
+			require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+			assert.Equal(t, tc.prefer, prefer)
+		})
+	}
+}
+
+// logsProbe runs a logs probe with the additional parameters against a mocked Log Analytics API, which returns the given response.
+func logsProbe(t *testing.T, parameters, response string) (int, string) {
+	t.Helper()
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, armresourcegraph.QueryResponse{}, azmetrics.MetricResults{})
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host != "api.loganalytics.io" {
+				return mockTransport(req)
+			}
+
+			recorder := httptest.NewRecorder()
+			recorder.WriteHeader(http.StatusOK)
+
+			if req.URL.Path == "/v1/workspaces/00000000-0000-0000-0000-000000000000/query" {
+				_, _ = recorder.WriteString(response)
+			}
+
+			return recorder.Result(), nil
+		}),
+	}
+
+	cred, err := azidentity.NewClientSecretCredential(
+		"mock",
+		"00000000-0000-0000-0000-000000000000",
+		"invalid",
+		&azidentity.ClientSecretCredentialOptions{
+			DisableInstanceDiscovery: true,
+			ClientOptions: azcore.ClientOptions{
+				Transport: httpClient,
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, cred, make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/logs?workspaceID=00000000-0000-0000-0000-000000000000&query=Perf"+parameters, nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeLogsHTTP(prometheus.NewRegistry())(recorder, request)
+
+	return recorder.Code, recorder.Body.String()
+}
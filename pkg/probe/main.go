@@ -1,22 +1,91 @@
 package probe
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	stdlog "log"
 	"math"
 	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	armruntime "github.com/Azure/azure-sdk-for-go/sdk/azcore/arm/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azlogs"
 	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
+	"github.com/Azure/azure-sdk-for-go/sdk/tracing/azotel"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/jkroepke/azure-monitor-exporter/pkg/cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"github.com/sosodev/duration"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
+// DefaultMetricsEndpointTemplate is the metrics endpoint of the Azure public cloud.
+const DefaultMetricsEndpointTemplate = "https://%s.metrics.monitor.azure.com"
+
+// DefaultMetricsAudience is the audience of the token of the metrics endpoint in the Azure public cloud.
+const DefaultMetricsAudience = "https://metrics.monitor.azure.com"
+
+// pipelineModule identifies the exporter in the User-Agent of the Azure REST API requests together with the version.
+const pipelineModule = "azure-monitor-exporter"
+
+// DefaultLogsEndpoint is the Log Analytics query endpoint of the Azure public cloud.
+const DefaultLogsEndpoint = "https://api.loganalytics.io/v1"
+
+// DefaultLogsAudience is the audience of the token of the Log Analytics query endpoint in the Azure public cloud.
+const DefaultLogsAudience = "https://api.loganalytics.io"
+
+// DefaultGlobalMetricsRegion is the region used to query the metrics of resources with the location global.
+const DefaultGlobalMetricsRegion = "westus2"
+
+// globalLocation is the location of non-regional resources like Traffic Manager or Front Door.
+// There is no metrics endpoint for this location.
+const globalLocation = "global"
+
+// azureTimestampWarnAge is the age of Azure timestamps, which may be rejected by Prometheus as out of bounds.
+const azureTimestampWarnAge = time.Hour
+
+// runChannelBuffer is the number of metrics buffered between the collection and the caller of Run.
+const runChannelBuffer = 1000
+
+// truncatedLabelValueSuffix marks label values truncated by Options.MaxLabelValueLength.
+const truncatedLabelValueSuffix = "..."
+
+// DefaultMetricNamesPerRequest is the maximum number of metric names supported by a single Azure Monitor request.
+const DefaultMetricNamesPerRequest = 20
+
+// DefaultMaxSeries is the default limit of samples emitted by a single probe.
+const DefaultMaxSeries = 1_000_000
+
+// resourceGraphMaxSubscriptions is the maximum number of subscriptions Resource Graph evaluates in a single query.
+const resourceGraphMaxSubscriptions = 1000
+
+// DefaultMaxSubscriptionIDs is the default limit of the subscriptionID parameter.
+// Larger lists require multiple Resource Graph queries per probe.
+const DefaultMaxSubscriptionIDs = resourceGraphMaxSubscriptions
+
+// DefaultSubscriptionsPerQuery is the number of subscriptions queried by a single Resource Graph request.
+const DefaultSubscriptionsPerQuery = resourceGraphMaxSubscriptions
+
 func New(
 	logger log.Logger,
 	httpClient *http.Client,
@@ -24,11 +93,202 @@ func New(
 	subscriptions []string,
 	queryCache *cache.Cache[Resources],
 	metricsClientCache *cache.Cache[azmetrics.Client],
+	options Options,
 ) (*Probe, error) {
+	if options.MetricsEndpointTemplate == "" {
+		options.MetricsEndpointTemplate = DefaultMetricsEndpointTemplate
+	}
+
+	if strings.Count(options.MetricsEndpointTemplate, "%") != 1 || strings.Count(options.MetricsEndpointTemplate, "%s") != 1 {
+		return nil, fmt.Errorf("metrics endpoint template %q must contain exactly one %%s", options.MetricsEndpointTemplate)
+	}
+
+	var err error
+
+	if options.MetricsAudience, err = normalizeAudience("metrics", options.MetricsAudience, DefaultMetricsAudience); err != nil {
+		return nil, err
+	}
+
+	if options.LogsEndpoint == "" {
+		options.LogsEndpoint = DefaultLogsEndpoint
+	}
+
+	options.LogsEndpoint = strings.TrimSuffix(options.LogsEndpoint, "/")
+
+	if !isHTTPSURL(options.LogsEndpoint) {
+		return nil, fmt.Errorf("logs endpoint %q must be an https URL, e.g. %s", options.LogsEndpoint, DefaultLogsEndpoint)
+	}
+
+	if options.LogsAudience, err = normalizeAudience("logs", options.LogsAudience, DefaultLogsAudience); err != nil {
+		return nil, err
+	}
+
+	resourceManager := cloud.AzurePublic.Services[cloud.ResourceManager]
+
+	if options.ResourceManagerEndpoint == "" {
+		options.ResourceManagerEndpoint = resourceManager.Endpoint
+	}
+
+	if !isHTTPSURL(options.ResourceManagerEndpoint) {
+		return nil, fmt.Errorf("resource manager endpoint %q must be an https URL, e.g. %s", options.ResourceManagerEndpoint, resourceManager.Endpoint)
+	}
+
+	// The audience is used as is, the audience of the public cloud requires the trailing slash.
+	if options.ResourceManagerAudience == "" {
+		options.ResourceManagerAudience = resourceManager.Audience
+	}
+
+	if !isHTTPSURL(options.ResourceManagerAudience) {
+		return nil, fmt.Errorf("resource manager audience %q must be an https URL, e.g. %s", options.ResourceManagerAudience, resourceManager.Audience)
+	}
+
+	if options.TimeoutHeader == "" {
+		options.TimeoutHeader = DefaultTimeoutHeader
+	}
+
+	if options.MetricNamesPerRequest == 0 {
+		options.MetricNamesPerRequest = DefaultMetricNamesPerRequest
+	}
+
+	if options.MetricNamesPerRequest < 0 {
+		return nil, fmt.Errorf("metric names per request must be positive, got %d", options.MetricNamesPerRequest)
+	}
+
+	if options.SubscriptionsPerQuery == 0 {
+		options.SubscriptionsPerQuery = DefaultSubscriptionsPerQuery
+	}
+
+	if options.SubscriptionsPerQuery < 0 {
+		return nil, fmt.Errorf("subscriptions per query must be positive, got %d", options.SubscriptionsPerQuery)
+	}
+
+	if options.MaxLabelValueLength < 0 {
+		return nil, fmt.Errorf("max label value length must not be negative, got %d", options.MaxLabelValueLength)
+	}
+
+	if math.IsNaN(options.QueryCacheJitter) || options.QueryCacheJitter < 0 || options.QueryCacheJitter >= 100 {
+		return nil, fmt.Errorf("query cache jitter must be between 0 and 100, got %v", options.QueryCacheJitter)
+	}
+
+	if options.DefaultInterval != "" {
+		if _, err := duration.Parse(options.DefaultInterval); err != nil {
+			return nil, fmt.Errorf("default interval %q must be a ISO8601 duration: %w", options.DefaultInterval, err)
+		}
+	}
+
+	if options.DefaultAggregation != "" {
+		defaultAggregations := strings.Split(options.DefaultAggregation, ",")
+		for i, aggregation := range defaultAggregations {
+			defaultAggregations[i] = strings.ToLower(strings.TrimSpace(aggregation))
+			if !slices.Contains(aggregationTypes, defaultAggregations[i]) {
+				return nil, fmt.Errorf("default aggregation %q must be one of %s", aggregation, strings.Join(aggregationTypes, ", "))
+			}
+		}
+
+		options.DefaultAggregation = strings.Join(defaultAggregations, ",")
+	}
+
 	clientOptions := azcore.ClientOptions{
 		Transport: httpClient,
+		Cloud: cloud.Configuration{
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {Endpoint: options.ResourceManagerEndpoint, Audience: options.ResourceManagerAudience},
+			},
+		},
+	}
+
+	// The Azure SDK pipeline is only instrumented, if the spans are recorded.
+	switch options.TracerProvider.(type) {
+	case nil, noop.TracerProvider:
+		options.TracerProvider = noop.NewTracerProvider()
+	default:
+		clientOptions.TracingProvider = azotel.NewTracingProvider(options.TracerProvider, nil)
+	}
+
+	defaultContext, err := newCredentialContext("", cred, subscriptions, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	logsClientOptions := clientOptions
+	logsClientOptions.Cloud = cloud.Configuration{
+		Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+			azlogs.ServiceName: {Audience: options.LogsAudience, Endpoint: options.LogsEndpoint},
+		},
+	}
+
+	logsClient, err := azlogs.NewClient(cred, &azlogs.ClientOptions{
+		ClientOptions: logsClientOptions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating logs client: %w", err)
+	}
+
+	var resourceFile *resourceFile
+
+	if options.ResourceFile != "" {
+		if resourceFile, err = newResourceFile(logger, options.ResourceFile); err != nil {
+			return nil, err
+		}
 	}
 
+	probe := &Probe{
+		logger:  logger,
+		options: options,
+
+		resourceFile: resourceFile,
+
+		defaultContext: defaultContext,
+		contexts:       make(map[string]*credentialContext),
+
+		logsClient:      logsClient,
+		azClientOptions: clientOptions,
+
+		queryCache:         queryCache,
+		metricsClientCache: metricsClientCache,
+		metricsClientsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "azure_monitor",
+			Name:      "metrics_clients_created_total",
+			Help:      "azure_monitor_exporter: Number of created Azure Monitor metrics clients.",
+		}),
+		resourceGraphTruncated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "azure_monitor",
+			Name:      "resourcegraph_truncated_total",
+			Help:      "azure_monitor_exporter: Number of Resource Graph responses with truncated results. The resources beyond the truncation are not scraped.",
+		}, []string{"resource_type"}),
+		probeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "azure_monitor",
+			Name:      "probe_errors_total",
+			Help:      "azure_monitor_exporter: Number of rejected probe requests by reason.",
+		}, []string{"reason"}),
+
+		metricDefinitionsCache: cache.NewCache[[]string](),
+		metricCache:            cache.NewCache[[]azmetrics.MetricData](),
+
+		tracer: options.TracerProvider.Tracer(tracerName),
+	}
+
+	return probe, nil
+}
+
+// RegisterMetrics registers the metrics about the metrics clients, Resource Graph queries and rejected requests of the probe.
+func (p *Probe) RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "azure_monitor",
+			Name:      "metrics_clients",
+			Help:      "azure_monitor_exporter: Number of cached Azure Monitor metrics clients. There is one client per context, subscription and region.",
+		}, func() float64 {
+			return float64(p.metricsClientCache.Len())
+		}),
+		p.metricsClientsCreated,
+		p.resourceGraphTruncated,
+		p.probeErrors,
+	)
+}
+
+// newCredentialContext returns a credential context including its Resource Graph client.
+func newCredentialContext(name string, cred azcore.TokenCredential, subscriptions []string, clientOptions azcore.ClientOptions) (*credentialContext, error) {
 	resourceGraphClient, err := armresourcegraph.NewClient(cred, &arm.ClientOptions{
 		ClientOptions: clientOptions,
 	})
@@ -36,83 +296,709 @@ func New(
 		return nil, fmt.Errorf("error creating resource graph client: %w", err)
 	}
 
-	probe := &Probe{
-		logger: logger,
+	armPipeline, err := armruntime.NewPipeline(pipelineModule, version.Version, cred, runtime.PipelineOptions{}, &arm.ClientOptions{
+		ClientOptions: clientOptions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating arm pipeline: %w", err)
+	}
 
+	return &credentialContext{
+		name:                name,
+		cred:                cred,
+		subscriptions:       subscriptions,
 		resourceGraphClient: resourceGraphClient,
-		azClientOptions:     clientOptions,
+		armPipeline:         armPipeline,
+		armEndpoint:         clientOptions.Cloud.Services[cloud.ResourceManager].Endpoint,
+	}, nil
+}
 
-		subscriptions:      subscriptions,
-		queryCache:         queryCache,
-		metricsClientCache: metricsClientCache,
+// AddContext registers a named credential context, which is selected by the 'context' parameter of a probe.
+// Probes of a context only query the given subscriptions with the given credential.
+// AddContext must be called before the probe serves requests.
+func (p *Probe) AddContext(name string, cred azcore.TokenCredential, subscriptions []string) error {
+	if name == "" {
+		return errors.New("context name must not be empty")
+	}
+
+	if _, ok := p.contexts[name]; ok {
+		return fmt.Errorf("context %q already exists", name)
+	}
+
+	credentials, err := newCredentialContext(name, cred, subscriptions, p.azClientOptions)
+	if err != nil {
+		return err
+	}
+
+	p.contexts[name] = credentials
+
+	return nil
+}
+
+// AddSubscriptionCredential registers a credential, which is used to query the metrics of subscriptions matching the
+// pattern instead of the credential of the context, e.g. for subscriptions delegated by Azure Lighthouse.
+// The pattern uses the syntax of path.Match, e.g. 00000000-* . The first matching credential is used.
+// Resource Graph queries always use the credential of the context.
+func (p *Probe) AddSubscriptionCredential(name, pattern string, cred azcore.TokenCredential) error {
+	if name == "" {
+		return errors.New("subscription credential name must not be empty")
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid subscription pattern %q of subscription credential %q: %w", pattern, name, err)
+	}
+
+	armPipeline, err := armruntime.NewPipeline(pipelineModule, version.Version, cred, runtime.PipelineOptions{}, &arm.ClientOptions{
+		ClientOptions: p.azClientOptions,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating arm pipeline of subscription credential %q: %w", name, err)
+	}
+
+	p.subscriptionCredentials = append(p.subscriptionCredentials, subscriptionCredential{
+		name:        name,
+		pattern:     strings.ToLower(pattern),
+		cred:        cred,
+		armPipeline: armPipeline,
+	})
+
+	return nil
+}
+
+// subscriptionCredential returns the first subscription credential matching the subscription or nil.
+func (p *Probe) subscriptionCredential(subscriptionID string) *subscriptionCredential {
+	for i, subscriptionCredential := range p.subscriptionCredentials {
+		if ok, _ := path.Match(subscriptionCredential.pattern, strings.ToLower(subscriptionID)); ok {
+			return &p.subscriptionCredentials[i]
+		}
+	}
+
+	return nil
+}
+
+// metricsCredential returns the name and credential used to query the metrics of the subscription.
+// Without matching subscription credential, the credential of the context is returned.
+func (p *Probe) metricsCredential(credentials *credentialContext, subscriptionID string) (string, azcore.TokenCredential) {
+	if subscriptionCredential := p.subscriptionCredential(subscriptionID); subscriptionCredential != nil {
+		return "subscription-credential:" + subscriptionCredential.name, subscriptionCredential.cred
+	}
 
-		scrapeDurationDesc: prometheus.NewDesc(
-			prometheus.BuildFQName("azure_monitor", "scrape", "collector_duration_seconds"),
+	return credentials.name, credentials.cred
+}
+
+// metricsPipeline returns the Azure Resource Manager pipeline used to query the per-resource metrics API of the subscription.
+func (p *Probe) metricsPipeline(credentials *credentialContext, subscriptionID string) runtime.Pipeline {
+	if subscriptionCredential := p.subscriptionCredential(subscriptionID); subscriptionCredential != nil {
+		return subscriptionCredential.armPipeline
+	}
+
+	return credentials.armPipeline
+}
+
+// credentialContext returns the credential context with the given name. An empty name returns the default context.
+func (p *Probe) credentialContext(name string) (*credentialContext, error) {
+	if name == "" {
+		return p.defaultContext, nil
+	}
+
+	credentials, ok := p.contexts[name]
+	if !ok {
+		return nil, fmt.Errorf("'context' parameter references unknown context %q", name)
+	}
+
+	return credentials, nil
+}
+
+// Run runs a probe with the given configuration without an HTTP request and returns the collected metrics.
+// The defaults of the probe are applied to the configuration. The timeout of the probe is controlled by ctx.
+// In case of an error, the metrics collected so far are returned together with the error.
+func (p *Probe) Run(ctx context.Context, config *Config) ([]prometheus.Metric, error) {
+	p.applyDefaults(config)
+
+	credentials, err := p.credentialContext(config.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.checkSubscriptionsRequired(config, credentials); err != nil {
+		return nil, err
+	}
+
+	probeRequest := &Request{
+		config:      config,
+		probe:       p,
+		descs:       newScrapeDescs(config.MetricPrefix, p.scrapeLabels(config.scrapeLabels())),
+		credentials: credentials,
+		Logger:      log.With(p.logger, "resource_type", config.ResourceType, "metric_names", config.MetricNames),
+	}
+
+	// The buffer decouples the collection from the consumer without holding all metrics in the channel.
+	ch := make(chan prometheus.Metric, runChannelBuffer)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(ch)
+
+		errCh <- probeRequest.collect(ctx, ch)
+	}()
+
+	metrics := make([]prometheus.Metric, 0)
+	for metric := range ch {
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, <-errCh
+}
+
+// HandlerOpts returns the options of the metric handlers.
+// The response is gzip compressed, if the client accepts it via the Accept-Encoding header.
+func HandlerOpts(logger log.Logger, reg prometheus.Registerer) promhttp.HandlerOpts {
+	return promhttp.HandlerOpts{
+		Registry:           reg,
+		ErrorLog:           stdlog.New(log.NewStdlibAdapter(logger), "ERROR: ", stdlog.LstdFlags),
+		DisableCompression: false,
+	}
+}
+
+// scrapeLabels returns the const labels of the scrape metrics of the probe, consisting of Options.ConstLabels and
+// the given labels of the probe parameters.
+func (p *Probe) scrapeLabels(labels prometheus.Labels) prometheus.Labels {
+	if len(p.options.ConstLabels) == 0 {
+		return labels
+	}
+
+	if labels == nil {
+		return p.options.ConstLabels
+	}
+
+	for name, value := range p.options.ConstLabels {
+		labels[name] = value
+	}
+
+	return labels
+}
+
+// newScrapeDescs returns the descriptors of the scrape metrics using the given metric namespace and constant labels.
+func newScrapeDescs(namespace string, constLabels prometheus.Labels) *scrapeDescs {
+	return &scrapeDescs{
+		scrapeDuration: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "collector_duration_seconds"),
 			"azure_monitor_exporter: Duration of a collector scrape.",
 			[]string{"phase"},
-			nil,
+			constLabels,
 		),
-		scrapeSuccessDesc: prometheus.NewDesc(
-			prometheus.BuildFQName("azure_monitor", "scrape", "collector_success"),
+		scrapeSuccess: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "collector_success"),
 			"azure_monitor_exporter: Whether a collector succeeded.",
 			[]string{},
-			nil,
+			constLabels,
+		),
+		scrapeTimedOut: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "timed_out"),
+			"azure_monitor_exporter: Whether the probe timed out. The metrics collected before the timeout are returned.",
+			[]string{},
+			constLabels,
+		),
+		scrapeTimeout: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "timeout_seconds"),
+			"azure_monitor_exporter: Effective timeout of a probe, including the safety buffer.",
+			[]string{},
+			constLabels,
+		),
+		resourceGraphPageLimit: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "resourcegraph_page_limit_reached"),
+			"azure_monitor_exporter: Whether the Resource Graph paging was stopped by the page limit.",
+			[]string{},
+			constLabels,
+		),
+		resourceGraphPartialScopes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "resourcegraph_partial_scopes"),
+			"azure_monitor_exporter: Whether Resource Graph may have skipped subscriptions, because the subscription limit has been exceeded.",
+			[]string{},
+			constLabels,
+		),
+		resourcesTotal: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "resources_total"),
+			"azure_monitor_exporter: Number of resources returned by Resource Graph per subscription and location.",
+			[]string{"subscription_id", "location"},
+			constLabels,
+		),
+		resourceGraphQuotaConsumed: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "resourcegraph", "quota_consumed"),
+			"azure_monitor_exporter: Estimated Resource Graph quota consumed by the probe, based on x-ms-user-quota-remaining.",
+			[]string{},
+			constLabels,
+		),
+		resourceGraphPages: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "resourcegraph_pages"),
+			"azure_monitor_exporter: Number of Resource Graph pages fetched by the probe. 0, if the resources have been served from the query cache.",
+			[]string{},
+			constLabels,
+		),
+		resourceGraphRows: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "resourcegraph_rows"),
+			"azure_monitor_exporter: Number of Resource Graph rows fetched by the probe. 0, if the resources have been served from the query cache.",
+			[]string{},
+			constLabels,
+		),
+		nullMetrics: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "null_metrics"),
+			"azure_monitor_exporter: Number of resources, for which Azure Monitor returned no data of the metric.",
+			[]string{"metric"},
+			constLabels,
+		),
+		resourcesWithoutMetrics: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "resources_without_metrics"),
+			"azure_monitor_exporter: Number of resources, for which Azure Monitor returned no metrics.",
+			[]string{},
+			constLabels,
+		),
+		samples: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "samples_total"),
+			"azure_monitor_exporter: Number of Azure Monitor samples emitted by the probe, including partial results of failed probes.",
+			[]string{},
+			constLabels,
+		),
+		seriesLimitExceeded: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "series_limit_exceeded"),
+			"azure_monitor_exporter: Whether the probe stopped emitting metrics, because the series limit has been exceeded.",
+			[]string{},
+			constLabels,
+		),
+		timeWindowStart: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "metric_window_start_timestamp_seconds"),
+			"azure_monitor_exporter: Start of the time window of the metrics returned by Azure Monitor for the resource.",
+			[]string{"instance"},
+			constLabels,
+		),
+		timeWindowEnd: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "metric_window_end_timestamp_seconds"),
+			"azure_monitor_exporter: End of the time window of the metrics returned by Azure Monitor for the resource.",
+			[]string{"instance"},
+			constLabels,
+		),
+		resourcesCacheAge: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "resources_cache_age_seconds"),
+			"azure_monitor_exporter: Age of the resources served from the query cache. 0, if the resources have been queried.",
+			[]string{},
+			constLabels,
+		),
+		cacheKeyInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "cache_key_info"),
+			"azure_monitor_exporter: Short query cache key of the probe. Probes with the same cache key share the cached resources.",
+			[]string{"cache_key"},
+			constLabels,
+		),
+		metricCacheHits: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "metric_cache_hits"),
+			"azure_monitor_exporter: Number of metric queries served from the metric cache.",
+			[]string{},
+			constLabels,
 		),
 	}
-
-	return probe, nil
 }
 
-func (p *Probe) getMetricsClient(location string) (*azmetrics.Client, error) {
-	if client, ok := p.metricsClientCache.Get(location); ok {
+// getMetricsClient returns the metrics client for a subscription and location.
+// Clients are cached per subscription and location. Concurrent creations of the same client are deduplicated.
+// Resources with the location global are queried at Options.GlobalMetricsRegion.
+func (p *Probe) getMetricsClient(credentials *credentialContext, subscriptionID, location string) (*azmetrics.Client, error) {
+	if strings.EqualFold(location, globalLocation) {
+		if p.options.GlobalMetricsRegion == "" {
+			return nil, fmt.Errorf("no metrics region configured for resources with location %q", location)
+		}
+
+		location = p.options.GlobalMetricsRegion
+	}
+
+	credentialName, cred := p.metricsCredential(credentials, subscriptionID)
+	cacheKey := strings.ToLower(credentialName + "/" + subscriptionID + "/" + location)
+
+	if client, ok := p.metricsClientCache.Get(cacheKey); ok {
 		return client, nil
 	}
 
-	metricsEndpoint := fmt.Sprintf("https://%s.metrics.monitor.azure.com", location)
+	client, err, _ := p.metricsClientGroup.Do(cacheKey, func() (any, error) {
+		if client, ok := p.metricsClientCache.Get(cacheKey); ok {
+			return client, nil
+		}
 
-	client, err := azmetrics.NewClient(metricsEndpoint, p.cred, &azmetrics.ClientOptions{
-		ClientOptions: p.azClientOptions,
+		metricsEndpoint := fmt.Sprintf(p.options.MetricsEndpointTemplate, location)
+
+		// The cloud configuration of the metrics client only selects the audience of the token.
+		clientOptions := p.azClientOptions
+		clientOptions.Cloud = cloud.Configuration{
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				azmetrics.ServiceName: {Audience: p.options.MetricsAudience},
+			},
+		}
+
+		client, err := azmetrics.NewClient(metricsEndpoint, cred, &azmetrics.ClientOptions{
+			ClientOptions: clientOptions,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating metrics client: %w", err)
+		}
+
+		p.metricsClientCache.Set(cacheKey, client, math.MaxInt64)
+		p.metricsClientsCreated.Inc()
+
+		return client, nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("error creating metrics client: %w", err)
+		return nil, err //nolint:wrapcheck // error is already wrapped
 	}
 
-	p.metricsClientCache.Set(location, client, math.MaxInt64)
-
-	return client, nil
+	return client.(*azmetrics.Client), nil //nolint:forcetypeassert // type is guaranteed by the function above
 }
 
 func (p *Probe) ServeHTTP(reg prometheus.Registerer) http.HandlerFunc {
 	return func(w http.ResponseWriter, request *http.Request) {
 		config, err := GetConfigFromRequest(request)
+		if err == nil {
+			err = validateSubscriptionIDs(config.Subscriptions, p.options.MaxSubscriptionIDs)
+		}
+
 		if err != nil {
 			_ = level.Error(p.logger).Log("msg", "error parsing request", "err", err)
+			p.probeErrors.WithLabelValues(probeErrorReason(err)).Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		p.applyDefaults(config)
+
+		credentials, err := p.credentialContext(config.Context)
+		if err == nil {
+			err = p.checkSubscriptionsRequired(config, credentials)
+		}
+
+		if err != nil {
+			_ = level.Error(p.logger).Log("msg", "error parsing request", "err", err)
+			p.probeErrors.WithLabelValues(probeErrorReason(err)).Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if err = p.checkSubscriptionLimit(config, credentials); err != nil {
+			_ = level.Error(p.logger).Log("msg", "error parsing request", "err", err)
+			p.probeErrors.WithLabelValues("too_many_subscriptions").Inc()
 			http.Error(w, err.Error(), http.StatusBadRequest)
 
 			return
 		}
 
 		logger := log.With(p.logger,
-			"client", request.RemoteAddr,
+			"client", p.clientAddress(request),
 			"query", request.URL.RawQuery,
 			"resource_type", config.ResourceType,
 			"metric_namespace", config.MetricNamespace,
 			"metric_names", config.MetricNames,
 		)
 
+		ctx, span := p.tracer.Start(otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header)), "probe",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("resource_type", config.ResourceType),
+				attribute.StringSlice("metric_names", config.MetricNames),
+			),
+		)
+		defer span.End()
+
+		request = request.WithContext(ctx)
+
 		probeRequest := &Request{
+			config:      config,
+			probe:       p,
+			descs:       newScrapeDescs(config.MetricPrefix, p.scrapeLabels(config.scrapeLabels())),
+			credentials: credentials,
+			Request:     *request,
+			Logger:      logger,
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(probeRequest)
+
+		var gatherer prometheus.Gatherer = registry
+
+		// The probe has to be collected before the status code is written.
+		// Only a successful probe without resources is answered by 204, a failed or timed out probe returns its scrape metrics.
+		if config.NoContentOnEmpty {
+			metricFamilies, err := registry.Gather()
+			if err == nil && probeRequest.succeeded && probeRequest.resourceCount == 0 {
+				w.WriteHeader(http.StatusNoContent)
+
+				return
+			}
+
+			gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return metricFamilies, err })
+		}
+
+		promhttp.HandlerFor(gatherer, HandlerOpts(p.logger, reg)).ServeHTTP(w, request)
+	}
+}
+
+// checkSubscriptionsRequired rejects probes without subscriptions, if Options.RequireSubscriptionIDs is set.
+// Probes of a resource file do not query Resource Graph and do not require subscriptions.
+func (p *Probe) checkSubscriptionsRequired(config *Config, credentials *credentialContext) error {
+	if !p.options.RequireSubscriptionIDs || config.Subscriptions != nil || len(credentials.subscriptions) != 0 || config.ResourceFile != "" {
+		return nil
+	}
+
+	return errors.New("'subscriptionID' parameter is required, because the subscription discovery is disabled")
+}
+
+// checkSubscriptionLimit rejects probes covering more subscriptions than Options.MaxSubscriptionsPerProbe.
+// This protects the rate limits from accidental tenant-wide probes of all discovered subscriptions.
+func (p *Probe) checkSubscriptionLimit(config *Config, credentials *credentialContext) error {
+	subscriptions := config.Subscriptions
+	if subscriptions == nil {
+		subscriptions = credentials.subscriptions
+	}
+
+	if p.options.MaxSubscriptionsPerProbe > 0 && len(subscriptions) > p.options.MaxSubscriptionsPerProbe {
+		return fmt.Errorf("probe covers %d subscriptions, which exceeds the limit of %d. Restrict the probe by the 'subscriptionID' parameter",
+			len(subscriptions), p.options.MaxSubscriptionsPerProbe)
+	}
+
+	return nil
+}
+
+func (p *Probe) ServeLogsHTTP(reg prometheus.Registerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		config, err := GetLogsConfigFromRequest(request)
+		if err != nil {
+			_ = level.Error(p.logger).Log("msg", "error parsing request", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		logger := log.With(p.logger,
+			"client", p.clientAddress(request),
+			"query", request.URL.RawQuery,
+			"workspace_id", config.WorkspaceID,
+		)
+
+		logsRequest := &LogsRequest{
 			config:  config,
 			probe:   p,
+			descs:   newScrapeDescs(config.MetricPrefix, p.scrapeLabels(config.scrapeLabels())),
 			Request: *request,
 			Logger:  logger,
 		}
 
 		registry := prometheus.NewRegistry()
-		registry.MustRegister(probeRequest)
+		registry.MustRegister(logsRequest)
 
-		promhttp.HandlerFor(registry, promhttp.HandlerOpts{
-			Registry: reg,
-			ErrorLog: stdlog.New(log.NewStdlibAdapter(p.logger), "ERROR: ", stdlog.LstdFlags),
-		}).ServeHTTP(w, request)
+		promhttp.HandlerFor(registry, HandlerOpts(p.logger, reg)).ServeHTTP(w, request)
 	}
 }
+
+// ServeConfigHTTP returns the parsed probe configuration as JSON without querying Azure.
+func (p *Probe) ServeConfigHTTP() http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		config, err := GetConfigFromRequest(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		p.applyDefaults(config)
+
+		credentials, err := p.credentialContext(config.Context)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		probeRequest := &Request{
+			config:      config,
+			probe:       p,
+			credentials: credentials,
+			Request:     *request,
+			Logger:      p.logger,
+		}
+
+		debugConfig := struct {
+			*Config
+
+			Subscriptions         []string `json:"Subscriptions"`
+			QueryCacheExpiration  string   `json:"QueryCacheExpiration"`
+			MetricCacheExpiration string   `json:"MetricCacheExpiration"`
+			MaxAge                string   `json:"MaxAge"`
+			CacheKey              string   `json:"CacheKey,omitempty"`
+			CacheCreated          string   `json:"CacheCreated,omitempty"`
+			CacheExpiration       string   `json:"CacheExpiration,omitempty"`
+			Timeout               string   `json:"Timeout"`
+		}{
+			Config:                config,
+			Subscriptions:         probeRequest.subscriptions(),
+			QueryCacheExpiration:  config.QueryCacheCacheExpiration.String(),
+			MetricCacheExpiration: config.MetricCacheExpiration.String(),
+			MaxAge:                config.MaxAge.String(),
+			Timeout:               probeRequest.getProbeTimeout().String(),
+		}
+
+		if config.QueryCacheCacheExpiration != 0 {
+			debugConfig.CacheKey = probeRequest.cacheKey()
+
+			if _, meta, ok := p.queryCache.GetWithMeta(debugConfig.CacheKey); ok {
+				debugConfig.CacheCreated = meta.Created.Format(time.RFC3339)
+				debugConfig.CacheExpiration = meta.Expiration.Format(time.RFC3339)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		if err = encoder.Encode(debugConfig); err != nil {
+			_ = level.Error(p.logger).Log("msg", "error encoding config", "err", err)
+		}
+	}
+}
+
+// ServeCacheFlushHTTP clears the query cache, the metric cache and the metric definitions cache, e.g. after changes in Azure.
+// With metricsClients=true, the metrics clients are removed as well. The response contains the number of evicted entries per cache.
+func (p *Probe) ServeCacheFlushHTTP() http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed, use POST", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		flushMetricsClients, err := getBoolParameter(request.URL.Query(), "metricsClients")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		evicted := map[string]int{
+			"queryCache":             p.queryCache.Clear(),
+			"metricCache":            p.metricCache.Clear(),
+			"metricDefinitionsCache": p.metricDefinitionsCache.Clear(),
+		}
+
+		if flushMetricsClients {
+			evicted["metricsClientCache"] = p.metricsClientCache.Clear()
+		}
+
+		_ = level.Info(p.logger).Log("msg", "flushed caches", "client", p.clientAddress(request),
+			"query_cache", evicted["queryCache"], "metric_cache", evicted["metricCache"],
+			"metric_definitions_cache", evicted["metricDefinitionsCache"], "metrics_client_cache", evicted["metricsClientCache"])
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err = json.NewEncoder(w).Encode(evicted); err != nil {
+			_ = level.Error(p.logger).Log("msg", "error encoding evicted cache entries", "err", err)
+		}
+	}
+}
+
+// clientAddress returns the address of the client. If TrustProxyHeaders is enabled,
+// the address is taken from the X-Forwarded-For or X-Real-IP header, if present.
+func (p *Probe) clientAddress(request *http.Request) string {
+	if !p.options.TrustProxyHeaders {
+		return request.RemoteAddr
+	}
+
+	if forwardedFor := request.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		client, _, _ := strings.Cut(forwardedFor, ",")
+
+		return strings.TrimSpace(client)
+	}
+
+	if realIP := request.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+
+	return request.RemoteAddr
+}
+
+// applyDefaults sets the globally configured defaults for all values not defined by the probe.
+func (p *Probe) applyDefaults(config *Config) {
+	if config.Interval == nil && p.options.DefaultInterval != "" {
+		config.Interval = to.Ptr(p.options.DefaultInterval)
+	}
+
+	if config.UseAzureTimestamps == nil {
+		config.UseAzureTimestamps = to.Ptr(p.options.UseAzureTimestamps)
+	}
+
+	// Per-metric overrides and aggregation=none also define the aggregation of the probe.
+	if config.Aggregation == nil && config.MetricAggregations == nil && !config.RawTimeSeries && p.options.DefaultAggregation != "" {
+		config.Aggregation = to.Ptr(p.options.DefaultAggregation)
+	}
+}
+
+// Warmup runs the resource query of a probe to populate the query cache.
+// The rawQuery contains the probe parameters in URL query format.
+func (p *Probe) Warmup(ctx context.Context, rawQuery string) error {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return fmt.Errorf("error parsing warmup probe: %w", err)
+	}
+
+	config, err := NewConfigFromValues(query)
+	if err != nil {
+		return fmt.Errorf("error parsing warmup probe: %w", err)
+	}
+
+	if config.QueryCacheCacheExpiration == 0 {
+		return errors.New("warmup probe must set 'queryCacheExpiration'")
+	}
+
+	p.applyDefaults(config)
+
+	credentials, err := p.credentialContext(config.Context)
+	if err != nil {
+		return fmt.Errorf("error parsing warmup probe: %w", err)
+	}
+
+	probeRequest := &Request{
+		config:      config,
+		probe:       p,
+		credentials: credentials,
+		Logger:      log.With(p.logger, "query", rawQuery),
+	}
+
+	resources, _, err := probeRequest.getResources(ctx)
+	if err != nil {
+		return fmt.Errorf("error querying resources: %w", err)
+	}
+
+	_ = level.Info(probeRequest).Log("msg", "warmed up query cache", "resources", resources.count())
+
+	return nil
+}
+
+// normalizeAudience returns the audience of a token without the scope suffix /.default or defaultAudience, if empty.
+func normalizeAudience(name, audience, defaultAudience string) (string, error) {
+	if audience == "" {
+		return defaultAudience, nil
+	}
+
+	// The scope of the token is derived from the audience, a scope is accepted as well.
+	audience = strings.TrimSuffix(strings.TrimSuffix(audience, "/.default"), "/")
+
+	if !isHTTPSURL(audience) {
+		return "", fmt.Errorf("%s audience %q must be an https URL, e.g. %s", name, audience, defaultAudience)
+	}
+
+	return audience, nil
+}
+
+// isHTTPSURL returns true, if rawURL is an absolute https URL.
+func isHTTPSURL(rawURL string) bool {
+	parsedURL, err := url.Parse(rawURL)
+
+	return err == nil && parsedURL.Scheme == "https" && parsedURL.Host != ""
+}
@@ -1,9 +1,12 @@
 package probe_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,6 +20,7 @@ import (
 	"github.com/jkroepke/azure-monitor-exporter/pkg/probe"
 	"github.com/jkroepke/azure-monitor-exporter/pkg/testutil"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/require"
 )
 
@@ -106,7 +110,7 @@ func BenchmarkFull(b *testing.B) {
 
 	for range b.N {
 		probeHandler, err := probe.New(log.NewNopLogger(), httpClient, cred, subscriptions,
-			cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client]())
+			cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
 		require.NoError(b, err)
 
 		request := httptest.NewRequest(http.MethodGet, requestURL, nil)
@@ -120,3 +124,153 @@ func BenchmarkFull(b *testing.B) {
 	b.StopTimer()
 	b.ReportAllocs()
 }
+
+// BenchmarkResourceGraphResultFormat compares the objectArray and table format of Resource Graph responses.
+// The responses are serialized once upfront to measure only the probe.
+func BenchmarkResourceGraphResultFormat(b *testing.B) {
+	objectArrayResponse := mockResourceGraphResponse(1000)
+
+	rows := make([][]any, 0, 1000)
+	for _, row := range objectArrayResponse.Data.([]map[string]any) {
+		rows = append(rows, []any{row["id"], row["location"], row["subscriptionId"]})
+	}
+
+	tableResponse := objectArrayResponse
+	tableResponse.Data = armresourcegraph.Table{
+		Columns: []*armresourcegraph.Column{
+			{Name: to.Ptr("id"), Type: to.Ptr(armresourcegraph.ColumnDataTypeString)},
+			{Name: to.Ptr("location"), Type: to.Ptr(armresourcegraph.ColumnDataTypeString)},
+			{Name: to.Ptr("subscriptionId"), Type: to.Ptr(armresourcegraph.ColumnDataTypeString)},
+		},
+		Rows: rows,
+	}
+
+	for _, tc := range []struct {
+		resultFormat string
+		response     armresourcegraph.QueryResponse
+	}{
+		{resultFormat: "objectArray", response: objectArrayResponse},
+		{resultFormat: "table", response: tableResponse},
+	} {
+		b.Run(tc.resultFormat, func(b *testing.B) {
+			body, err := json.Marshal(tc.response)
+			require.NoError(b, err)
+
+			mockTransport := testutil.MockTransport(http.DefaultTransport, armresourcegraph.QueryResponse{}, azmetrics.MetricResults{})
+			httpClient := &http.Client{
+				Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					if req.URL.Path != "/providers/Microsoft.ResourceGraph/resources" {
+						return mockTransport(req)
+					}
+
+					recorder := httptest.NewRecorder()
+					recorder.WriteHeader(http.StatusOK)
+					_, _ = recorder.Write(body)
+
+					return recorder.Result(), nil
+				}),
+			}
+
+			requestURL := "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&resultFormat=" + tc.resultFormat
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for range b.N {
+				probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(b, httpClient), make([]string, 0),
+					cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+				require.NoError(b, err)
+
+				request := httptest.NewRequest(http.MethodGet, requestURL, nil)
+				recorder := httptest.NewRecorder()
+
+				probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+				require.Equal(b, http.StatusOK, recorder.Code)
+			}
+		})
+	}
+}
+
+// BenchmarkProbeLarge runs a probe with 10k resources to measure the allocations of the fetch path.
+// Each data point contains all aggregations to cover metrics emitting multiple series per resource.
+func BenchmarkProbeLarge(b *testing.B) {
+	const resourceCount = 10000
+
+	metricResults := azmetrics.MetricResults{Values: make([]azmetrics.MetricData, resourceCount)}
+
+	for i := range resourceCount {
+		metricData := mockMetricResults(azmetrics.TimeSeriesElement{
+			Data: []azmetrics.MetricValue{
+				{
+					TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 25, 0, 0, time.UTC)),
+					Average:   to.Ptr(0.0), Minimum: to.Ptr(0.0), Maximum: to.Ptr(0.0), Total: to.Ptr(0.0), Count: to.Ptr(1.0),
+				},
+				{
+					TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)),
+					Average:   to.Ptr(1.0), Minimum: to.Ptr(1.0), Maximum: to.Ptr(1.0), Total: to.Ptr(1.0), Count: to.Ptr(1.0),
+				},
+			},
+		}).Values[0]
+		metricData.ResourceID = to.Ptr(fmt.Sprintf("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm%d", i))
+
+		metricResults.Values[i] = metricData
+	}
+
+	metricsBody, err := json.Marshal(metricResults)
+	require.NoError(b, err)
+
+	// Azure Monitor returns the metrics of up to 50 resources per request. The mock returns the metrics of all resources
+	// only once per probe to keep the number of series equal to the number of resources.
+	var metricRequests atomic.Int32
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(resourceCount), azmetrics.MetricResults{})
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if !strings.HasSuffix(req.Host, "metrics.monitor.azure.com") {
+				return mockTransport(req)
+			}
+
+			recorder := httptest.NewRecorder()
+			recorder.WriteHeader(http.StatusOK)
+
+			if metricRequests.Add(1) == 1 {
+				_, _ = recorder.Write(metricsBody)
+			} else {
+				_, _ = recorder.WriteString(`{"values":[]}`)
+			}
+
+			return recorder.Result(), nil
+		}),
+	}
+
+	for _, tc := range []struct {
+		name  string
+		query string
+	}{
+		{name: "latest", query: ""},
+		{name: "raw", query: "&aggregation=none"},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			requestURL := "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric" + tc.query
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for range b.N {
+				metricRequests.Store(0)
+
+				probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(b, httpClient), make([]string, 0),
+					cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+				require.NoError(b, err)
+
+				request := httptest.NewRequest(http.MethodGet, requestURL, nil)
+				recorder := httptest.NewRecorder()
+
+				probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+				require.Equal(b, http.StatusOK, recorder.Code)
+			}
+		})
+	}
+}
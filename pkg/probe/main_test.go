@@ -1,13 +1,28 @@
 package probe_test
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
@@ -17,8 +32,12 @@ import (
 	"github.com/jkroepke/azure-monitor-exporter/pkg/probe"
 	"github.com/jkroepke/azure-monitor-exporter/pkg/testutil"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestProbe(t *testing.T) {
@@ -27,10 +46,13 @@ func TestProbe(t *testing.T) {
 	testCases := []struct {
 		name                       string
 		subscriptions              []string
+		options                    probe.Options
 		request                    string
 		resourceGraphQueryResponse armresourcegraph.QueryResponse
 		metricResults              azmetrics.MetricResults
+		expectedMetricPrefix       string
 		expectedMetrics            []string
+		unexpectedMetrics          []string
 	}{
 		{
 			name:          "simple probe",
@@ -206,6 +228,699 @@ func TestProbe(t *testing.T) {
 				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm1",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
 			},
 		},
+		{
+			name:                       "drop single value dimensions",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&dimension=LUN&dropSingleValueDimensions=true",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				MetadataValues: []azmetrics.MetadataValue{
+					{Name: &azmetrics.LocalizableString{Value: to.Ptr("lun")}, Value: to.Ptr("0")},
+				},
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:                       "multi-dimension split",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&dimension=LUN&dimension=Tier",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(
+				azmetrics.TimeSeriesElement{
+					MetadataValues: []azmetrics.MetadataValue{
+						{Name: &azmetrics.LocalizableString{Value: to.Ptr("lun")}, Value: to.Ptr("0")},
+						{Name: &azmetrics.LocalizableString{Value: to.Ptr("tier")}, Value: to.Ptr("premium")},
+					},
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+					},
+				},
+				azmetrics.TimeSeriesElement{
+					MetadataValues: []azmetrics.MetadataValue{
+						{Name: &azmetrics.LocalizableString{Value: to.Ptr("lun")}, Value: to.Ptr("1")},
+						{Name: &azmetrics.LocalizableString{Value: to.Ptr("tier")}, Value: to.Ptr("standard")},
+					},
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(2.0)},
+					},
+				},
+			),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",lun="0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000",tier="premium"} 1`,
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",lun="1",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000",tier="standard"} 2`,
+			},
+		},
+		{
+			name:                       "dimension labels per time series",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&dimension=LUN&dimension=Tier",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(
+				azmetrics.TimeSeriesElement{
+					MetadataValues: []azmetrics.MetadataValue{
+						{Name: &azmetrics.LocalizableString{Value: to.Ptr("lun")}, Value: to.Ptr("0")},
+						{Name: &azmetrics.LocalizableString{Value: to.Ptr("tier")}, Value: to.Ptr("premium")},
+					},
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+					},
+				},
+				azmetrics.TimeSeriesElement{
+					MetadataValues: []azmetrics.MetadataValue{
+						{Name: &azmetrics.LocalizableString{Value: to.Ptr("lun")}, Value: to.Ptr("1")},
+					},
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(2.0)},
+					},
+				},
+			),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",lun="0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000",tier="premium"} 1`,
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",lun="1",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000",tier=""} 2`,
+			},
+		},
+		{
+			name:          "page limit",
+			subscriptions: make([]string, 0),
+			options:       probe.Options{MaxPages: 2},
+			request:       "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric",
+			resourceGraphQueryResponse: func() armresourcegraph.QueryResponse {
+				response := mockResourceGraphResponse(1)
+				response.SkipToken = to.Ptr("next")
+
+				return response
+			}(),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				"azure_monitor_scrape_resourcegraph_page_limit_reached 1",
+				"azure_monitor_scrape_resourcegraph_pages 2",
+				"azure_monitor_scrape_resourcegraph_rows 2",
+			},
+		},
+		{
+			name:                       "metric prefix",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&metricPrefix=custom",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetricPrefix: "custom",
+			expectedMetrics: []string{
+				`custom_scrape_collector_duration_seconds{phase="query_resources"}`,
+				`custom_scrape_resourcegraph_page_limit_reached 0`,
+				`custom_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:                       "resource count",
+			subscriptions:              []string{"00000000-0000-0000-0000-000000000000", "11111111-1111-1111-1111-111111111111"},
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&emitResourceCount=true",
+			resourceGraphQueryResponse: mockResourceGraphResponse(2),
+			metricResults:              mockMetricResults(),
+			expectedMetrics: []string{
+				`azure_monitor_scrape_resources_total{location="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 2`,
+				`azure_monitor_scrape_resources_total{location="",subscription_id="11111111-1111-1111-1111-111111111111"} 0`,
+			},
+		},
+		{
+			name:          "resource info",
+			subscriptions: make([]string, 0),
+			request:       "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&emitResourceInfo=true",
+			resourceGraphQueryResponse: func() armresourcegraph.QueryResponse {
+				response := mockResourceGraphResponse(2)
+				response.Data.([]map[string]any)[0]["label_owner"] = "platform"
+				response.Data.([]map[string]any)[1]["label_owner"] = "data"
+
+				return response
+			}(),
+			metricResults: mockMetricResults(),
+			expectedMetrics: []string{
+				`azure_monitor_resource_info{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",location="westeurope",name="vm0",owner="platform",resource_group="rg-mock",resource_id="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",subscription_id="00000000-0000-0000-0000-000000000000",type="Microsoft.Compute/virtualMachines"} 1`,
+				`azure_monitor_resource_info{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm1",location="westeurope",name="vm1",owner="data",resource_group="rg-mock",resource_id="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm1",subscription_id="00000000-0000-0000-0000-000000000000",type="Microsoft.Compute/virtualMachines"} 1`,
+			},
+		},
+		{
+			name:                       "include metric id",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&includeMetricID=true",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",metric_id="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0/providers/Microsoft.Insights/metrics/VmAvailabilityMetric",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:                       "include metric id without id",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric,Percentage%20CPU&includeMetricID=true",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: func() azmetrics.MetricResults {
+				metricResults := mockMetricResults(azmetrics.TimeSeriesElement{
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+					},
+				})
+				metricResults.Values[0].Values = append(metricResults.Values[0].Values, azmetrics.Metric{
+					Name: &azmetrics.LocalizableString{Value: to.Ptr("Percentage CPU")},
+					Unit: to.Ptr(azmetrics.MetricUnitPercent),
+					TimeSeries: []azmetrics.TimeSeriesElement{{
+						Data: []azmetrics.MetricValue{
+							{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(2.0)},
+						},
+					}},
+				})
+
+				return metricResults
+			}(),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",metric_id="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0/providers/Microsoft.Insights/metrics/VmAvailabilityMetric",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+				`azure_monitor_microsoft_compute_virtualmachines_percentagecpu_average_percent{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 2`,
+			},
+		},
+		{
+			name:                       "preferred aggregation fallback",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&preferredAggregation=average",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Total: to.Ptr(5.0), Count: to.Ptr(2.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_total_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 5`,
+			},
+			unexpectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_count_count`,
+			},
+		},
+		{
+			name:                       "metric names split into multiple requests",
+			subscriptions:              make([]string, 0),
+			options:                    probe.Options{MetricNamesPerRequest: 1},
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&metricName=Percentage%20CPU&metricName=vmavailabilitymetric",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: func() azmetrics.MetricResults {
+				metricResults := mockMetricResults(azmetrics.TimeSeriesElement{
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+					},
+				})
+
+				metricResults.Values[0].Values = append(metricResults.Values[0].Values, azmetrics.Metric{
+					Name: &azmetrics.LocalizableString{
+						Value:          to.Ptr("Percentage CPU"),
+						LocalizedValue: to.Ptr("Percentage CPU"),
+					},
+					DisplayDescription: to.Ptr("The percentage of allocated compute units that are currently in use by the Virtual Machine(s)"),
+					Unit:               to.Ptr(azmetrics.MetricUnitPercent),
+					TimeSeries: []azmetrics.TimeSeriesElement{
+						{
+							Data: []azmetrics.MetricValue{
+								{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(42.0)},
+							},
+						},
+					},
+				})
+
+				return metricResults
+			}(),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+				`azure_monitor_microsoft_compute_virtualmachines_percentagecpu_average_percent{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 42`,
+			},
+		},
+		{
+			name:                       "metric without description",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: func() azmetrics.MetricResults {
+				metricResults := mockMetricResults(azmetrics.TimeSeriesElement{
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+					},
+				})
+
+				metricResults.Values[0].Values[0].DisplayDescription = nil
+				metricResults.Values[0].Values[0].Name.LocalizedValue = nil
+
+				return metricResults
+			}(),
+			expectedMetrics: []string{
+				"# HELP azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count VmAvailabilityMetric\n",
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:                       "partially populated metrics",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: func() azmetrics.MetricResults {
+				metricResults := mockMetricResults(azmetrics.TimeSeriesElement{
+					MetadataValues: []azmetrics.MetadataValue{
+						{Name: nil, Value: to.Ptr("0")},
+					},
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: nil, Average: to.Ptr(2.0)},
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+					},
+				})
+
+				metricResults.Values[0].Namespace = nil
+				metricResults.Values[0].ResourceRegion = nil
+				metricResults.Values[0].Values[0].Unit = nil
+				metricResults.Values[0].Values = append(metricResults.Values[0].Values, azmetrics.Metric{})
+				metricResults.Values = append(metricResults.Values, azmetrics.MetricData{})
+
+				return metricResults
+			}(),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_unspecified{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:          "deduplicate resources",
+			subscriptions: make([]string, 0),
+			options:       probe.Options{DeduplicateResources: true},
+			request:       "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric",
+			resourceGraphQueryResponse: func() armresourcegraph.QueryResponse {
+				response := mockResourceGraphResponse(1)
+
+				data, _ := response.Data.([]map[string]any)
+				response.Data = append(data, map[string]any{
+					"id":             data[0]["id"],
+					"location":       "westeurope",
+					"subscriptionId": "11111111-1111-1111-1111-111111111111",
+				})
+				response.Count = to.Ptr(int64(2))
+
+				return response
+			}(),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"}`,
+			},
+			unexpectedMetrics: []string{
+				`subscription_id="11111111-1111-1111-1111-111111111111"`,
+			},
+		},
+		{
+			name:                       "round",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&round=2",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(99.98765)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 99.99`,
+				`azure_monitor_scrape_samples_total 1`,
+			},
+		},
+		{
+			name:                       "valueScale",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&valueScale=0.01&round=4",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(99.5)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count_scaled{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 0.995`,
+			},
+		},
+		{
+			name:                       "constLabel",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&constLabel=team=platform&constLabel=env=prod",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{env="prod",instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000",team="platform"}`,
+			},
+		},
+		{
+			name:                       "includeTimeWindow",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&includeTimeWindow=true",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults:              mockMetricResults(),
+			expectedMetrics: []string{
+				`azure_monitor_scrape_metric_window_start_timestamp_seconds{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0"} 1.7040708e+09`,
+				`azure_monitor_scrape_metric_window_end_timestamp_seconds{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0"} 1.7040672e+09`,
+			},
+		},
+		{
+			name:                       "metricType",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&metricType=VmAvailabilityMetric:counter",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`# TYPE azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count counter`,
+			},
+		},
+		{
+			name: "allow partial scopes",
+			subscriptions: func() []string {
+				subscriptions := make([]string, 1001)
+				for i := range subscriptions {
+					subscriptions[i] = fmt.Sprintf("00000000-0000-0000-0000-%012d", i)
+				}
+
+				return subscriptions
+			}(),
+			options:                    probe.Options{AllowPartialScopes: true, SubscriptionsPerQuery: 1001},
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				"azure_monitor_scrape_resourcegraph_partial_scopes 1",
+			},
+		},
+		{
+			name:                       "boolean metrics",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&booleanMetrics=vmAvailabilityMetric&booleanThreshold=0.9",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(0.95), Minimum: to.Ptr(0.5)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_minimum_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 0`,
+			},
+		},
+		{
+			name:                       "region label",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&regionLabel=location",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",location="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+			unexpectedMetrics: []string{
+				`region="westeurope"`,
+			},
+		},
+		{
+			name:          "max label value length",
+			subscriptions: make([]string, 0),
+			request:       "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&dimension=description",
+			options:       probe.Options{MaxLabelValueLength: 5},
+			resourceGraphQueryResponse: func() armresourcegraph.QueryResponse {
+				response := mockResourceGraphResponse(1)
+				response.Data.([]map[string]any)[0]["label_owner"] = "platform-team"
+
+				return response
+			}(),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				MetadataValues: []azmetrics.MetadataValue{
+					{Name: &azmetrics.LocalizableString{Value: to.Ptr("description")}, Value: to.Ptr("äöüäöü long description")},
+				},
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{description="äöüäö...",instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",owner="platf...",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:                       "raw time series",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&aggregation=None",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 25, 0, 0, time.UTC)), Average: to.Ptr(0.0)},
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_raw_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000",timestamp="2024-01-01T00:25:00Z"} 0`,
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_raw_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000",timestamp="2024-01-01T00:30:00Z"} 1`,
+			},
+			unexpectedMetrics: []string{
+				`vmavailabilitymetric_average_count`,
+			},
+		},
+		{
+			name:          "table result format",
+			subscriptions: make([]string, 0),
+			request:       "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&resultFormat=table",
+			resourceGraphQueryResponse: func() armresourcegraph.QueryResponse {
+				response := mockResourceGraphResponse(1)
+				response.Data.([]map[string]any)[0]["label_owner"] = "platform"
+
+				return response
+			}(),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",owner="platform",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:                       "skip null metrics",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&skipNullMetrics=true",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC))},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_scrape_null_metrics{metric="VmAvailabilityMetric"} 1`,
+			},
+			unexpectedMetrics: []string{
+				`vmavailabilitymetric_`,
+			},
+		},
+		{
+			name:                       "azure timestamps",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric",
+			options:                    probe.Options{UseAzureTimestamps: true},
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1 1704069000000`,
+			},
+		},
+		{
+			name:                       "latest value per time series",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&dimension=LUN",
+			options:                    probe.Options{UseAzureTimestamps: true},
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(
+				azmetrics.TimeSeriesElement{
+					MetadataValues: []azmetrics.MetadataValue{
+						{Name: &azmetrics.LocalizableString{Value: to.Ptr("lun")}, Value: to.Ptr("0")},
+					},
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 35, 0, 0, time.UTC)), Average: to.Ptr(3.0)},
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+					},
+				},
+				azmetrics.TimeSeriesElement{
+					MetadataValues: []azmetrics.MetadataValue{
+						{Name: &azmetrics.LocalizableString{Value: to.Ptr("lun")}, Value: to.Ptr("1")},
+					},
+					Data: []azmetrics.MetricValue{
+						{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(2.0)},
+					},
+				},
+			),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",lun="0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 3 1704069300000`,
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",lun="1",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 2 1704069000000`,
+			},
+		},
+		{
+			name:                       "azure timestamps disabled by parameter",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&useAzureTimestamps=false",
+			options:                    probe.Options{UseAzureTimestamps: true},
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1` + "\n",
+			},
+		},
+		{
+			name:                       "instance format name",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&instanceFormat=name",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:                       "instance format resource group and name",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&instanceFormat=rg/name",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="rg-mock/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:                       "snake name case",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&nameCase=snake",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vm_availability_metric_average_count{`,
+			},
+		},
+		{
+			name:                       "preserve name case",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&nameCase=preserve",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_VmAvailabilityMetric_average_count{`,
+			},
+		},
+		{
+			name:                       "include interval",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&includeInterval=true",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",interval="5m",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
+		{
+			name:                       "use configured namespace",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&metricNamespace=Custom.App&useConfiguredNamespace=true",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_custom_app_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+			unexpectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count`,
+			},
+		},
+		{
+			name:                       "resources without metrics",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric",
+			resourceGraphQueryResponse: mockResourceGraphResponse(3),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_scrape_resources_without_metrics 2`,
+			},
+		},
+		{
+			name:                       "all metric names",
+			subscriptions:              make([]string, 0),
+			request:                    "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=*",
+			resourceGraphQueryResponse: mockResourceGraphResponse(1),
+			metricResults: mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}),
+			expectedMetrics: []string{
+				`azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -230,7 +945,7 @@ func TestProbe(t *testing.T) {
 			require.NoError(t, err)
 
 			probeHandler, err := probe.New(log.NewNopLogger(), httpClient, cred, tc.subscriptions,
-				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client]())
+				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), tc.options)
 			require.NoError(t, err)
 
 			request := httptest.NewRequest(http.MethodGet, tc.request, nil)
@@ -241,11 +956,1808 @@ func TestProbe(t *testing.T) {
 			require.Equal(t, http.StatusOK, recorder.Code)
 
 			metricsText := recorder.Body.String()
-			assert.Contains(t, metricsText, "azure_monitor_scrape_collector_success 1")
+			metricPrefix := "azure_monitor"
+			if tc.expectedMetricPrefix != "" {
+				metricPrefix = tc.expectedMetricPrefix
+			}
+
+			assert.Contains(t, metricsText, metricPrefix+"_scrape_collector_success 1")
+			assert.Contains(t, metricsText, metricPrefix+"_scrape_timeout_seconds 9.5")
+			assert.Contains(t, metricsText, metricPrefix+"_scrape_timed_out 0")
 
 			for _, expectedMetric := range tc.expectedMetrics {
 				assert.Contains(t, metricsText, expectedMetric)
 			}
+
+			for _, unexpectedMetric := range tc.unexpectedMetrics {
+				assert.NotContains(t, metricsText, unexpectedMetric)
+			}
 		})
 	}
 }
+
+func TestProbeCanceledContext(t *testing.T) {
+	t.Parallel()
+
+	var resourceGraphRequests atomic.Int32
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, armresourcegraph.QueryResponse{}, azmetrics.MetricResults{})
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "management.azure.com" {
+				resourceGraphRequests.Add(1)
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	cred, err := azidentity.NewClientSecretCredential(
+		"mock",
+		"00000000-0000-0000-0000-000000000000",
+		"invalid",
+		&azidentity.ClientSecretCredentialOptions{
+			DisableInstanceDiscovery: true,
+			ClientOptions: azcore.ClientOptions{
+				Transport: httpClient,
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, cred, make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil)
+	request = request.WithContext(ctx)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	assert.Contains(t, recorder.Body.String(), "paging aborted: context canceled")
+	assert.Zero(t, resourceGraphRequests.Load())
+}
+
+// mockResourceGraphResponse returns a resource graph response containing the virtual machines vm0 to vm<count-1>.
+func mockResourceGraphResponse(count int) armresourcegraph.QueryResponse {
+	data := make([]map[string]any, count)
+
+	for i := range count {
+		data[i] = map[string]any{
+			"id":             fmt.Sprintf("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm%d", i),
+			"location":       "westeurope",
+			"subscriptionId": "00000000-0000-0000-0000-000000000000",
+		}
+	}
+
+	return armresourcegraph.QueryResponse{
+		Count:           to.Ptr(int64(count)),
+		TotalRecords:    to.Ptr(int64(count)),
+		ResultTruncated: to.Ptr(armresourcegraph.ResultTruncated("false")),
+		Data:            data,
+	}
+}
+
+// mockMetricResults returns the VmAvailabilityMetric of vm0 with the given time series.
+func mockMetricResults(timeSeries ...azmetrics.TimeSeriesElement) azmetrics.MetricResults {
+	return azmetrics.MetricResults{
+		Values: []azmetrics.MetricData{
+			{
+				EndTime:        to.Ptr("2024-01-01T00:00:00Z"),
+				Interval:       to.Ptr("PT5M"),
+				Namespace:      to.Ptr("microsoft.compute/virtualmachines"),
+				ResourceID:     to.Ptr("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0"),
+				ResourceRegion: to.Ptr("westeurope"),
+				StartTime:      to.Ptr("2024-01-01T01:00:00Z"),
+				Values: []azmetrics.Metric{
+					{
+						ID: to.Ptr("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0/providers/Microsoft.Insights/metrics/VmAvailabilityMetric"),
+						Name: &azmetrics.LocalizableString{
+							Value:          to.Ptr("VmAvailabilityMetric"),
+							LocalizedValue: to.Ptr("VM Availability Metric (Preview)"),
+						},
+						DisplayDescription: to.Ptr("Measure of Availability of Virtual machines over time."),
+						Unit:               to.Ptr(azmetrics.MetricUnitCount),
+						TimeSeries:         timeSeries,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, options := range []probe.Options{
+		{MetricsEndpointTemplate: "https://metrics.monitor.azure.com"},
+		{MetricsEndpointTemplate: "https://%s.%s.monitor.azure.com"},
+		{MetricsEndpointTemplate: "https://%d.metrics.monitor.azure.com"},
+		{QueryCacheJitter: 100},
+		{QueryCacheJitter: -1},
+		{QueryCacheJitter: math.NaN()},
+		{DefaultInterval: "5m"},
+		{MetricsAudience: "metrics.monitor.azure.us"},
+		{LogsEndpoint: "http://api.loganalytics.io/v1"},
+		{LogsAudience: "api.loganalytics.us"},
+		{ResourceManagerEndpoint: "http://management.usgovcloudapi.net"},
+		{ResourceManagerAudience: "management.usgovcloudapi.net"},
+	} {
+		_, err := probe.New(log.NewNopLogger(), http.DefaultClient, nil, make([]string, 0),
+			cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), options)
+		require.Error(t, err, options)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	t.Parallel()
+
+	var resourceGraphRequests atomic.Int32
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults())
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "management.azure.com" {
+				resourceGraphRequests.Add(1)
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	requestQuery := "resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&queryCacheExpiration=1m"
+
+	require.Error(t, probeHandler.Warmup(context.Background(), "resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric"))
+	require.NoError(t, probeHandler.Warmup(context.Background(), requestQuery))
+	assert.Equal(t, int32(1), resourceGraphRequests.Load())
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?"+requestQuery, nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, int32(1), resourceGraphRequests.Load())
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_resources_cache_age_seconds")
+	assert.NotContains(t, recorder.Body.String(), "azure_monitor_scrape_resources_cache_age_seconds 0\n")
+
+	recorder = httptest.NewRecorder()
+
+	probeHandler.ServeConfigHTTP()(recorder, httptest.NewRequest(http.MethodGet, "/config?"+requestQuery, nil))
+
+	var config map[string]any
+
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&config))
+	assert.NotEmpty(t, config["CacheCreated"])
+	assert.NotEmpty(t, config["CacheExpiration"])
+}
+
+func TestProbePageLimitNotCached(t *testing.T) {
+	t.Parallel()
+
+	var resourceGraphRequests atomic.Int32
+
+	resourceGraphResponse := mockResourceGraphResponse(1)
+	resourceGraphResponse.SkipToken = to.Ptr("next")
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, resourceGraphResponse, mockMetricResults())
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "management.azure.com" {
+				resourceGraphRequests.Add(1)
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{MaxPages: 1})
+	require.NoError(t, err)
+
+	for range 2 {
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&queryCacheExpiration=1h", nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_resourcegraph_page_limit_reached 1")
+	}
+
+	// The truncated resources are queried again by the second probe.
+	assert.Equal(t, int32(2), resourceGraphRequests.Load())
+}
+
+func TestQueryCacheJitter(t *testing.T) {
+	t.Parallel()
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults()),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{QueryCacheJitter: 50})
+	require.NoError(t, err)
+
+	expirations := make(map[time.Duration]struct{})
+
+	// Each query has its own cache entry.
+	for i := range 20 {
+		requestQuery := url.Values{
+			"resourceType":         {"Microsoft.Compute/virtualMachines"},
+			"metricName":           {"VmAvailabilityMetric"},
+			"queryCacheExpiration": {"1h"},
+			"query":                {fmt.Sprintf("Resources | where name != 'vm%d'", i)},
+		}.Encode()
+
+		require.NoError(t, probeHandler.Warmup(context.Background(), requestQuery))
+
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeConfigHTTP()(recorder, httptest.NewRequest(http.MethodGet, "/config?"+requestQuery, nil))
+
+		var config map[string]any
+
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(&config))
+
+		cacheCreated, err := time.Parse(time.RFC3339, config["CacheCreated"].(string)) //nolint:forcetypeassert
+		require.NoError(t, err)
+		cacheExpiration, err := time.Parse(time.RFC3339, config["CacheExpiration"].(string)) //nolint:forcetypeassert
+		require.NoError(t, err)
+
+		// The timestamps have a resolution of seconds.
+		expiration := cacheExpiration.Sub(cacheCreated)
+		assert.GreaterOrEqual(t, expiration, 30*time.Minute-time.Second)
+		assert.LessOrEqual(t, expiration, 90*time.Minute+time.Second)
+
+		expirations[expiration] = struct{}{}
+	}
+
+	assert.Greater(t, len(expirations), 1, "the expirations are not randomized")
+}
+
+func TestProbeNoCache(t *testing.T) {
+	t.Parallel()
+
+	var resourceGraphRequests atomic.Int32
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults())
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "management.azure.com" {
+				resourceGraphRequests.Add(1)
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	requestQuery := "resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&queryCacheExpiration=1m"
+
+	for i, request := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/probe?"+requestQuery, nil),
+		httptest.NewRequest(http.MethodGet, "/probe?"+requestQuery+"&noCache=true", nil),
+		func() *http.Request {
+			request := httptest.NewRequest(http.MethodGet, "/probe?"+requestQuery, nil)
+			request.Header.Set("Cache-Control", "max-age=0, no-cache")
+
+			return request
+		}(),
+	} {
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, int32(i+1), resourceGraphRequests.Load())
+	}
+
+	// The bypassing probes still populate the cache.
+	recorder := httptest.NewRecorder()
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet, "/probe?"+requestQuery, nil))
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, int32(3), resourceGraphRequests.Load())
+	assert.NotContains(t, recorder.Body.String(), "azure_monitor_scrape_resources_cache_age_seconds 0\n")
+}
+
+func TestProbeCacheKeyInfo(t *testing.T) {
+	t.Parallel()
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults()),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	cacheKeyRegexp := regexp.MustCompile(`azure_monitor_scrape_cache_key_info\{cache_key="([0-9a-f]{12})"} 1`)
+
+	cacheKey := func(request string) string {
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet, request, nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		match := cacheKeyRegexp.FindStringSubmatch(recorder.Body.String())
+		if match == nil {
+			return ""
+		}
+
+		return match[1]
+	}
+
+	requestQuery := "/probe?resourceType=Microsoft.Compute/virtualMachines&queryCacheExpiration=1m"
+
+	assert.Empty(t, cacheKey(requestQuery+"&metricName=VmAvailabilityMetric"))
+
+	// Probes with different metric names share the cached resources.
+	cacheKeyA := cacheKey(requestQuery + "&metricName=VmAvailabilityMetric&includeCacheKey=true")
+	cacheKeyB := cacheKey(requestQuery + "&metricName=Percentage%20CPU&includeCacheKey=true")
+	cacheKeyC := cacheKey(requestQuery + "&metricName=VmAvailabilityMetric&includeCacheKey=true&subscriptionID=00000000-0000-0000-0000-000000000000")
+
+	require.NotEmpty(t, cacheKeyA)
+	assert.Equal(t, cacheKeyA, cacheKeyB)
+	assert.NotEqual(t, cacheKeyA, cacheKeyC)
+}
+
+func TestProbeMetricCache(t *testing.T) {
+	t.Parallel()
+
+	var metricRequests atomic.Int32
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults(azmetrics.TimeSeriesElement{
+		Data: []azmetrics.MetricValue{
+			{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+		},
+	}))
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if strings.HasSuffix(req.URL.Host, ".metrics.monitor.azure.com") {
+				metricRequests.Add(1)
+			}
+
+			return mockTransport.RoundTrip(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	probeBody := func(request string) string {
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet, request, nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		return recorder.Body.String()
+	}
+
+	requestQuery := "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&timespan=PT5M"
+
+	body := probeBody(requestQuery + "&metricCacheExpiration=5m")
+	assert.Contains(t, body, "azure_monitor_scrape_metric_cache_hits 0")
+	assert.Equal(t, int32(1), metricRequests.Load())
+
+	body = probeBody(requestQuery + "&metricCacheExpiration=5m")
+	assert.Contains(t, body, "azure_monitor_scrape_metric_cache_hits 1")
+	assert.Contains(t, body, `vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0"`)
+	assert.Equal(t, int32(1), metricRequests.Load())
+
+	// The aggregation and filter are part of the cache key.
+	probeBody(requestQuery + "&metricCacheExpiration=5m&aggregation=Maximum")
+	probeBody(requestQuery + "&metricCacheExpiration=5m&filter=LUN%20eq%20'0'")
+	assert.Equal(t, int32(3), metricRequests.Load())
+
+	// noCache skips the cache read, without metricCacheExpiration the cache is not used.
+	probeBody(requestQuery + "&metricCacheExpiration=5m&noCache=true")
+	body = probeBody(requestQuery)
+	assert.NotContains(t, body, "azure_monitor_scrape_metric_cache_hits")
+	assert.Equal(t, int32(5), metricRequests.Load())
+}
+
+func TestProbeMaxAge(t *testing.T) {
+	t.Parallel()
+
+	probeBody := func(timestamp time.Time, request string) string {
+		httpClient := &http.Client{
+			Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(timestamp), Average: to.Ptr(1.0)},
+				},
+			})),
+		}
+
+		probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+			cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet, request, nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		return recorder.Body.String()
+	}
+
+	requestQuery := "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&timespan=PT5M"
+
+	body := probeBody(time.Now().Add(-50*time.Minute), requestQuery+"&maxAge=1h")
+	assert.Contains(t, body, "vmavailabilitymetric_average_count{")
+
+	body = probeBody(time.Now().Add(-2*time.Hour), requestQuery+"&maxAge=1h")
+	assert.NotContains(t, body, "vmavailabilitymetric_average_count{")
+	assert.Contains(t, body, "azure_monitor_scrape_collector_success 1")
+
+	body = probeBody(time.Now().Add(-2*time.Hour), requestQuery)
+	assert.Contains(t, body, "vmavailabilitymetric_average_count{")
+}
+
+func TestServeCacheFlushHTTP(t *testing.T) {
+	t.Parallel()
+
+	var resourceGraphRequests atomic.Int32
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults(azmetrics.TimeSeriesElement{
+		Data: []azmetrics.MetricValue{
+			{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+		},
+	}))
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "management.azure.com" {
+				resourceGraphRequests.Add(1)
+			}
+
+			return mockTransport.RoundTrip(req)
+		}),
+	}
+
+	metricsClientCache := cache.NewCache[azmetrics.Client]()
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), metricsClientCache, probe.Options{})
+	require.NoError(t, err)
+
+	probeRequest := func() {
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&queryCacheExpiration=1h&metricCacheExpiration=1h", nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	flush := func(request string) (int, map[string]int) {
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeCacheFlushHTTP()(recorder, httptest.NewRequest(http.MethodPost, request, nil))
+
+		var evicted map[string]int
+		if recorder.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(recorder.Body).Decode(&evicted))
+		}
+
+		return recorder.Code, evicted
+	}
+
+	probeRequest()
+	probeRequest()
+	assert.Equal(t, int32(1), resourceGraphRequests.Load())
+
+	code, evicted := flush("/-/cache/flush")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]int{"queryCache": 1, "metricCache": 1, "metricDefinitionsCache": 0}, evicted)
+	assert.Equal(t, 1, metricsClientCache.Len())
+
+	probeRequest()
+	assert.Equal(t, int32(2), resourceGraphRequests.Load())
+
+	code, evicted = flush("/-/cache/flush?metricsClients=true")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]int{"queryCache": 1, "metricCache": 1, "metricDefinitionsCache": 0, "metricsClientCache": 1}, evicted)
+	assert.Zero(t, metricsClientCache.Len())
+
+	code, _ = flush("/-/cache/flush?metricsClients=maybe")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	recorder := httptest.NewRecorder()
+	probeHandler.ServeCacheFlushHTTP()(recorder, httptest.NewRequest(http.MethodGet, "/-/cache/flush", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, http.MethodPost, recorder.Header().Get("Allow"))
+}
+
+func TestProbeSubscriptionChunks(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu                 sync.Mutex
+		querySubscriptions []int
+	)
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults(azmetrics.TimeSeriesElement{
+		Data: []azmetrics.MetricValue{
+			{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+		},
+	}))
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "management.azure.com" {
+				var queryRequest armresourcegraph.QueryRequest
+				if err := json.NewDecoder(req.Body).Decode(&queryRequest); err != nil {
+					return nil, err
+				}
+
+				mu.Lock()
+				querySubscriptions = append(querySubscriptions, len(queryRequest.Subscriptions))
+				mu.Unlock()
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	subscriptions := make([]string, 5)
+	for i := range subscriptions {
+		subscriptions[i] = fmt.Sprintf("00000000-0000-0000-0000-%012d", i)
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), subscriptions,
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{SubscriptionsPerQuery: 2})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_collector_success 1")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []int{2, 2, 1}, querySubscriptions)
+}
+
+func TestProbeAggregationOverrides(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu             sync.Mutex
+		metricRequests []string
+	)
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults())
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if strings.HasSuffix(req.URL.Host, "metrics.monitor.azure.com") {
+				mu.Lock()
+				metricRequests = append(metricRequests, req.URL.Query().Get("metricnames")+"="+req.URL.Query().Get("aggregation"))
+				mu.Unlock()
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines"+
+		"&metricName=Percentage%20CPU&metricName=Network%20In&metricName=Network%20Out&aggregation=average,Network%20In:total,Network%20Out:total", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_collector_success 1")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []string{"Percentage CPU=average", "Network In,Network Out=total"}, metricRequests)
+}
+
+func TestProbeMissingColumns(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		query       string
+		row         map[string]any
+		expectedErr string
+	}{
+		{
+			name:  "renamed id",
+			query: "Resources | project-rename resourceId = id",
+			row: map[string]any{
+				"resourceId":     "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",
+				"location":       "westeurope",
+				"subscriptionId": "00000000-0000-0000-0000-000000000000",
+			},
+			expectedErr: "missing column id. The query must not project away or rename the columns id, subscriptionId, location. " +
+				"Available columns: [location resourceId subscriptionId]",
+		},
+		{
+			name:        "projected away",
+			query:       "Resources | project name",
+			row:         map[string]any{"name": "vm0"},
+			expectedErr: "the query returned none of the required columns id, subscriptionId, location",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			httpClient := &http.Client{
+				Transport: testutil.MockTransport(http.DefaultTransport, armresourcegraph.QueryResponse{
+					Count:           to.Ptr(int64(1)),
+					TotalRecords:    to.Ptr(int64(1)),
+					ResultTruncated: to.Ptr(armresourcegraph.ResultTruncatedFalse),
+					Data:            []map[string]any{tc.row},
+				}, mockMetricResults()),
+			}
+
+			probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+			require.NoError(t, err)
+
+			request := httptest.NewRequest(http.MethodGet,
+				"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&query="+url.QueryEscape(tc.query), nil)
+			recorder := httptest.NewRecorder()
+
+			probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+			require.Equal(t, http.StatusInternalServerError, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), tc.expectedErr)
+		})
+	}
+}
+
+func TestProbeDefaultAggregation(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name                string
+		request             string
+		expectedAggregation string
+	}{
+		{
+			name:                "without aggregation",
+			request:             "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU",
+			expectedAggregation: "average,total,count",
+		},
+		{
+			name:                "with aggregation",
+			request:             "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&aggregation=maximum",
+			expectedAggregation: "maximum",
+		},
+		{
+			name:                "raw time series",
+			request:             "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&aggregation=none",
+			expectedAggregation: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var aggregation atomic.Value
+
+			mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults())
+			httpClient := &http.Client{
+				Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					if strings.HasSuffix(req.URL.Host, "metrics.monitor.azure.com") {
+						aggregation.Store(req.URL.Query().Get("aggregation"))
+					}
+
+					return mockTransport(req)
+				}),
+			}
+
+			probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{DefaultAggregation: "Average, total,count"})
+			require.NoError(t, err)
+
+			recorder := httptest.NewRecorder()
+
+			probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet, tc.request, nil))
+
+			require.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, tc.expectedAggregation, aggregation.Load())
+		})
+	}
+
+	_, err := probe.New(log.NewNopLogger(), http.DefaultClient, nil, make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{DefaultAggregation: "average,median"})
+	require.EqualError(t, err, `default aggregation "median" must be one of average, total, maximum, minimum, count`)
+}
+
+func TestProbeMetricsRegion(t *testing.T) {
+	t.Parallel()
+
+	resourceGraphResponse := mockResourceGraphResponse(1)
+	resourceGraphResponse.Data.([]map[string]any)[0]["location"] = "global"
+
+	for _, tc := range []struct {
+		name                string
+		globalMetricsRegion string
+		parameters          string
+		expectedCode        int
+		expectedBody        string
+		expectedHosts       []string
+	}{
+		{
+			name:                "mapped",
+			globalMetricsRegion: "westus2",
+			expectedCode:        http.StatusOK,
+			expectedHosts:       []string{"westus2.metrics.monitor.azure.com"},
+		},
+		{
+			name:         "unmapped",
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: `no metrics region configured for resources with location "global"`,
+		},
+		{
+			name:          "region parameter",
+			parameters:    "&region=NorthEurope",
+			expectedCode:  http.StatusOK,
+			expectedHosts: []string{"northeurope.metrics.monitor.azure.com"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				mu           sync.Mutex
+				metricsHosts []string
+			)
+
+			mockTransport := testutil.MockTransport(http.DefaultTransport, resourceGraphResponse, mockMetricResults())
+			httpClient := &http.Client{
+				Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					if strings.HasSuffix(req.URL.Host, "metrics.monitor.azure.com") {
+						mu.Lock()
+						metricsHosts = append(metricsHosts, req.URL.Host)
+						mu.Unlock()
+					}
+
+					return mockTransport(req)
+				}),
+			}
+
+			probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{GlobalMetricsRegion: tc.globalMetricsRegion})
+			require.NoError(t, err)
+
+			request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Network/trafficManagerProfiles&metricName=ProbeAgentCurrentEndpointStateByProfileResourceId"+tc.parameters, nil)
+			recorder := httptest.NewRecorder()
+
+			probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+			require.Equal(t, tc.expectedCode, recorder.Code, recorder.Body.String())
+			assert.Contains(t, recorder.Body.String(), tc.expectedBody)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			assert.Equal(t, tc.expectedHosts, metricsHosts)
+		})
+	}
+}
+
+func TestProbeTarget(t *testing.T) {
+	t.Parallel()
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults()),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&target=virtual-machines", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `azure_monitor_scrape_collector_success{target="virtual-machines"} 1`)
+	assert.Contains(t, recorder.Body.String(), `azure_monitor_scrape_timeout_seconds{target="virtual-machines"} 9.5`)
+}
+
+func TestProbeConstLabels(t *testing.T) {
+	t.Parallel()
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults()),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{ConstLabels: prometheus.Labels{"cluster": "prod"}})
+	require.NoError(t, err)
+
+	for request, expectedMetric := range map[string]string{
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric":           `azure_monitor_scrape_collector_success{cluster="prod"} 1`,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&target=vm": `azure_monitor_scrape_collector_success{cluster="prod",target="vm"} 1`,
+	} {
+		recorder := httptest.NewRecorder()
+
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet, request, nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), expectedMetric)
+	}
+}
+
+func TestProbeLegacyMetricsFallback(t *testing.T) {
+	t.Parallel()
+
+	for _, fallback := range []bool{false, true} {
+		t.Run(strconv.FormatBool(fallback), func(t *testing.T) {
+			t.Parallel()
+
+			var legacyQuery url.Values
+
+			mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults())
+			httpClient := &http.Client{
+				Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					recorder := httptest.NewRecorder()
+
+					switch {
+					case strings.HasSuffix(req.URL.Host, ".metrics.monitor.azure.com"):
+						recorder.WriteHeader(http.StatusBadRequest)
+						_, _ = recorder.WriteString(`{"error":{"code":"BadRequest","message":"Metric namespace microsoft.compute/virtualmachines is not supported."}}`)
+					case strings.HasSuffix(req.URL.Path, "/providers/Microsoft.Insights/metrics"):
+						legacyQuery = req.URL.Query()
+
+						recorder.WriteHeader(http.StatusOK)
+						_, _ = recorder.WriteString(`{
+						  "timespan": "2024-01-01T00:00:00Z/2024-01-01T01:00:00Z",
+						  "interval": "PT5M",
+						  "namespace": "Microsoft.Compute/virtualMachines",
+						  "resourceregion": "westeurope",
+						  "value": [{
+						    "id": "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0/providers/Microsoft.Insights/metrics/VmAvailabilityMetric",
+						    "name": {"value": "VmAvailabilityMetric", "localizedValue": "VM Availability Metric (Preview)"},
+						    "unit": "Count",
+						    "timeseries": [{"metadatavalues": [], "data": [{"timeStamp": "2024-01-01T00:30:00Z", "average": 1}]}]
+						  }]
+						}`)
+					default:
+						return mockTransport(req)
+					}
+
+					return recorder.Result(), nil
+				}),
+			}
+
+			probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{LegacyMetricsFallback: fallback})
+			require.NoError(t, err)
+
+			recorder := httptest.NewRecorder()
+			probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet,
+				"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&aggregation=average&interval=PT5M", nil))
+
+			if !fallback {
+				require.Equal(t, http.StatusInternalServerError, recorder.Code)
+				assert.Contains(t, recorder.Body.String(), "is not supported")
+				assert.Nil(t, legacyQuery)
+
+				return
+			}
+
+			require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+			assert.Contains(t, recorder.Body.String(), `azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`)
+			assert.Equal(t, "VmAvailabilityMetric", legacyQuery.Get("metricnames"))
+			assert.Equal(t, "average", legacyQuery.Get("aggregation"))
+			assert.Equal(t, "PT5M", legacyQuery.Get("interval"))
+		})
+	}
+}
+
+func TestProbeSubscriptionScope(t *testing.T) {
+	t.Parallel()
+
+	var (
+		metricsQuery          url.Values
+		resourceGraphRequests atomic.Int32
+	)
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults())
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			switch req.URL.Path {
+			case "/providers/Microsoft.ResourceGraph/resources":
+				resourceGraphRequests.Add(1)
+			case "/subscriptions/00000000-0000-0000-0000-000000000000/providers/Microsoft.Insights/metrics":
+				metricsQuery = req.URL.Query()
+
+				recorder := httptest.NewRecorder()
+				recorder.WriteHeader(http.StatusOK)
+				_, _ = recorder.WriteString(`{
+				  "timespan": "2024-01-01T00:00:00Z/2024-01-01T01:00:00Z",
+				  "interval": "PT5M",
+				  "namespace": "Microsoft.Compute/virtualMachines",
+				  "resourceregion": "westeurope",
+				  "value": [{
+				    "id": "/subscriptions/00000000-0000-0000-0000-000000000000/providers/Microsoft.Insights/metrics/Percentage CPU",
+				    "name": {"value": "Percentage CPU", "localizedValue": "Percentage CPU"},
+				    "unit": "Percent",
+				    "timeseries": [{"metadatavalues": [], "data": [{"timeStamp": "2024-01-01T00:30:00Z", "average": 42}]}]
+				  }]
+				}`)
+
+				return recorder.Result(), nil
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), []string{"00000000-0000-0000-0000-000000000000"},
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&aggregation=average&scope=subscription&region=westeurope", nil))
+
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Contains(t, recorder.Body.String(), `azure_monitor_microsoft_compute_virtualmachines_percentagecpu_average_percent{instance="/subscriptions/00000000-0000-0000-0000-000000000000",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 42`)
+	assert.Equal(t, int32(0), resourceGraphRequests.Load())
+	assert.Equal(t, "westeurope", metricsQuery.Get("region"))
+	assert.Equal(t, "Percentage CPU", metricsQuery.Get("metricnames"))
+	assert.Equal(t, "Microsoft.Compute/virtualMachines", metricsQuery.Get("metricnamespace"))
+}
+
+func TestProbeResourceManagerEndpoint(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		armHosts = make(map[string]struct{})
+		scopes   []string
+	)
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults())
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case req.URL.Host == "login.microsoftonline.com" && req.Method == http.MethodPost:
+				if err := req.ParseForm(); err != nil {
+					return nil, err
+				}
+
+				scopes = append(scopes, req.PostForm.Get("scope"))
+
+				recorder := httptest.NewRecorder()
+				_, _ = recorder.WriteString(strings.ReplaceAll(testutil.MockTokenResponse,
+					"https://management.core.windows.net//.default", "https://management.usgovcloudapi.net/.default"))
+
+				return recorder.Result(), nil
+			case strings.HasPrefix(req.URL.Host, "management."):
+				armHosts[req.URL.Host] = struct{}{}
+
+				if strings.HasSuffix(req.URL.Path, "/providers/Microsoft.Insights/metrics") {
+					recorder := httptest.NewRecorder()
+					recorder.WriteHeader(http.StatusOK)
+					_, _ = recorder.WriteString(`{"timespan": "2024-01-01T00:00:00Z/2024-01-01T01:00:00Z", "value": []}`)
+
+					return recorder.Result(), nil
+				}
+
+				// The mock serves the Azure Resource Manager API of the public cloud.
+				req = req.Clone(req.Context())
+				req.URL.Host = "management.azure.com"
+				req.Host = "management.azure.com"
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), []string{"00000000-0000-0000-0000-000000000000"},
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{
+			ResourceManagerEndpoint: "https://management.usgovcloudapi.net",
+			ResourceManagerAudience: "https://management.usgovcloudapi.net",
+			LegacyMetricsFallback:   true,
+		})
+	require.NoError(t, err)
+
+	for _, request := range []string{
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=*",
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=Percentage%20CPU&scope=subscription&region=westeurope",
+	} {
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet, request, nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	assert.Equal(t, map[string]struct{}{"management.usgovcloudapi.net": {}}, armHosts)
+	assert.Contains(t, scopes, "https://management.usgovcloudapi.net/.default openid offline_access profile")
+}
+
+func TestProbeResourceFile(t *testing.T) {
+	t.Parallel()
+
+	var resourceGraphRequests atomic.Int32
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults(azmetrics.TimeSeriesElement{
+		Data: []azmetrics.MetricValue{
+			{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+		},
+	}))
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "management.azure.com" {
+				resourceGraphRequests.Add(1)
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	resourceFile := filepath.Join(t.TempDir(), "resources.yaml")
+	require.NoError(t, os.WriteFile(resourceFile, []byte(`virtual-machines:
+  - id: /subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0
+    location: West Europe
+`), 0o600))
+
+	_, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{ResourceFile: filepath.Join(t.TempDir(), "missing.yaml")})
+	require.ErrorContains(t, err, "error reading resource file")
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{ResourceFile: resourceFile})
+	require.NoError(t, err)
+
+	probeRequest := func(list string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet,
+			"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&resourceFile="+list, nil))
+
+		return recorder
+	}
+
+	recorder := probeRequest("virtual-machines")
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Contains(t, recorder.Body.String(), `azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`)
+	assert.Equal(t, int32(0), resourceGraphRequests.Load())
+
+	recorder = probeRequest("storage-accounts")
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `'resourceFile' parameter references unknown resource list "storage-accounts"`)
+
+	// The changed file is reloaded on the next probe.
+	require.NoError(t, os.WriteFile(resourceFile, []byte(`storage-accounts:
+  - id: /subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Storage/storageAccounts/sa0
+    location: westeurope
+`), 0o600))
+	require.NoError(t, os.Chtimes(resourceFile, time.Now(), time.Now().Add(time.Minute)))
+
+	recorder = probeRequest("storage-accounts")
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `of resource list "storage-accounts" is not of type Microsoft.Compute/virtualMachines`)
+}
+
+func TestProbeNoContentOnEmpty(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name         string
+		resources    int
+		parameters   string
+		expectedCode int
+	}{
+		{name: "empty", resources: 0, parameters: "&noContentOnEmpty=true", expectedCode: http.StatusNoContent},
+		{name: "empty without noContentOnEmpty", resources: 0, expectedCode: http.StatusInternalServerError},
+		{name: "resources", resources: 1, parameters: "&noContentOnEmpty=true", expectedCode: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			httpClient := &http.Client{
+				Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(tc.resources), mockMetricResults()),
+			}
+
+			probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+			require.NoError(t, err)
+
+			request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric"+tc.parameters, nil)
+			recorder := httptest.NewRecorder()
+
+			probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+			require.Equal(t, tc.expectedCode, recorder.Code)
+
+			switch tc.expectedCode {
+			case http.StatusOK:
+				assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_collector_success 1")
+			case http.StatusNoContent:
+				assert.Empty(t, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestProbeNoContentOnEmptyTimeout(t *testing.T) {
+	t.Parallel()
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(0), mockMetricResults())
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// The Resource Graph query blocks until the probe times out.
+			if req.URL.Path == "/providers/Microsoft.ResourceGraph/resources" {
+				<-req.Context().Done()
+
+				return nil, req.Context().Err()
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&noContentOnEmpty=true", nil)
+	request.Header.Set(probe.DefaultTimeoutHeader, "1")
+
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_timed_out 1")
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_collector_success 0")
+}
+
+func TestProbeSeriesLimit(t *testing.T) {
+	t.Parallel()
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults(azmetrics.TimeSeriesElement{
+			Data: []azmetrics.MetricValue{
+				{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 31, 0, 0, time.UTC)), Average: to.Ptr(2.0)},
+				{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 32, 0, 0, time.UTC)), Average: to.Ptr(3.0)},
+			},
+		})),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{MaxSeries: 2})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&aggregation=none", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `timestamp="2024-01-01T00:31:00Z"} 2`)
+	assert.NotContains(t, recorder.Body.String(), `timestamp="2024-01-01T00:32:00Z"`)
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_samples_total 2")
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_series_limit_exceeded 1")
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_timed_out 0")
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_collector_success 0")
+}
+
+func TestProbePartialTimeout(t *testing.T) {
+	t.Parallel()
+
+	var metricRequests atomic.Int32
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults(azmetrics.TimeSeriesElement{
+		Data: []azmetrics.MetricValue{
+			{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+		},
+	}))
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// The second metrics request blocks until the probe times out.
+			if strings.HasSuffix(req.URL.Host, "metrics.monitor.azure.com") && metricRequests.Add(1) > 1 {
+				<-req.Context().Done()
+
+				return nil, req.Context().Err()
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{MetricNamesPerRequest: 1})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&metricName=Percentage%20CPU", nil)
+	request.Header.Set(probe.DefaultTimeoutHeader, "1")
+
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_timed_out 1")
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_collector_success 0")
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{")
+}
+
+func TestProbeTracing(t *testing.T) {
+	t.Parallel()
+
+	spanRecorder := tracetest.NewSpanRecorder()
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults()),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{
+			TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)),
+		})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spanRecorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	require.Contains(t, spans, "probe")
+	require.Contains(t, spans, "queryResources")
+	require.Contains(t, spans, "fetchMetricsPerSubscription")
+
+	assert.Equal(t, spans["probe"].SpanContext().SpanID(), spans["queryResources"].Parent().SpanID())
+	assert.Equal(t, spans["probe"].SpanContext().SpanID(), spans["fetchMetricsPerSubscription"].Parent().SpanID())
+}
+
+func TestProbeCheck(t *testing.T) {
+	t.Parallel()
+
+	resourceGraphResponse := mockResourceGraphResponse(1)
+	resourceGraphResponse.Data.([]map[string]any)[0]["type"] = "microsoft.compute/virtualmachines"
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, resourceGraphResponse, mockMetricResults()),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), []string{"00000000-0000-0000-0000-000000000000"},
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	results := probeHandler.Check(context.Background())
+	require.Len(t, results, 3)
+
+	for _, result := range results {
+		require.NoError(t, result.Err, result.Step)
+	}
+
+	assert.Equal(t, "queried VmAvailabilityMetric of "+
+		"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0", results[2].Detail)
+}
+
+func TestProbeLabelCollision(t *testing.T) {
+	t.Parallel()
+
+	metricResults := mockMetricResults(azmetrics.TimeSeriesElement{
+		MetadataValues: []azmetrics.MetadataValue{
+			{Name: &azmetrics.LocalizableString{Value: to.Ptr("region")}, Value: to.Ptr("zone1")},
+		},
+		Data: []azmetrics.MetricValue{
+			{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+		},
+	})
+
+	for _, tc := range []struct {
+		name         string
+		parameters   string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "default",
+			expectedCode: http.StatusOK,
+			expectedBody: `azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{dim_region="zone1",` +
+				`instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",` +
+				`region="westeurope",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+		},
+		{
+			name:         "prefix label",
+			parameters:   "&labelCollision=prefix-label",
+			expectedCode: http.StatusOK,
+			expectedBody: `azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count{` +
+				`instance="/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm0",` +
+				`label_region="westeurope",region="zone1",subscription_id="00000000-0000-0000-0000-000000000000"} 1`,
+		},
+		{
+			name:         "error",
+			parameters:   "&labelCollision=error",
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: `dimension "region" collides with a label of the resource`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			httpClient := &http.Client{
+				Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), metricResults),
+			}
+
+			probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+			require.NoError(t, err)
+
+			request := httptest.NewRequest(http.MethodGet,
+				"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric"+tc.parameters, nil)
+			recorder := httptest.NewRecorder()
+
+			probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+			require.Equal(t, tc.expectedCode, recorder.Code, recorder.Body.String())
+			assert.Contains(t, recorder.Body.String(), tc.expectedBody)
+		})
+	}
+}
+
+func TestProbeMetricsClients(t *testing.T) {
+	t.Parallel()
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults()),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	probeHandler.RegisterMetrics(reg)
+
+	for range 2 {
+		request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil)
+		recorder := httptest.NewRecorder()
+
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+	}
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64, len(metricFamilies))
+	for _, metricFamily := range metricFamilies {
+		metric := metricFamily.GetMetric()[0]
+		values[metricFamily.GetName()] = metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+	}
+
+	assert.Equal(t, map[string]float64{
+		"azure_monitor_metrics_clients":               1,
+		"azure_monitor_metrics_clients_created_total": 1,
+	}, values)
+}
+
+func TestProbeMetricsAudience(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		scopes []string
+	)
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults())
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "login.microsoftonline.com" && req.Method == http.MethodPost {
+				if err := req.ParseForm(); err != nil {
+					return nil, err
+				}
+
+				mu.Lock()
+				scopes = append(scopes, req.PostForm.Get("scope"))
+				mu.Unlock()
+
+				recorder := httptest.NewRecorder()
+				_, _ = recorder.WriteString(strings.ReplaceAll(testutil.MockTokenResponse, "metrics.monitor.azure.com", "metrics.monitor.azure.us"))
+
+				return recorder.Result(), nil
+			}
+
+			return mockTransport.RoundTrip(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{MetricsAudience: "https://metrics.monitor.azure.us/.default"})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Contains(t, scopes, "https://metrics.monitor.azure.us/.default openid offline_access profile")
+}
+
+func TestProbeResourceGraphQuotaConsumed(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name             string
+		quotaRemaining   []string
+		expectedConsumed string
+	}{
+		// The first page already consumed one unit before 14 remained.
+		{name: "two pages", quotaRemaining: []string{"14", "13"}, expectedConsumed: "2"},
+		{name: "quota reset", quotaRemaining: []string{"1", "14"}, expectedConsumed: "0"},
+		{name: "without header", quotaRemaining: []string{"", ""}, expectedConsumed: "0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var resourceGraphRequests atomic.Int32
+
+			mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults(azmetrics.TimeSeriesElement{
+				Data: []azmetrics.MetricValue{
+					{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+				},
+			}))
+			httpClient := &http.Client{
+				Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					if req.URL.Path != "/providers/Microsoft.ResourceGraph/resources" {
+						return mockTransport(req)
+					}
+
+					page := resourceGraphRequests.Add(1)
+
+					response := mockResourceGraphResponse(1)
+					if page == 1 {
+						response.SkipToken = to.Ptr("next")
+					}
+
+					body, err := json.Marshal(response)
+					if err != nil {
+						return nil, err
+					}
+
+					recorder := httptest.NewRecorder()
+					if quotaRemaining := tc.quotaRemaining[page-1]; quotaRemaining != "" {
+						recorder.Header().Set("x-ms-user-quota-remaining", quotaRemaining)
+					}
+
+					recorder.WriteHeader(http.StatusOK)
+					_, _ = recorder.Write(body)
+
+					return recorder.Result(), nil
+				}),
+			}
+
+			probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+				cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+			require.NoError(t, err)
+
+			recorder := httptest.NewRecorder()
+			probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder,
+				httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil))
+
+			require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+			assert.Equal(t, int32(2), resourceGraphRequests.Load())
+			assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_resourcegraph_pages 2\n")
+			assert.Contains(t, recorder.Body.String(), "azure_monitor_resourcegraph_quota_consumed "+tc.expectedConsumed+"\n")
+		})
+	}
+}
+
+func TestProbeResourceGraphTruncated(t *testing.T) {
+	t.Parallel()
+
+	resourceGraphResponse := mockResourceGraphResponse(1)
+	resourceGraphResponse.ResultTruncated = to.Ptr(armresourcegraph.ResultTruncatedTrue)
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, resourceGraphResponse, mockMetricResults()),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	probeHandler.RegisterMetrics(reg)
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+
+	var truncated *dto.MetricFamily
+
+	for _, metricFamily := range metricFamilies {
+		if metricFamily.GetName() == "azure_monitor_resourcegraph_truncated_total" {
+			truncated = metricFamily
+		}
+	}
+
+	require.NotNil(t, truncated)
+	require.Len(t, truncated.GetMetric(), 1)
+	assert.Equal(t, "resource_type", truncated.GetMetric()[0].GetLabel()[0].GetName())
+	assert.Equal(t, "microsoft.compute/virtualmachines", truncated.GetMetric()[0].GetLabel()[0].GetValue())
+	assert.InDelta(t, 1, truncated.GetMetric()[0].GetCounter().GetValue(), 0)
+}
+
+// staticCredential returns a static access token.
+type staticCredential string
+
+func (c staticCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: string(c), ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestProbeSubscriptionCredential(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu                   sync.Mutex
+		metricsAuthorization []string
+	)
+
+	mockTransport := testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults())
+	httpClient := &http.Client{
+		Transport: promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if strings.HasSuffix(req.URL.Host, "metrics.monitor.azure.com") {
+				mu.Lock()
+				metricsAuthorization = append(metricsAuthorization, req.Header.Get("Authorization"))
+				mu.Unlock()
+			}
+
+			return mockTransport(req)
+		}),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	require.EqualError(t, probeHandler.AddSubscriptionCredential("invalid", "[", staticCredential("invalid")),
+		`invalid subscription pattern "[" of subscription credential "invalid": syntax error in pattern`)
+	require.NoError(t, probeHandler.AddSubscriptionCredential("customer-b", "11111111-*", staticCredential("customer-b")))
+	require.NoError(t, probeHandler.AddSubscriptionCredential("customer-a", "00000000-*", staticCredential("customer-a")))
+
+	request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "azure_monitor_scrape_collector_success 1")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []string{"Bearer customer-a"}, metricsAuthorization)
+}
+
+func TestProbeErrors(t *testing.T) {
+	t.Parallel()
+
+	probeHandler, err := probe.New(log.NewNopLogger(), http.DefaultClient, nil, []string{"00000000-0000-0000-0000-000000000000"},
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{MaxSubscriptionsPerProbe: 1, MaxSubscriptionIDs: 2})
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	probeHandler.RegisterMetrics(reg)
+
+	// The handler can be created multiple times for the same registerer, e.g. for a second route.
+	_ = probeHandler.ServeHTTP(reg)
+	handler := probeHandler.ServeHTTP(reg)
+
+	for _, request := range []string{
+		"/probe?metricName=VmAvailabilityMetric",
+		"/probe?metricName=VmAvailabilityMetric",
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName[]=VmAvailabilityMetric&round=-1",
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&context=unknown",
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric" +
+			"&subscriptionID=00000000-0000-0000-0000-000000000000&subscriptionID=11111111-1111-1111-1111-111111111111",
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&subscriptionID[]=00000000-0000-0000-0000-000000000000" +
+			"&subscriptionID[]=11111111-1111-1111-1111-111111111111&subscriptionID[]=22222222-2222-2222-2222-222222222222",
+	} {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, request, nil))
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	}
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+
+	idx := slices.IndexFunc(metricFamilies, func(metricFamily *dto.MetricFamily) bool {
+		return metricFamily.GetName() == "azure_monitor_probe_errors_total"
+	})
+	require.NotEqual(t, -1, idx)
+
+	errorsByReason := make(map[string]float64)
+	for _, metric := range metricFamilies[idx].GetMetric() {
+		errorsByReason[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+	}
+
+	assert.Equal(t, map[string]float64{"invalid_resourceType": 2, "invalid_round": 1, "invalid_context": 1, "too_many_subscriptions": 1, "invalid_subscriptionID": 1},
+		errorsByReason)
+}
+
+func TestProbeRequireSubscriptionIDs(t *testing.T) {
+	t.Parallel()
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults()),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), nil,
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{RequireSubscriptionIDs: true})
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil))
+
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "'subscriptionID' parameter is required, because the subscription discovery is disabled")
+
+	recorder = httptest.NewRecorder()
+	probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, httptest.NewRequest(http.MethodGet,
+		"/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric&subscriptionID=00000000-0000-0000-0000-000000000000", nil))
+
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(1), mockMetricResults(azmetrics.TimeSeriesElement{
+			Data: []azmetrics.MetricValue{
+				{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(1.0)},
+			},
+		})),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	config, err := probe.NewConfigFromValues(url.Values{
+		"resourceType": []string{"Microsoft.Compute/virtualMachines"},
+		"metricName":   []string{"VmAvailabilityMetric"},
+	})
+	require.NoError(t, err)
+
+	metrics, err := probeHandler.Run(context.Background(), config)
+	require.NoError(t, err)
+
+	var found bool
+
+	for _, metric := range metrics {
+		if strings.Contains(metric.Desc().String(), `"azure_monitor_microsoft_compute_virtualmachines_vmavailabilitymetric_average_count"`) {
+			found = true
+		}
+	}
+
+	assert.True(t, found, "metric not found in %v", metrics)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = probeHandler.Run(ctx, config)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestProbeCompression(t *testing.T) {
+	t.Parallel()
+
+	// The metrics mock returns all resources on each request, stay within a single batch of resource IDs.
+	const resourceCount = 50
+
+	metricResults := azmetrics.MetricResults{Values: make([]azmetrics.MetricData, 0, resourceCount)}
+
+	for i := range resourceCount {
+		metricData := mockMetricResults(azmetrics.TimeSeriesElement{
+			Data: []azmetrics.MetricValue{
+				{TimeStamp: to.Ptr(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)), Average: to.Ptr(float64(i))},
+			},
+		}).Values[0]
+		metricData.ResourceID = to.Ptr(fmt.Sprintf("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg-mock/providers/Microsoft.Compute/virtualMachines/vm%d", i))
+
+		metricResults.Values = append(metricResults.Values, metricData)
+	}
+
+	httpClient := &http.Client{
+		Transport: testutil.MockTransport(http.DefaultTransport, mockResourceGraphResponse(resourceCount), metricResults),
+	}
+
+	probeHandler, err := probe.New(log.NewNopLogger(), httpClient, mockCredential(t, httpClient), make([]string, 0),
+		cache.NewCache[probe.Resources](), cache.NewCache[azmetrics.Client](), probe.Options{})
+	require.NoError(t, err)
+
+	scrape := func(acceptEncoding string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/probe?resourceType=Microsoft.Compute/virtualMachines&metricName=VmAvailabilityMetric", nil)
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+
+		recorder := httptest.NewRecorder()
+
+		probeHandler.ServeHTTP(prometheus.NewRegistry())(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		return recorder
+	}
+
+	plain := scrape("")
+	assert.Empty(t, plain.Header().Get("Content-Encoding"))
+
+	compressed := scrape("gzip")
+	require.Equal(t, "gzip", compressed.Header().Get("Content-Encoding"))
+
+	compressedSize := compressed.Body.Len()
+
+	reader, err := gzip.NewReader(compressed.Body)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "azure_monitor_scrape_collector_success 1")
+	// The scrape durations differ between both responses.
+	assert.InDelta(t, plain.Body.Len(), len(body), 100)
+
+	t.Logf("response size of %d resources: %d bytes, gzip compressed: %d bytes (%.1f%%)",
+		resourceCount, plain.Body.Len(), compressedSize, float64(compressedSize)/float64(plain.Body.Len())*100)
+
+	assert.Less(t, compressedSize*5, plain.Body.Len(), "gzip should reduce the response size by more than 80%")
+}
+
+func mockCredential(tb testing.TB, httpClient *http.Client) azcore.TokenCredential {
+	tb.Helper()
+
+	cred, err := azidentity.NewClientSecretCredential(
+		"mock",
+		"00000000-0000-0000-0000-000000000000",
+		"invalid",
+		&azidentity.ClientSecretCredentialOptions{
+			DisableInstanceDiscovery: true,
+			ClientOptions: azcore.ClientOptions{
+				Transport: httpClient,
+			},
+		},
+	)
+	require.NoError(tb, err)
+
+	return cred
+}
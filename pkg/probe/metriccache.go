@@ -0,0 +1,65 @@
+package probe
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
+)
+
+// queryMetricsCached returns the metrics of the resources from the metric cache, if Config.MetricCacheExpiration is set.
+// Otherwise or on a cache miss, the metrics are queried and stored in the metric cache. Like the query cache,
+// Config.NoCache skips the cache read only.
+func (r *Request) queryMetricsCached(
+	ctx context.Context, client *azmetrics.Client, subscriptionID, metricNamespace string, resourceIDs []string, metricQuery metricQuery,
+) ([]azmetrics.MetricData, error) {
+	if r.config.MetricCacheExpiration <= 0 {
+		return r.queryMetrics(ctx, client, subscriptionID, metricNamespace, resourceIDs, metricQuery)
+	}
+
+	cacheKey := r.metricCacheKey(subscriptionID, metricNamespace, resourceIDs, metricQuery)
+
+	if !r.config.NoCache {
+		if values, ok := r.probe.metricCache.Get(cacheKey); ok {
+			r.metricCacheHits++
+
+			return *values, nil
+		}
+	}
+
+	values, err := r.queryMetrics(ctx, client, subscriptionID, metricNamespace, resourceIDs, metricQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	r.probe.metricCache.Set(cacheKey, &values, r.config.MetricCacheExpiration)
+
+	return values, nil
+}
+
+// metricCacheKey returns the key of the metric cache. It contains everything, which changes the response of Azure Monitor,
+// e.g. the resources, the metric names, the aggregation and the filter. The start and end time are replaced by the
+// length of the time span, because they change with every probe.
+func (r *Request) metricCacheKey(subscriptionID, metricNamespace string, resourceIDs []string, metricQuery metricQuery) string {
+	// The query parameters of the per-resource metrics API contain all options of the metric query.
+	query := legacyMetricsQuery(strings.ToLower(metricNamespace), metricQuery)
+	query.Del("api-version")
+
+	if options := metricQuery.options; options != nil && options.StartTime != nil && options.EndTime != nil {
+		startTime, startErr := time.Parse(time.RFC3339, *options.StartTime)
+		endTime, endErr := time.Parse(time.RFC3339, *options.EndTime)
+
+		if startErr == nil && endErr == nil {
+			query.Set("timespan", endTime.Sub(startTime).Round(time.Second).String())
+		}
+	}
+
+	cacheKey := fmt.Sprintf("%s-%s-%s-%s", r.credentials.name, subscriptionID, strings.ToLower(strings.Join(resourceIDs, ",")), query.Encode())
+	hash := sha256.Sum256([]byte(cacheKey))
+
+	return hex.EncodeToString(hash[:])
+}
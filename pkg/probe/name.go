@@ -0,0 +1,73 @@
+package probe
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// nameCaseLower lower-cases the names and removes spaces. This is the default.
+	nameCaseLower = "lower"
+	// nameCaseSnake converts camelCase and spaces to snake_case.
+	nameCaseSnake = "snake"
+	// nameCasePreserve keeps the case of the names and removes spaces.
+	nameCasePreserve = "preserve"
+)
+
+// nameCases contains the supported values of the nameCase parameter.
+var nameCases = []string{nameCaseLower, nameCaseSnake, nameCasePreserve}
+
+// formatName converts an Azure metric name or namespace into a part of a Prometheus metric name.
+// Characters, which are not valid in a Prometheus metric name, e.g. '.' and '/', are replaced by '_'.
+func formatName(name, nameCase string) string {
+	switch nameCase {
+	case nameCaseSnake:
+		name = strings.ToLower(snakeCase(name))
+	case nameCasePreserve:
+		name = strings.ReplaceAll(name, " ", "")
+	default:
+		name = strings.ReplaceAll(strings.ToLower(name), " ", "")
+	}
+
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+
+		return '_'
+	}, name)
+}
+
+// snakeCase inserts an underscore at every word boundary of a camelCase name and replaces spaces by underscores,
+// e.g. "VmAvailabilityMetric" becomes "Vm_Availability_Metric" and "CPUCredits Remaining" becomes "CPU_Credits_Remaining".
+func snakeCase(name string) string {
+	runes := []rune(name)
+
+	var builder strings.Builder
+
+	builder.Grow(len(name) + 4)
+
+	for i, r := range runes {
+		if r == ' ' || r == '.' || r == '/' {
+			r = '_'
+		}
+
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextIsLower) {
+				builder.WriteRune('_')
+			}
+		}
+
+		// Avoid repeated underscores, e.g. for "Bytes / sec".
+		if r == '_' && builder.Len() > 0 && strings.HasSuffix(builder.String(), "_") {
+			continue
+		}
+
+		builder.WriteRune(r)
+	}
+
+	return builder.String()
+}
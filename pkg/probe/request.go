@@ -6,56 +6,239 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/sosodev/duration"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/maps"
 )
 
+// errSeriesLimitExceeded is returned, if a probe exceeds Options.MaxSeries.
+var errSeriesLimitExceeded = errors.New("probe exceeds the series limit")
+
 func (r *Request) Describe(_ chan<- *prometheus.Desc) {
 	// Return no descriptors to turn the collector into an unchecked collector.
 }
 
 func (r *Request) Collect(ch chan<- prometheus.Metric) {
-	ctx, cancel := context.WithDeadline(r.Context(), time.Now().Add(r.getProbeTimeout()))
+	timeout := r.getProbeTimeout()
+
+	ctx, cancel := context.WithDeadline(r.Context(), time.Now().Add(timeout))
 	defer cancel()
 
-	startTime := time.Now()
+	ch <- prometheus.MustNewConstMetric(r.descs.scrapeTimeout, prometheus.GaugeValue, timeout.Seconds())
+
+	err := r.collect(ctx, ch)
 
-	azureResources, err := r.getResources(ctx)
+	seriesLimitExceeded := 0.0
+	if errors.Is(err, errSeriesLimitExceeded) {
+		seriesLimitExceeded = 1
+	}
 
-	ch <- prometheus.MustNewConstMetric(r.probe.scrapeDurationDesc, prometheus.GaugeValue, time.Since(startTime).Seconds(), "query_resources")
+	ch <- prometheus.MustNewConstMetric(r.descs.samples, prometheus.GaugeValue, float64(r.samples))
+	ch <- prometheus.MustNewConstMetric(r.descs.seriesLimitExceeded, prometheus.GaugeValue, seriesLimitExceeded)
 
-	if err != nil {
+	if err == nil {
+		r.succeeded = true
+
+		ch <- prometheus.MustNewConstMetric(r.descs.scrapeTimedOut, prometheus.GaugeValue, 0)
+		ch <- prometheus.MustNewConstMetric(r.descs.scrapeSuccess, prometheus.GaugeValue, 1)
+
+		return
+	}
+
+	// An invalid metric discards all metrics of the scrape.
+	// On timeout or exceeded series limit, the metrics collected so far are returned instead.
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		_ = level.Warn(r).Log("msg", "Probe timed out, returning partial metrics", "timeout", timeout, "err", err)
+
+		ch <- prometheus.MustNewConstMetric(r.descs.scrapeTimedOut, prometheus.GaugeValue, 1)
+	case errors.Is(err, errSeriesLimitExceeded):
+		_ = level.Warn(r).Log("msg", "Probe exceeds the series limit, returning partial metrics", "err", err)
+
+		ch <- prometheus.MustNewConstMetric(r.descs.scrapeTimedOut, prometheus.GaugeValue, 0)
+	default:
 		ch <- prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
-		ch <- prometheus.MustNewConstMetric(r.probe.scrapeSuccessDesc, prometheus.GaugeValue, 0)
+	}
+
+	ch <- prometheus.MustNewConstMetric(r.descs.scrapeSuccess, prometheus.GaugeValue, 0)
+}
 
+// collect queries the resources and fetches their metrics. It is independent of the HTTP request,
+// the timeout has to be applied to the context by the caller.
+func (r *Request) collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	startTime := time.Now()
+
+	azureResources, resourceGraphStats, err := r.getResources(ctx)
+
+	ch <- prometheus.MustNewConstMetric(r.descs.scrapeDuration, prometheus.GaugeValue, time.Since(startTime).Seconds(), "query_resources")
+
+	if err != nil {
 		_ = level.Error(r).Log("msg", "Error querying resources", "err", err)
 
-		return
+		return err
+	}
+
+	r.resourceCount = azureResources.count()
+
+	pageLimitReached := 0.0
+	if azureResources.PageLimitReached {
+		pageLimitReached = 1
+	}
+
+	partialScopes := 0.0
+	if azureResources.PartialScopes {
+		partialScopes = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(r.descs.resourceGraphPageLimit, prometheus.GaugeValue, pageLimitReached)
+	ch <- prometheus.MustNewConstMetric(r.descs.resourceGraphPartialScopes, prometheus.GaugeValue, partialScopes)
+	ch <- prometheus.MustNewConstMetric(r.descs.resourceGraphQuotaConsumed, prometheus.GaugeValue, resourceGraphStats.quotaConsumed)
+	ch <- prometheus.MustNewConstMetric(r.descs.resourcesCacheAge, prometheus.GaugeValue, resourceGraphStats.cacheAge)
+	ch <- prometheus.MustNewConstMetric(r.descs.resourceGraphPages, prometheus.GaugeValue, float64(resourceGraphStats.pages))
+	ch <- prometheus.MustNewConstMetric(r.descs.resourceGraphRows, prometheus.GaugeValue, float64(resourceGraphStats.rows))
+
+	if r.config.EmitResourceCount {
+		r.collectResourceCount(azureResources, ch)
+	}
+
+	if r.config.EmitResourceInfo {
+		if err = r.collectResourceInfo(azureResources, ch); err != nil {
+			return err
+		}
+	}
+
+	// Resources of a resource file or the subscription scope are not cached.
+	if r.config.IncludeCacheKey && r.config.ResourceFile == "" && r.config.Scope != scopeSubscription {
+		ch <- prometheus.MustNewConstMetric(r.descs.cacheKeyInfo, prometheus.GaugeValue, 1, r.cacheKey()[:shortCacheKeyLength])
 	}
 
 	startTime = time.Now()
 	err = r.fetchMetrics(ctx, azureResources, ch)
 
-	ch <- prometheus.MustNewConstMetric(r.probe.scrapeDurationDesc, prometheus.GaugeValue, time.Since(startTime).Seconds(), "fetch_metrics")
+	ch <- prometheus.MustNewConstMetric(r.descs.scrapeDuration, prometheus.GaugeValue, time.Since(startTime).Seconds(), "fetch_metrics")
 
 	if err != nil {
-		ch <- prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
-		ch <- prometheus.MustNewConstMetric(r.probe.scrapeSuccessDesc, prometheus.GaugeValue, 0)
-
 		_ = level.Error(r).Log("msg", "Error fetching metrics", "err", err)
 
-		return
+		return err
+	}
+
+	ch <- prometheus.MustNewConstMetric(r.descs.resourcesWithoutMetrics, prometheus.GaugeValue, float64(r.resourcesWithoutMetrics))
+
+	if r.config.MetricCacheExpiration > 0 {
+		ch <- prometheus.MustNewConstMetric(r.descs.metricCacheHits, prometheus.GaugeValue, float64(r.metricCacheHits))
+	}
+
+	if r.config.SkipNullMetrics {
+		r.collectNullMetrics(ch)
+	}
+
+	return nil
+}
+
+// count returns the number of resources of all locations and subscriptions.
+func (r *Resources) count() int {
+	count := 0
+
+	for _, subscriptions := range r.Resources {
+		for _, resourceIDs := range subscriptions {
+			count += len(resourceIDs)
+		}
+	}
+
+	return count
+}
+
+// collectNullMetrics emits the number of resources without data for every metric of the probe.
+// A value of 0 means that every resource returned data, which distinguishes missing data from errors.
+func (r *Request) collectNullMetrics(ch chan<- prometheus.Metric) {
+	for _, metricName := range r.metricNames() {
+		ch <- prometheus.MustNewConstMetric(r.descs.nullMetrics, prometheus.GaugeValue, float64(r.nullMetrics[strings.ToLower(metricName)]), metricName)
+	}
+}
+
+// collectResourceCount emits the number of resources per subscription and location.
+// Subscriptions in scope without any resource are emitted with an empty location and a value of 0.
+func (r *Request) collectResourceCount(resources *Resources, ch chan<- prometheus.Metric) {
+	subscriptionsWithResources := make(map[string]struct{})
+
+	for location, subscriptions := range resources.Resources {
+		for subscriptionID, resourceIDs := range subscriptions {
+			subscriptionsWithResources[strings.ToLower(subscriptionID)] = struct{}{}
+
+			ch <- prometheus.MustNewConstMetric(r.descs.resourcesTotal, prometheus.GaugeValue, float64(len(resourceIDs)), subscriptionID, location)
+		}
+	}
+
+	subscriptions := r.subscriptions()
+
+	for _, subscriptionID := range subscriptions {
+		if _, ok := subscriptionsWithResources[strings.ToLower(subscriptionID)]; !ok {
+			ch <- prometheus.MustNewConstMetric(r.descs.resourcesTotal, prometheus.GaugeValue, 0, subscriptionID, "")
+		}
+	}
+}
+
+// collectResourceInfo emits an info metric with the metadata and the label_* columns of each resource, independent of
+// the availability of metrics. The instance label matches the instance label of the metrics of the resource to join them.
+func (r *Request) collectResourceInfo(resources *Resources, ch chan<- prometheus.Metric) error {
+	fqName := prometheus.BuildFQName(r.config.MetricPrefix, "resource", "info")
+	labels := make(map[string]string)
+
+	for location, subscriptions := range resources.Resources {
+		for subscriptionID, resourceIDs := range subscriptions {
+			for _, resourceID := range resourceIDs {
+				clear(labels)
+				maps.Copy(labels, r.config.ConstLabels)
+				maps.Copy(labels, resources.AdditionalLabels[resourceID])
+
+				labels["instance"] = r.instanceLabel(resourceID)
+				labels["subscription_id"] = subscriptionID
+				labels["location"] = location
+				labels["resource_id"] = resourceID
+				labels["resource_group"] = ""
+				labels["name"] = ""
+				labels["type"] = r.config.ResourceType
+
+				if parsedID, err := arm.ParseResourceID(resourceID); err == nil {
+					labels["resource_group"] = parsedID.ResourceGroupName
+					labels["name"] = parsedID.Name
+					labels["type"] = parsedID.ResourceType.String()
+				}
+
+				labelNames, labelValues := r.sortedLabels(labels)
+
+				err := r.emitSample(ch, prometheus.MustNewConstMetric(
+					r.metricDesc(fqName, "Metadata of the Azure resource. The value is always 1.", labelNames),
+					prometheus.GaugeValue, 1, labelValues...,
+				))
+				if err != nil {
+					return err
+				}
+			}
+		}
 	}
 
-	ch <- prometheus.MustNewConstMetric(r.probe.scrapeSuccessDesc, prometheus.GaugeValue, 1)
+	return nil
 }
 
 // getResources is a method of the Probe structure. It retrieves resource information from a cache or by querying resources if not found in the cache.
@@ -64,305 +247,1251 @@ func (r *Request) Collect(ch chan<- prometheus.Metric) {
 // If the resource information is not found in the cache, it calls the queryResources method to retrieve the resource information.
 // After retrieving the resource information, it is stored in the cache before being returned.
 // The function's behavior depends on the implementation of the queryResources method and the configuration of the cache.
-func (r *Request) getResources(ctx context.Context) (*Resources, error) {
+// The returned statistics are empty, if the resources are served from the cache.
+// With Config.NoCache, the cache is not read, but the queried resources are stored in the cache.
+func (r *Request) getResources(ctx context.Context) (*Resources, resourceGraphStats, error) {
+	if r.config.ResourceFile != "" {
+		resources, err := r.resourcesFromFile()
+
+		return resources, resourceGraphStats{}, err
+	}
+
+	if r.config.Scope == scopeSubscription {
+		resources, err := r.subscriptionResources()
+
+		return resources, resourceGraphStats{}, err
+	}
+
 	if r.config.QueryCacheCacheExpiration == 0 {
 		return r.queryResources(ctx)
 	}
 
-	subscriptions := r.probe.subscriptions
-	if r.config.Subscriptions != nil {
-		subscriptions = r.config.Subscriptions
+	cacheKey := r.cacheKey()
+
+	if r.config.NoCache {
+		_ = level.Info(r).Log("msg", "bypassing query cache", "cache_key", cacheKey)
+	} else if resources, age, ok := r.probe.queryCache.GetWithAge(cacheKey); ok {
+		return resources, resourceGraphStats{cacheAge: age.Seconds()}, nil
 	}
 
-	cacheKey := fmt.Sprintf("%s-%s-%s", r.config.Query, r.config.ResourceType, strings.Join(subscriptions, ","))
+	resources, stats, err := r.queryResources(ctx)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	// Partial results are not cached, otherwise a single truncated query would serve partial resources for the whole expiration.
+	if resources.PageLimitReached {
+		_ = level.Warn(r).Log("msg", "not caching resources, because the page limit has been reached", "cache_key", cacheKey)
+
+		return resources, stats, nil
+	}
+
+	r.probe.queryCache.Set(cacheKey, resources, r.queryCacheExpiration())
+
+	return resources, stats, nil
+}
+
+// shortCacheKeyLength is the length of the cache key emitted by Config.IncludeCacheKey.
+const shortCacheKeyLength = 12
+
+// cacheKey returns the query cache key of the probe.
+func (r *Request) cacheKey() string {
+	cacheKey := fmt.Sprintf("%s-%s-%s-%s", r.credentials.name, r.config.Query, r.config.ResourceType, strings.Join(r.subscriptions(), ","))
 	hash := sha256.Sum256([]byte(cacheKey))
-	cacheKey = hex.EncodeToString(hash[:])
 
-	resources, ok := r.probe.queryCache.Get(cacheKey)
-	if ok {
-		return resources, nil
+	return hex.EncodeToString(hash[:])
+}
+
+// subscriptions returns the subscriptions in scope of the probe.
+func (r *Request) subscriptions() []string {
+	if r.config.Subscriptions != nil {
+		return r.config.Subscriptions
 	}
 
-	resources, err := r.queryResources(ctx)
-	if err != nil {
-		return nil, err
+	return r.credentials.subscriptions
+}
+
+// queryCacheExpiration returns the query cache expiration with the configured jitter applied.
+// This spreads the expiration of probes with the same queryCacheExpiration.
+func (r *Request) queryCacheExpiration() time.Duration {
+	expiration := r.config.QueryCacheCacheExpiration
+	if r.probe.options.QueryCacheJitter == 0 {
+		return expiration
 	}
 
-	r.probe.queryCache.Set(cacheKey, resources, r.config.QueryCacheCacheExpiration)
+	jitter := (rand.Float64()*2 - 1) * r.probe.options.QueryCacheJitter / 100 //nolint:gosec // no security context
+	jitteredExpiration := time.Duration(float64(expiration) * (1 + jitter))
+
+	if jitteredExpiration <= 0 {
+		return expiration
+	}
 
-	return resources, nil
+	return jitteredExpiration
 }
 
 // queryResources queries the Azure Resource Graph API for resources.
-//
-//nolint:gocognit,cyclop
-func (r *Request) queryResources(ctx context.Context) (*Resources, error) {
-	var (
-		err       error
-		skipToken string
-		response  armresourcegraph.ClientResourcesResponse
-	)
+// The subscriptions are split into chunks, each chunk is queried with its own paging.
+func (r *Request) queryResources(ctx context.Context) (*Resources, resourceGraphStats, error) {
+	ctx, span := r.probe.tracer.Start(ctx, "queryResources", trace.WithAttributes(
+		attribute.String("resource_type", r.config.ResourceType),
+	))
+	defer span.End()
+
+	var stats resourceGraphStats
 
 	resources := Resources{
 		Resources:        make(map[string]map[string][]string),
 		AdditionalLabels: make(map[string]map[string]string),
 	}
 
-	subscriptions := r.probe.subscriptions
-	if r.config.Subscriptions != nil {
-		subscriptions = r.config.Subscriptions
+	subscriptions := r.subscriptions()
+	query := resourceGraphQuery{
+		pages:               0,
+		rows:                0,
+		firstQuotaRemaining: -1,
+		lastQuotaRemaining:  -1,
+	}
+
+	for _, subscriptionChunk := range chunkSubscriptions(subscriptions, r.probe.options.SubscriptionsPerQuery) {
+		if err := r.queryResourcesChunk(ctx, subscriptionChunk, &query, &resources); err != nil {
+			return nil, stats, spanError(span, err)
+		}
+
+		if resources.PageLimitReached {
+			break
+		}
+	}
+
+	// With noContentOnEmpty, a probe without resources is answered by 204 instead of failing.
+	if len(resources.Resources) == 0 && !r.config.NoContentOnEmpty {
+		return nil, stats, spanError(span, errors.New("error querying resource graph: no rows returned"))
+	}
+
+	stats.pages = query.pages
+	stats.rows = query.rows
+
+	span.SetAttributes(attribute.Int("pages", stats.pages), attribute.Int("rows", stats.rows))
+
+	// The first request already consumed one unit of the quota before the first value has been observed.
+	// A negative delta indicates a quota reset during the probe.
+	if query.firstQuotaRemaining != -1 {
+		stats.quotaConsumed = math.Max(float64(query.firstQuotaRemaining+1-query.lastQuotaRemaining), 0)
+	}
+
+	return &resources, stats, nil
+}
+
+// resourceGraphQuery tracks the state of a Resource Graph query across multiple chunks of subscriptions.
+type resourceGraphQuery struct {
+	pages int
+	rows  int
+
+	firstQuotaRemaining int64
+	lastQuotaRemaining  int64
+}
+
+// chunkSubscriptions splits the subscriptions into chunks of the given size.
+// An empty list of subscriptions results in a single empty chunk.
+func chunkSubscriptions(subscriptions []string, size int) [][]string {
+	chunks := make([][]string, 0, len(subscriptions)/size+1)
+
+	for len(subscriptions) > size {
+		chunks = append(chunks, subscriptions[:size])
+		subscriptions = subscriptions[size:]
+	}
+
+	return append(chunks, subscriptions)
+}
+
+// queryResourcesChunk queries the resources of a chunk of subscriptions and adds them to resources.
+//
+//nolint:gocognit,cyclop
+func (r *Request) queryResourcesChunk(ctx context.Context, subscriptions []string, state *resourceGraphQuery, resources *Resources) error {
+	var (
+		err                error
+		skipToken          string
+		response           armresourcegraph.ClientResourcesResponse
+		rawResponse        *http.Response
+		allowPartialScopes *bool
+	)
+
+	if r.probe.options.AllowPartialScopes {
+		allowPartialScopes = to.Ptr(true)
+
+		if len(subscriptions) > resourceGraphMaxSubscriptions {
+			_ = level.Warn(r).Log("msg", "Number of subscriptions exceeds the Resource Graph limit, some subscriptions may be skipped",
+				"subscriptions", len(subscriptions), "limit", resourceGraphMaxSubscriptions)
+
+			resources.PartialScopes = true
+		}
 	}
 
+	query := fmt.Sprintf("%s\n| where type == '%s' \n| project-keep id, subscriptionId, location, label_*",
+		r.config.Query, strings.ToLower(r.config.ResourceType),
+	)
+
 	for {
-		query := fmt.Sprintf("%s\n| where type == '%s' \n| project-keep id, subscriptionId, location, label_*",
-			r.config.Query, strings.ToLower(r.config.ResourceType),
-		)
+		// Stop paging as soon as the scrape has been canceled or timed out.
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("error querying resource graph: paging aborted: %w", err)
+		}
 
-		response, err = r.probe.resourceGraphClient.Resources(ctx, armresourcegraph.QueryRequest{
+		state.pages++
+
+		response, err = r.credentials.resourceGraphClient.Resources(runtime.WithCaptureResponse(ctx, &rawResponse), armresourcegraph.QueryRequest{
 			Options: &armresourcegraph.QueryRequestOptions{
-				ResultFormat: to.Ptr(armresourcegraph.ResultFormatObjectArray),
-				SkipToken:    to.Ptr(skipToken),
+				ResultFormat:       to.Ptr(r.config.ResultFormat),
+				SkipToken:          to.Ptr(skipToken),
+				AllowPartialScopes: allowPartialScopes,
 			},
 			Query:         &query,
 			Subscriptions: to.SliceOfPtrs(subscriptions...),
 		}, nil)
 		if err != nil {
-			return nil, fmt.Errorf("error querying resource graph '%q': %w", query, err)
+			return fmt.Errorf("error querying resource graph '%q': %w", query, err)
+		}
+
+		if quotaRemaining, err := strconv.ParseInt(rawResponse.Header.Get("x-ms-user-quota-remaining"), 10, 64); err == nil {
+			if state.firstQuotaRemaining == -1 {
+				state.firstQuotaRemaining = quotaRemaining
+			}
+
+			state.lastQuotaRemaining = quotaRemaining
 		}
 
 		if response.ResultTruncated == nil || response.Data == nil || response.Count == nil {
-			return nil, errors.New("error querying resource graph: unexpected response")
+			return errors.New("error querying resource graph: unexpected response")
 		}
 
 		if *response.ResultTruncated == armresourcegraph.ResultTruncatedTrue {
 			_ = level.Warn(r).Log("msg", "Result truncated", "query", query)
+
+			r.probe.resourceGraphTruncated.WithLabelValues(strings.ToLower(r.config.ResourceType)).Inc()
 		}
 
+		// Other chunks of subscriptions may still contain resources.
 		if *response.Count == 0 {
-			return nil, errors.New("error querying resource graph: no rows returned")
+			return nil
 		}
 
-		rows, ok := response.Data.([]any)
-		if !ok {
-			return nil, fmt.Errorf("error querying resource graph: unexpected type: %+v", response.Data)
-		}
+		var rows []resourceGraphRow
 
-		if len(rows) == 0 {
-			return nil, errors.New("error querying resource graph: no rows returned")
+		if r.config.ResultFormat == armresourcegraph.ResultFormatTable {
+			rows, err = parseResourceGraphTable(response.Data)
+		} else {
+			rows, err = parseResourceGraphObjectArray(response.Data)
 		}
 
-		row, ok := rows[0].(map[string]any)
-		if !ok {
-			return nil, fmt.Errorf("error querying resource graph: unexpected type: %+v", rows[0])
+		if err != nil {
+			return err
 		}
 
-		for _, field := range []string{"subscriptionId", "location", "id"} {
-			if _, ok = row[field]; !ok {
-				return nil, fmt.Errorf("error querying resource graph: missing field %s. Available fields: %v", field, maps.Keys(row))
-			}
+		if len(rows) == 0 {
+			return nil
 		}
 
-		var (
-			resultRow      map[string]any
-			subscriptionID string
-			location       string
-			labelValue     string
-			resourceID     string
-		)
+		state.rows += len(rows)
 
 		for _, row := range rows {
-			resultRow, ok = row.(map[string]any)
-			if !ok {
-				return nil, fmt.Errorf("error querying resource graph: unexpected row type: %+v", row)
-			}
-
-			subscriptionID, ok = resultRow["subscriptionId"].(string)
-			if !ok {
-				return nil, fmt.Errorf("error querying resource graph: unexpected subscriptionId type: %+v", rows[0])
+			if _, ok := resources.Resources[row.location]; !ok {
+				resources.Resources[row.location] = make(map[string][]string, len(subscriptions))
 			}
 
-			location, ok = resultRow["location"].(string)
-			if !ok {
-				return nil, fmt.Errorf("error querying resource graph: unexpected location type: %+v", rows[0])
+			if _, ok := resources.Resources[row.location][row.subscriptionID]; !ok {
+				resources.Resources[row.location][row.subscriptionID] = make([]string, 0, len(rows))
 			}
 
-			resourceID, ok = resultRow["id"].(string)
-			if !ok {
-				return nil, fmt.Errorf("error querying resource graph: unexpected id type: %+v", rows[0])
-			}
+			if row.labels != nil {
+				for key, value := range row.labels {
+					row.labels[key] = r.probe.truncateLabelValue(value)
+				}
 
-			if _, ok = resources.Resources[location]; !ok {
-				resources.Resources[location] = make(map[string][]string, len(subscriptions))
+				resources.AdditionalLabels[row.resourceID] = row.labels
 			}
 
-			if _, ok = resources.Resources[location][subscriptionID]; !ok {
-				resources.Resources[location][subscriptionID] = make([]string, 0, len(rows))
-			}
+			resources.Resources[row.location][row.subscriptionID] = append(
+				resources.Resources[row.location][row.subscriptionID],
+				row.resourceID,
+			)
+		}
 
-			if len(resultRow)-3 > 0 {
-				resources.AdditionalLabels[resourceID] = make(map[string]string, len(resultRow)-3)
+		if response.SkipToken == nil || *response.SkipToken == "" {
+			return nil
+		}
 
-				for key, value := range resultRow {
-					if strings.HasPrefix(key, "label_") {
-						labelValue, ok = value.(string)
-						if !ok {
-							return nil, fmt.Errorf("error querying resource graph: unexpected id type: %+v", rows[0])
-						}
+		if r.probe.options.MaxPages > 0 && state.pages >= r.probe.options.MaxPages {
+			_ = level.Warn(r).Log("msg", "Resource Graph page limit reached, returning partial results", "max_pages", r.probe.options.MaxPages)
 
-						resources.AdditionalLabels[resourceID][key[6:]] = labelValue
-					}
-				}
-			}
+			resources.PageLimitReached = true
 
-			resources.Resources[location][subscriptionID] = append(
-				resources.Resources[location][subscriptionID],
-				resourceID,
-			)
+			return nil
 		}
 
-		if response.SkipToken == nil || *response.SkipToken == "" {
-			break
+		skipToken = *response.SkipToken
+	}
+}
+
+// resourceGraphRow is a single resource returned by Resource Graph.
+type resourceGraphRow struct {
+	subscriptionID string
+	location       string
+	resourceID     string
+	// labels contains the values of the label_* columns without prefix. nil, if the query has no additional columns.
+	labels map[string]string
+}
+
+// resourceGraphRequiredColumns contains the columns kept by the project-keep statement appended to every query.
+var resourceGraphRequiredColumns = []string{"id", "subscriptionId", "location"}
+
+// checkResourceGraphColumns returns an error, if the query has removed or renamed a required column.
+// The appended project-keep statement silently ignores columns which don't exist anymore.
+func checkResourceGraphColumns(columns []string) error {
+	var missing []string
+
+	for _, column := range resourceGraphRequiredColumns {
+		if !slices.Contains(columns, column) {
+			missing = append(missing, column)
 		}
+	}
 
-		skipToken = *response.SkipToken
+	if len(missing) == 0 {
+		return nil
 	}
 
-	return &resources, nil
+	columns = slices.Clone(columns)
+	slices.Sort(columns)
+
+	switch {
+	case len(missing) == len(resourceGraphRequiredColumns):
+		return fmt.Errorf("error querying resource graph: the query returned none of the required columns %s. "+
+			"The query must not project away or rename them. Available columns: %v",
+			strings.Join(resourceGraphRequiredColumns, ", "), columns)
+	default:
+		return fmt.Errorf("error querying resource graph: missing column %s. "+
+			"The query must not project away or rename the columns %s. Available columns: %v",
+			strings.Join(missing, ", "), strings.Join(resourceGraphRequiredColumns, ", "), columns)
+	}
 }
 
-// fetchMetrics fetches metrics for the resources.
-//
-//nolint:gocognit,cyclop
-func (r *Request) fetchMetrics(ctx context.Context, resources *Resources, ch chan<- prometheus.Metric) error {
-	var (
-		client *azmetrics.Client
-		err    error
-		resp   azmetrics.QueryResourcesResponse
-	)
+// parseResourceGraphObjectArray parses the rows of a Resource Graph response in the objectArray format.
+func parseResourceGraphObjectArray(data any) ([]resourceGraphRow, error) {
+	rows, ok := data.([]any)
+	if !ok {
+		return nil, fmt.Errorf("error querying resource graph: unexpected type: %+v", data)
+	}
 
-	if resources == nil {
-		return errors.New("resources is nil")
+	if len(rows) == 0 {
+		return nil, nil
 	}
 
-	for location, subscriptions := range resources.Resources {
-		client, err = r.probe.getMetricsClient(location)
-		if err != nil {
-			return fmt.Errorf("error get metrics client: %w", err)
+	row, ok := rows[0].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("error querying resource graph: unexpected type: %+v", rows[0])
+	}
+
+	if err := checkResourceGraphColumns(maps.Keys(row)); err != nil {
+		return nil, err
+	}
+
+	result := make([]resourceGraphRow, len(rows))
+
+	for i, row := range rows {
+		resultRow, ok := row.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("error querying resource graph: unexpected row type: %+v", row)
 		}
 
-		for subscriptionID, resourceIDs := range subscriptions {
-			for {
-				maxResourceIDs := 50
-				if len(resourceIDs) < maxResourceIDs {
-					maxResourceIDs = len(resourceIDs)
-				}
+		if result[i].subscriptionID, ok = resultRow["subscriptionId"].(string); !ok {
+			return nil, fmt.Errorf("error querying resource graph: unexpected subscriptionId type: %+v", rows[0])
+		}
 
-				requestResourceIDs := resourceIDs[:maxResourceIDs]
-				resourceIDs = resourceIDs[maxResourceIDs:]
+		if result[i].location, ok = resultRow["location"].(string); !ok {
+			return nil, fmt.Errorf("error querying resource graph: unexpected location type: %+v", rows[0])
+		}
 
-				metricNamespace := r.config.ResourceType
-				if r.config.MetricNamespace != "" {
-					metricNamespace = r.config.MetricNamespace
-				}
+		if result[i].resourceID, ok = resultRow["id"].(string); !ok {
+			return nil, fmt.Errorf("error querying resource graph: unexpected id type: %+v", rows[0])
+		}
 
-				resp, err = client.QueryResources(
-					ctx,
-					subscriptionID,
-					metricNamespace,
-					r.config.MetricNames,
-					azmetrics.ResourceIDList{ResourceIDs: requestResourceIDs},
-					&r.config.QueryResourcesOptions,
-				)
-				if err != nil {
-					var azErr *azcore.ResponseError
-					if errors.As(err, &azErr) {
-						return fmt.Errorf("error querying metrics: %w", azErr)
-					}
+		if len(resultRow)-3 > 0 {
+			result[i].labels = make(map[string]string, len(resultRow)-3)
 
-					return fmt.Errorf("error querying metrics: %w", err)
+			for key, value := range resultRow {
+				if strings.HasPrefix(key, "label_") {
+					if result[i].labels[key[6:]], ok = value.(string); !ok {
+						return nil, fmt.Errorf("error querying resource graph: unexpected %s type: %+v", key, rows[0])
+					}
 				}
+			}
+		}
+	}
 
-				var (
-					latestTimestamp time.Time
-					latestMetric    map[string]*float64
-				)
+	return result, nil
+}
 
-				for _, metric := range resp.Values {
-					prometheusMetricNamespace := "azure_monitor_" + strings.ReplaceAll(strings.ReplaceAll(strings.ToLower(*metric.Namespace), ".", "_"), "/", "_")
+// parseResourceGraphTable parses the rows of a Resource Graph response in the table format.
+// The table format transfers the column names only once, which reduces the response size of large results.
+func parseResourceGraphTable(data any) ([]resourceGraphRow, error) {
+	table, ok := data.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("error querying resource graph: unexpected type: %+v", data)
+	}
 
-					prometheusLabels := map[string]string{
-						"subscription_id": subscriptionID,
-						"region":          *metric.ResourceRegion,
-						"instance":        *metric.ResourceID,
-					}
+	columns, ok := table["columns"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("error querying resource graph: unexpected columns type: %+v", table["columns"])
+	}
 
-					for labelKey, labelValue := range resources.AdditionalLabels[*metric.ResourceID] {
-						prometheusLabels[labelKey] = labelValue
-					}
+	rows, ok := table["rows"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("error querying resource graph: unexpected rows type: %+v", table["rows"])
+	}
 
-					latestTimestamp = time.Time{}
-					latestMetric = map[string]*float64{
-						"total":   nil,
-						"average": nil,
-						"count":   nil,
-						"minimum": nil,
-						"maximum": nil,
-					}
+	columnNames := make([]string, len(columns))
+	columnIndex := make(map[string]int, len(columns))
 
-					for _, metricValue := range metric.Values {
-						for _, metricTimeSeries := range metricValue.TimeSeries {
-							if len(metricTimeSeries.Data) == 0 {
-								continue
-							}
-
-							for _, label := range metricTimeSeries.MetadataValues {
-								prometheusLabels[*label.Name.Value] = *label.Value
-							}
-
-							for _, data := range metricTimeSeries.Data {
-								if data.TimeStamp.After(latestTimestamp) {
-									latestTimestamp = *data.TimeStamp
-									latestMetric["total"] = data.Total
-									latestMetric["average"] = data.Average
-									latestMetric["count"] = data.Count
-									latestMetric["minimum"] = data.Minimum
-									latestMetric["maximum"] = data.Maximum
-								}
-							}
-						}
+	for i, column := range columns {
+		columnMap, ok := column.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("error querying resource graph: unexpected column type: %+v", column)
+		}
 
-						for metricType, value := range latestMetric {
-							if value == nil {
-								continue
-							}
-
-							ch <- prometheus.MustNewConstMetric(
-								prometheus.NewDesc(
-									prometheus.BuildFQName(
-										prometheusMetricNamespace,
-										strings.ReplaceAll(strings.ToLower(*metricValue.Name.Value), " ", ""),
-										fmt.Sprintf("%s_%s",
-											metricType,
-											strings.ToLower(string(*metricValue.Unit)),
-										),
-									),
-									fmt.Sprintf("%s: %s", *metricValue.Name.LocalizedValue, *metricValue.DisplayDescription),
-									nil,
-									prometheusLabels,
-								),
-								prometheus.GaugeValue,
-								*value,
-							)
-						}
-					}
-				}
+		if columnNames[i], ok = columnMap["name"].(string); !ok {
+			return nil, fmt.Errorf("error querying resource graph: unexpected column name type: %+v", column)
+		}
 
-				if len(resourceIDs) == 0 {
-					break
+		columnIndex[columnNames[i]] = i
+	}
+
+	if err := checkResourceGraphColumns(columnNames); err != nil {
+		return nil, err
+	}
+
+	result := make([]resourceGraphRow, len(rows))
+
+	for i, row := range rows {
+		values, ok := row.([]any)
+		if !ok || len(values) != len(columnNames) {
+			return nil, fmt.Errorf("error querying resource graph: unexpected row type: %+v", row)
+		}
+
+		if result[i].subscriptionID, ok = values[columnIndex["subscriptionId"]].(string); !ok {
+			return nil, fmt.Errorf("error querying resource graph: unexpected subscriptionId type: %+v", row)
+		}
+
+		if result[i].location, ok = values[columnIndex["location"]].(string); !ok {
+			return nil, fmt.Errorf("error querying resource graph: unexpected location type: %+v", row)
+		}
+
+		if result[i].resourceID, ok = values[columnIndex["id"]].(string); !ok {
+			return nil, fmt.Errorf("error querying resource graph: unexpected id type: %+v", row)
+		}
+
+		if len(columnNames)-3 > 0 {
+			result[i].labels = make(map[string]string, len(columnNames)-3)
+
+			for j, columnName := range columnNames {
+				if strings.HasPrefix(columnName, "label_") {
+					if result[i].labels[columnName[6:]], ok = values[j].(string); !ok {
+						return nil, fmt.Errorf("error querying resource graph: unexpected %s type: %+v", columnName, row)
+					}
 				}
 			}
 		}
 	}
 
-	return nil
+	return result, nil
+}
+
+// fetchMetrics fetches metrics for the resources.
+func (r *Request) fetchMetrics(ctx context.Context, resources *Resources, ch chan<- prometheus.Metric) error {
+	if resources == nil {
+		return errors.New("resources is nil")
+	}
+
+	if len(resources.Resources) == 0 {
+		return nil
+	}
+
+	if r.config.Scope == scopeSubscription {
+		return r.fetchSubscriptionMetrics(ctx, resources, ch)
+	}
+
+	if r.config.AllMetricNames() {
+		var err error
+
+		r.expandedMetricNames, err = r.expandMetricNames(ctx, resources.anyResourceID())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Shared or delegated resources may appear under multiple subscriptions.
+	// Subscriptions are processed in a stable order to always scrape a duplicate resource under the same subscription.
+	var seenResourceIDs map[string]string
+	if r.probe.options.DeduplicateResources {
+		seenResourceIDs = make(map[string]string)
+	}
+
+	for location, subscriptions := range resources.Resources {
+		metricsRegion := location
+		if r.config.Region != "" {
+			metricsRegion = r.config.Region
+		}
+
+		subscriptionIDs := maps.Keys(subscriptions)
+		slices.Sort(subscriptionIDs)
+
+		for _, subscriptionID := range subscriptionIDs {
+			resourceIDs := subscriptions[subscriptionID]
+
+			if r.probe.options.DeduplicateResources {
+				resourceIDs = r.deduplicateResourceIDs(seenResourceIDs, subscriptionID, resourceIDs)
+				if len(resourceIDs) == 0 {
+					continue
+				}
+			}
+
+			client, err := r.probe.getMetricsClient(r.credentials, subscriptionID, metricsRegion)
+			if err != nil {
+				return fmt.Errorf("error get metrics client: %w", err)
+			}
+
+			if err = r.fetchMetricsPerSubscription(ctx, client, subscriptionID, resourceIDs, resources, ch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deduplicateResourceIDs returns the resource IDs, which have not been seen under another subscription before.
+func (r *Request) deduplicateResourceIDs(seenResourceIDs map[string]string, subscriptionID string, resourceIDs []string) []string {
+	uniqueResourceIDs := make([]string, 0, len(resourceIDs))
+
+	for _, resourceID := range resourceIDs {
+		key := strings.ToLower(resourceID)
+
+		if seenSubscriptionID, ok := seenResourceIDs[key]; ok {
+			_ = level.Debug(r).Log("msg", "skipping duplicate resource", "resource_id", resourceID,
+				"subscription_id", subscriptionID, "seen_subscription_id", seenSubscriptionID)
+
+			continue
+		}
+
+		seenResourceIDs[key] = subscriptionID
+		uniqueResourceIDs = append(uniqueResourceIDs, resourceID)
+	}
+
+	if duplicates := len(resourceIDs) - len(uniqueResourceIDs); duplicates > 0 {
+		_ = level.Warn(r).Log("msg", "duplicate resources detected", "subscription_id", subscriptionID, "duplicates", duplicates)
+	}
+
+	return uniqueResourceIDs
+}
+
+// fetchMetricsPerSubscription fetches the metrics of resources of a single subscription in batches.
+// The resource IDs and metric names are split into chunks to stay within the limits of the Azure Monitor API.
+func (r *Request) fetchMetricsPerSubscription(
+	ctx context.Context, client *azmetrics.Client, subscriptionID string, resourceIDs []string, resources *Resources, ch chan<- prometheus.Metric,
+) error {
+	ctx, span := r.probe.tracer.Start(ctx, "fetchMetricsPerSubscription", trace.WithAttributes(
+		attribute.String("subscription_id", subscriptionID),
+		attribute.Int("resources", len(resourceIDs)),
+	))
+	defer span.End()
+
+	metricQueries := r.metricQueries()
+
+	for {
+		maxResourceIDs := 50
+		if len(resourceIDs) < maxResourceIDs {
+			maxResourceIDs = len(resourceIDs)
+		}
+
+		requestResourceIDs := resourceIDs[:maxResourceIDs]
+		resourceIDs = resourceIDs[maxResourceIDs:]
+
+		metricNamespace := r.config.ResourceType
+		if r.config.MetricNamespace != "" {
+			metricNamespace = r.config.MetricNamespace
+		}
+
+		returnedResourceIDs := make(map[string]struct{}, len(requestResourceIDs))
+
+		for _, metricQuery := range metricQueries {
+			values, err := r.queryMetricsCached(ctx, client, subscriptionID, metricNamespace, requestResourceIDs, metricQuery)
+			if err != nil {
+				var azErr *azcore.ResponseError
+				if errors.As(err, &azErr) {
+					return spanError(span, fmt.Errorf("error querying metrics: %w", azErr))
+				}
+
+				return spanError(span, fmt.Errorf("error querying metrics: %w", err))
+			}
+
+			for _, metric := range values {
+				if metric.ResourceID != nil {
+					returnedResourceIDs[strings.ToLower(*metric.ResourceID)] = struct{}{}
+				}
+			}
+
+			if r.config.MaxAge > 0 {
+				values = r.suppressStaleMetrics(values, time.Now().Add(-r.config.MaxAge))
+			}
+
+			if err = r.collectMetrics(subscriptionID, values, resources, ch); err != nil {
+				return spanError(span, err)
+			}
+		}
+
+		r.countResourcesWithoutMetrics(subscriptionID, requestResourceIDs, returnedResourceIDs)
+
+		if len(resourceIDs) == 0 {
+			break
+		}
+	}
+
+	return nil
+}
+
+// countResourcesWithoutMetrics counts the requested resources, for which Azure Monitor returned no data in any metric query.
+func (r *Request) countResourcesWithoutMetrics(subscriptionID string, requestResourceIDs []string, returnedResourceIDs map[string]struct{}) {
+	for _, resourceID := range requestResourceIDs {
+		if _, ok := returnedResourceIDs[strings.ToLower(resourceID)]; ok {
+			continue
+		}
+
+		r.resourcesWithoutMetrics++
+
+		_ = level.Debug(r).Log("msg", "no metrics returned for resource", "resource_id", resourceID, "subscription_id", subscriptionID)
+	}
+}
+
+// suppressStaleMetrics removes the metrics, whose latest data point is older than notBefore, e.g. of resources that stopped reporting.
+// Metrics without any data are kept for the handling of null metrics. The values are copied, because they may be part of the metric cache.
+func (r *Request) suppressStaleMetrics(values []azmetrics.MetricData, notBefore time.Time) []azmetrics.MetricData {
+	freshValues := make([]azmetrics.MetricData, 0, len(values))
+
+	for _, metric := range values {
+		var staleMetricNames []string
+
+		freshMetrics := make([]azmetrics.Metric, 0, len(metric.Values))
+
+		for _, metricValue := range metric.Values {
+			if latestTimestamp := latestDataTimestamp(metricValue); !latestTimestamp.IsZero() && latestTimestamp.Before(notBefore) {
+				if metricValue.Name != nil && metricValue.Name.Value != nil {
+					staleMetricNames = append(staleMetricNames, *metricValue.Name.Value)
+				}
+
+				continue
+			}
+
+			freshMetrics = append(freshMetrics, metricValue)
+		}
+
+		if len(freshMetrics) != len(metric.Values) && metric.ResourceID != nil {
+			_ = level.Debug(r).Log("msg", "suppressing stale metrics of resource", "resource_id", *metric.ResourceID,
+				"metrics", strings.Join(staleMetricNames, ","), "max_age", r.config.MaxAge)
+		}
+
+		metric.Values = freshMetrics
+		freshValues = append(freshValues, metric)
+	}
+
+	return freshValues
+}
+
+// latestDataTimestamp returns the timestamp of the latest data point with a value across all time series of the metric.
+func latestDataTimestamp(metricValue azmetrics.Metric) time.Time {
+	var latestTimestamp time.Time
+
+	for _, timeSeries := range metricValue.TimeSeries {
+		for _, data := range timeSeries.Data {
+			if data.TimeStamp != nil && rawValue(data) != nil && data.TimeStamp.After(latestTimestamp) {
+				latestTimestamp = *data.TimeStamp
+			}
+		}
+	}
+
+	return latestTimestamp
+}
+
+// metricQuery contains the metric names and options of a single Azure Monitor request.
+type metricQuery struct {
+	metricNames []string
+	options     *azmetrics.QueryResourcesOptions
+}
+
+// metricQueries groups the metric names by their aggregation and splits each group into chunks
+// to stay within the limit of metric names per request.
+// Metrics without an aggregation override use the global aggregation.
+func (r *Request) metricQueries() []metricQuery {
+	var globalMetricNames []string
+
+	overrideMetricNames := make(map[string][]string)
+
+	for _, metricName := range r.metricNames() {
+		aggregation, ok := r.config.MetricAggregations[strings.ToLower(metricName)]
+		if !ok {
+			globalMetricNames = append(globalMetricNames, metricName)
+
+			continue
+		}
+
+		overrideMetricNames[aggregation] = append(overrideMetricNames[aggregation], metricName)
+	}
+
+	metricQueries := make([]metricQuery, 0, len(overrideMetricNames)+1)
+
+	if len(globalMetricNames) != 0 {
+		metricQueries = r.appendMetricQueries(metricQueries, globalMetricNames, &r.config.QueryResourcesOptions)
+	}
+
+	aggregations := maps.Keys(overrideMetricNames)
+	slices.Sort(aggregations)
+
+	for _, aggregation := range aggregations {
+		options := r.config.QueryResourcesOptions
+		options.Aggregation = to.Ptr(aggregation)
+
+		metricQueries = r.appendMetricQueries(metricQueries, overrideMetricNames[aggregation], &options)
+	}
+
+	return metricQueries
+}
+
+// appendMetricQueries splits the metric names into chunks of Options.MetricNamesPerRequest and appends them as queries.
+func (r *Request) appendMetricQueries(metricQueries []metricQuery, metricNames []string, options *azmetrics.QueryResourcesOptions) []metricQuery {
+	for len(metricNames) > r.probe.options.MetricNamesPerRequest {
+		metricQueries = append(metricQueries, metricQuery{metricNames: metricNames[:r.probe.options.MetricNamesPerRequest], options: options})
+		metricNames = metricNames[r.probe.options.MetricNamesPerRequest:]
+	}
+
+	return append(metricQueries, metricQuery{metricNames: metricNames, options: options})
+}
+
+// metricNames returns the metric names of the probe without duplicates.
+// Azure Monitor treats metric names case-insensitive, duplicates would result in duplicate series.
+func (r *Request) metricNames() []string {
+	configMetricNames := r.config.MetricNames
+	if r.expandedMetricNames != nil {
+		configMetricNames = r.expandedMetricNames
+	}
+
+	metricNames := make([]string, 0, len(configMetricNames))
+	seen := make(map[string]struct{}, len(configMetricNames))
+
+	for _, metricName := range configMetricNames {
+		if _, ok := seen[strings.ToLower(metricName)]; ok {
+			continue
+		}
+
+		seen[strings.ToLower(metricName)] = struct{}{}
+		metricNames = append(metricNames, metricName)
+	}
+
+	return metricNames
+}
+
+// collectMetrics converts the metrics returned by Azure Monitor into Prometheus metrics.
+//
+//nolint:gocognit,cyclop
+func (r *Request) collectMetrics(subscriptionID string, values []azmetrics.MetricData, resources *Resources, ch chan<- prometheus.Metric) error {
+	var (
+		// latestMetric, seriesLabels and dimensionNames are reused for all time series to reduce allocations of large probes.
+		latestMetric   = make(map[string]*float64, len(aggregationTypes))
+		seriesLabels   = make(map[string]string)
+		dimensionNames []string
+
+		// Usually, all resources share the same namespace. The converted namespace is reused to reduce allocations.
+		metricNamespace, prometheusMetricNamespace string
+	)
+
+	for _, metric := range values {
+		if metric.ResourceID == nil {
+			_ = level.Warn(r).Log("msg", "skipping metrics without resource ID", "subscription_id", subscriptionID)
+
+			continue
+		}
+
+		if r.config.IncludeTimeWindow {
+			r.collectTimeWindow(metric, ch)
+		}
+
+		resourceMetricNamespace := r.config.MetricNamespace
+		if metric.Namespace != nil && !r.config.UseConfiguredNamespace {
+			resourceMetricNamespace = *metric.Namespace
+		}
+
+		if resourceMetricNamespace != metricNamespace || prometheusMetricNamespace == "" {
+			metricNamespace = resourceMetricNamespace
+			prometheusMetricNamespace = r.config.MetricPrefix + "_" + formatName(metricNamespace, r.config.NameCase)
+		}
+
+		region := ""
+		if metric.ResourceRegion != nil {
+			region = *metric.ResourceRegion
+		}
+
+		prometheusLabels := map[string]string{
+			"subscription_id":    subscriptionID,
+			r.config.RegionLabel: region,
+			"instance":           r.instanceLabel(*metric.ResourceID),
+		}
+
+		for labelKey, labelValue := range r.config.ConstLabels {
+			prometheusLabels[labelKey] = labelValue
+		}
+
+		for labelKey, labelValue := range resources.AdditionalLabels[*metric.ResourceID] {
+			prometheusLabels[labelKey] = labelValue
+		}
+
+		// Azure may adjust the time grain, e.g. if the requested interval is not supported by the metric.
+		if r.config.IncludeInterval && metric.Interval != nil {
+			prometheusLabels["interval"] = formatInterval(*metric.Interval)
+		}
+
+		// resourceLabels keeps the labels of the resource to detect collisions with dimensions.
+		resourceLabels := maps.Clone(prometheusLabels)
+
+		for _, metricValue := range metric.Values {
+			if metricValue.Name == nil || metricValue.Name.Value == nil {
+				_ = level.Warn(r).Log("msg", "skipping metric without name", "resource_id", *metric.ResourceID)
+
+				continue
+			}
+
+			unit := azmetrics.MetricUnitUnspecified
+			if metricValue.Unit != nil {
+				unit = *metricValue.Unit
+			}
+
+			// The label maps are shared by all metrics of the resource, a metric without ID must not inherit the previous ID.
+			if r.config.IncludeMetricID && metricValue.ID != nil {
+				prometheusLabels["metric_id"] = *metricValue.ID
+				resourceLabels["metric_id"] = *metricValue.ID
+			} else if r.config.IncludeMetricID {
+				delete(prometheusLabels, "metric_id")
+				delete(resourceLabels, "metric_id")
+			}
+
+			if r.config.SkipNullMetrics && !hasMetricData(metricValue) {
+				_ = level.Debug(r).Log("msg", "skipping metric without data", "resource_id", *metric.ResourceID, "metric", *metricValue.Name.Value)
+
+				if r.nullMetrics == nil {
+					r.nullMetrics = make(map[string]int)
+				}
+
+				r.nullMetrics[strings.ToLower(*metricValue.Name.Value)]++
+
+				continue
+			}
+
+			dimensionNames = appendDimensionNames(dimensionNames[:0], metricValue)
+
+			for _, metricTimeSeries := range metricValue.TimeSeries {
+				if len(metricTimeSeries.Data) == 0 {
+					continue
+				}
+
+				// Each time series of a metric split by dimensions has its own dimension values.
+				// The labels are rebuilt from the labels of the resource for each time series.
+				clear(seriesLabels)
+				maps.Copy(seriesLabels, prometheusLabels)
+
+				// A single time series carries no information in its dimension labels,
+				// so it can be treated like the aggregated series.
+				if !r.config.DropSingleValueDimensions || len(metricValue.TimeSeries) != 1 {
+					// Dimensions missing in this time series get an empty value to keep the label names of the metric consistent.
+					for _, name := range dimensionNames {
+						if err := r.setDimensionLabel(seriesLabels, resourceLabels, name, ""); err != nil {
+							return err
+						}
+					}
+
+					for _, label := range metricTimeSeries.MetadataValues {
+						if label.Name == nil || label.Name.Value == nil || label.Value == nil {
+							continue
+						}
+
+						if err := r.setDimensionLabel(seriesLabels, resourceLabels, *label.Name.Value, r.probe.truncateLabelValue(*label.Value)); err != nil {
+							return err
+						}
+					}
+				}
+
+				if r.config.RawTimeSeries {
+					if err := r.collectRawTimeSeries(prometheusMetricNamespace, metricValue, unit, seriesLabels, metricTimeSeries, ch); err != nil {
+						return err
+					}
+
+					continue
+				}
+
+				if err := r.collectLatestValue(prometheusMetricNamespace, metricValue, unit, seriesLabels, metricTimeSeries, latestMetric, ch); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// appendDimensionNames appends the names of the dimensions of all time series of the metric. Azure may omit a dimension
+// in a time series, e.g. if the dimension has no value for this time series.
+func appendDimensionNames(dimensionNames []string, metricValue azmetrics.Metric) []string {
+	// Without multiple time series, there is no other time series to be consistent with.
+	if len(metricValue.TimeSeries) < 2 {
+		return dimensionNames
+	}
+
+	for _, timeSeries := range metricValue.TimeSeries {
+		for _, label := range timeSeries.MetadataValues {
+			if label.Name == nil || label.Name.Value == nil || slices.Contains(dimensionNames, *label.Name.Value) {
+				continue
+			}
+
+			dimensionNames = append(dimensionNames, *label.Name.Value)
+		}
+	}
+
+	return dimensionNames
+}
+
+// hasMetricData reports, if any time series of the metric contains a value.
+func hasMetricData(metricValue azmetrics.Metric) bool {
+	return slices.ContainsFunc(metricValue.TimeSeries, func(timeSeries azmetrics.TimeSeriesElement) bool {
+		return slices.ContainsFunc(timeSeries.Data, func(data azmetrics.MetricValue) bool { return rawValue(data) != nil })
+	})
+}
+
+// collectLatestValue emits the aggregations of the latest data point of a single time series.
+func (r *Request) collectLatestValue(prometheusMetricNamespace string, metricValue azmetrics.Metric, unit azmetrics.MetricUnit,
+	labels map[string]string, timeSeries azmetrics.TimeSeriesElement, latestMetric map[string]*float64, ch chan<- prometheus.Metric,
+) error {
+	var latestTimestamp time.Time
+
+	for _, aggregation := range aggregationTypes {
+		latestMetric[aggregation] = nil
+	}
+
+	for _, data := range timeSeries.Data {
+		if data.TimeStamp != nil && data.TimeStamp.After(latestTimestamp) {
+			latestTimestamp = *data.TimeStamp
+			latestMetric["total"] = data.Total
+			latestMetric["average"] = data.Average
+			latestMetric["count"] = data.Count
+			latestMetric["minimum"] = data.Minimum
+			latestMetric["maximum"] = data.Maximum
+		}
+	}
+
+	// Metrics with an aggregation override are queried with exactly this aggregation.
+	_, hasAggregationOverride := r.config.MetricAggregations[strings.ToLower(*metricValue.Name.Value)]
+
+	emitMetric := latestMetric
+	if len(r.config.PreferredAggregations) != 0 && !hasAggregationOverride {
+		emitMetric = r.selectPreferredAggregation(latestMetric, *metricValue.Name.Value)
+	}
+
+	// The name, help and labels are shared by all aggregations and computed only, if a value is available.
+	var (
+		metricName, help, unitSuffix string
+		labelNames, labelValues      []string
+	)
+
+	for metricType, value := range emitMetric {
+		if value == nil {
+			continue
+		}
+
+		if metricName == "" {
+			metricName = formatName(*metricValue.Name.Value, r.config.NameCase)
+			help = metricHelp(metricValue)
+			unitSuffix = r.unitSuffix(*metricValue.Name.Value, unit)
+			labelNames, labelValues = r.sortedLabels(labels)
+		}
+
+		err := r.emitSample(ch, r.withAzureTimestamp(latestTimestamp, prometheus.MustNewConstMetric(
+			r.metricDesc(prometheus.BuildFQName(prometheusMetricNamespace, metricName, metricType+unitSuffix), help, labelNames),
+			r.valueType(*metricValue.Name.Value),
+			r.metricValue(*metricValue.Name.Value, *value),
+			labelValues...,
+		)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectTimeWindow emits the start and end of the time window returned by Azure Monitor for the resource.
+// Azure Monitor lags behind the current time, which explains stale values. Resources queried by multiple requests,
+// e.g. because of metricNamesPerRequest, are emitted once.
+func (r *Request) collectTimeWindow(metric azmetrics.MetricData, ch chan<- prometheus.Metric) {
+	if _, ok := r.timeWindowResources[*metric.ResourceID]; ok {
+		return
+	}
+
+	if r.timeWindowResources == nil {
+		r.timeWindowResources = make(map[string]struct{})
+	}
+
+	r.timeWindowResources[*metric.ResourceID] = struct{}{}
+
+	for desc, value := range map[*prometheus.Desc]*string{r.descs.timeWindowStart: metric.StartTime, r.descs.timeWindowEnd: metric.EndTime} {
+		if value == nil {
+			continue
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, *value)
+		if err != nil {
+			_ = level.Debug(r).Log("msg", "skipping invalid time window", "resource_id", *metric.ResourceID, "value", *value, "err", err)
+
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(timestamp.UnixNano())/1e9, r.instanceLabel(*metric.ResourceID))
+	}
+}
+
+// collectRawTimeSeries emits every data point of the time series. Data points are distinguished by the timestamp label.
+// Without requested aggregation, Azure returns only the primary aggregation of the metric, which is emitted with the raw suffix.
+func (r *Request) collectRawTimeSeries(
+	prometheusMetricNamespace string, metricValue azmetrics.Metric, unit azmetrics.MetricUnit, prometheusLabels map[string]string,
+	metricTimeSeries azmetrics.TimeSeriesElement, ch chan<- prometheus.Metric,
+) error {
+	labelNames, labelValues := r.sortedLabels(prometheusLabels)
+	labelNames = append(labelNames, "timestamp")
+	labelValues = append(labelValues, "")
+
+	desc := r.metricDesc(
+		prometheus.BuildFQName(
+			prometheusMetricNamespace,
+			formatName(*metricValue.Name.Value, r.config.NameCase),
+			rawMetricSuffix+r.unitSuffix(*metricValue.Name.Value, unit),
+		),
+		metricHelp(metricValue),
+		labelNames,
+	)
+
+	for _, data := range metricTimeSeries.Data {
+		value := rawValue(data)
+		if data.TimeStamp == nil || value == nil {
+			continue
+		}
+
+		labelValues[len(labelValues)-1] = data.TimeStamp.UTC().Format(time.RFC3339)
+
+		err := r.emitSample(ch, r.withAzureTimestamp(*data.TimeStamp, prometheus.MustNewConstMetric(desc, r.valueType(*metricValue.Name.Value),
+			r.metricValue(*metricValue.Name.Value, *value), labelValues...)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// metricDesc returns the descriptor of a metric with the given variable labels. The labels of resources and dimensions
+// are passed as variable labels, so a descriptor is shared by all series of a metric within a scrape.
+// The help of the first series is used, Prometheus rejects metric families with inconsistent help anyway.
+func (r *Request) metricDesc(fqName, help string, labelNames []string) *prometheus.Desc {
+	if cached, ok := r.descCache[fqName]; ok && slices.Equal(cached.labelNames, labelNames) {
+		return cached.desc
+	}
+
+	if r.descCache == nil {
+		r.descCache = make(map[string]cachedDesc)
+	}
+
+	// The label names are reused by sortedLabels, the descriptor keeps a copy.
+	labelNames = slices.Clone(labelNames)
+	desc := prometheus.NewDesc(fqName, help, labelNames, nil)
+	r.descCache[fqName] = cachedDesc{desc: desc, labelNames: labelNames}
+
+	return desc
+}
+
+// sortedLabels returns the names and values of the labels ordered by name. The returned slices are reused by
+// the next call to avoid allocations per series.
+func (r *Request) sortedLabels(labels map[string]string) ([]string, []string) {
+	r.labelNames = r.labelNames[:0]
+	for name := range labels {
+		r.labelNames = append(r.labelNames, name)
+	}
+
+	slices.Sort(r.labelNames)
+
+	r.labelValues = r.labelValues[:0]
+	for _, name := range r.labelNames {
+		r.labelValues = append(r.labelValues, labels[name])
+	}
+
+	return r.labelNames, r.labelValues
+}
+
+// emitSample sends an Azure Monitor sample to the channel and counts it. Once Options.MaxSeries samples have been emitted,
+// errSeriesLimitExceeded is returned instead to protect Prometheus from a cardinality explosion.
+func (r *Request) emitSample(ch chan<- prometheus.Metric, metric prometheus.Metric) error {
+	if r.probe.options.MaxSeries > 0 && r.samples >= r.probe.options.MaxSeries {
+		return fmt.Errorf("%w of %d samples", errSeriesLimitExceeded, r.probe.options.MaxSeries)
+	}
+
+	ch <- metric
+	r.samples++
+
+	return nil
+}
+
+// withAzureTimestamp attaches the timestamp of the Azure data point to the metric, if Config.UseAzureTimestamps is set.
+// Prometheus rejects samples older than its head block, which is logged once per probe.
+func (r *Request) withAzureTimestamp(timestamp time.Time, metric prometheus.Metric) prometheus.Metric {
+	if r.config.UseAzureTimestamps == nil || !*r.config.UseAzureTimestamps || timestamp.IsZero() {
+		return metric
+	}
+
+	if age := time.Since(timestamp); age > azureTimestampWarnAge && !r.timestampWarned {
+		r.timestampWarned = true
+
+		_ = level.Warn(r).Log("msg", "Azure timestamp is older than "+azureTimestampWarnAge.String()+", Prometheus may reject the samples as out of bounds",
+			"timestamp", timestamp, "age", age)
+	}
+
+	return prometheus.NewMetricWithTimestamp(timestamp, metric)
+}
+
+// rawValue returns the first available aggregation of the data point.
+func rawValue(data azmetrics.MetricValue) *float64 {
+	for _, value := range []*float64{data.Average, data.Total, data.Maximum, data.Minimum, data.Count} {
+		if value != nil {
+			return value
+		}
+	}
+
+	return nil
+}
+
+// metricValue returns the value of a metric, either as boolean or rounded.
+func (r *Request) metricValue(metricName string, value float64) float64 {
+	if !slices.Contains(r.config.BooleanMetrics, strings.ToLower(metricName)) {
+		return r.roundValue(value * r.valueScale(metricName))
+	}
+
+	if value >= r.config.BooleanThreshold {
+		return 1
+	}
+
+	return 0
+}
+
+// valueType returns the Prometheus value type of the metric defined by the metricType parameter.
+func (r *Request) valueType(metricName string) prometheus.ValueType {
+	metricType, ok := r.config.MetricTypes[strings.ToLower(metricName)]
+	if !ok {
+		metricType = r.config.MetricType
+	}
+
+	if metricType == metricTypeCounter {
+		return prometheus.CounterValue
+	}
+
+	return prometheus.GaugeValue
+}
+
+// valueScale returns the scale of the metric defined by the valueScale parameter.
+func (r *Request) valueScale(metricName string) float64 {
+	if scale, ok := r.config.MetricValueScales[strings.ToLower(metricName)]; ok {
+		return scale
+	}
+
+	return r.config.ValueScale
+}
+
+// unitSuffix returns the suffix of the metric name for the unit. Scaled values are marked by the suffix _scaled,
+// because the unit reported by Azure does not apply to them anymore.
+func (r *Request) unitSuffix(metricName string, unit azmetrics.MetricUnit) string {
+	if r.valueScale(metricName) != 1 && !slices.Contains(r.config.BooleanMetrics, strings.ToLower(metricName)) {
+		return "_" + strings.ToLower(string(unit)) + "_scaled"
+	}
+
+	return "_" + strings.ToLower(string(unit))
+}
+
+// roundValue rounds the value to the decimal places of the round parameter.
+func (r *Request) roundValue(value float64) float64 {
+	if r.config.Round == nil {
+		return value
+	}
+
+	scale := math.Pow10(*r.config.Round)
+
+	return math.Round(value*scale) / scale
+}
+
+// selectPreferredAggregation returns only the first available aggregation of the preferred aggregations.
+// If none of them is available, the first available aggregation of the remaining types is returned.
+func (r *Request) selectPreferredAggregation(values map[string]*float64, metricName string) map[string]*float64 {
+	for i, aggregation := range slices.Concat(r.config.PreferredAggregations, aggregationTypes) {
+		if values[aggregation] == nil {
+			continue
+		}
+
+		if i != 0 {
+			_ = level.Debug(r).Log("msg", "preferred aggregation not available, falling back",
+				"metric", metricName, "preferred", r.config.PreferredAggregations[0], "aggregation", aggregation)
+		}
+
+		return map[string]*float64{aggregation: values[aggregation]}
+	}
+
+	return nil
+}
+
+// metricHelp returns the help text of a metric. Azure does not return a description for all metrics,
+// in this case the metric name is used.
+func metricHelp(metric azmetrics.Metric) string {
+	var name string
+
+	switch {
+	case metric.Name == nil:
+	case metric.Name.LocalizedValue != nil && *metric.Name.LocalizedValue != "":
+		name = *metric.Name.LocalizedValue
+	case metric.Name.Value != nil:
+		name = *metric.Name.Value
+	}
+
+	if metric.DisplayDescription == nil || *metric.DisplayDescription == "" {
+		return name
+	}
+
+	return fmt.Sprintf("%s: %s", name, *metric.DisplayDescription)
+}
+
+// formatInterval converts an ISO 8601 duration like PT5M into a Prometheus duration like 5m.
+// Intervals, which can't be parsed, are returned unchanged.
+func formatInterval(interval string) string {
+	parsed, err := duration.Parse(interval)
+	if err != nil {
+		return interval
+	}
+
+	return model.Duration(parsed.ToTimeDuration()).String()
+}
+
+// truncateLabelValue shortens label values exceeding Options.MaxLabelValueLength and marks them with truncatedLabelValueSuffix.
+func (p *Probe) truncateLabelValue(value string) string {
+	maxLength := p.options.MaxLabelValueLength
+	if maxLength <= 0 || utf8.RuneCountInString(value) <= maxLength {
+		return value
+	}
+
+	runes := []rune(value)
+
+	return string(runes[:maxLength]) + truncatedLabelValueSuffix
 }
@@ -0,0 +1,148 @@
+package probe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"gopkg.in/yaml.v3"
+)
+
+// resourceFile contains named lists of resources, which are scraped without Resource Graph query.
+// The file is reloaded, if its modification time changes. If the reload fails, the previous lists are kept.
+type resourceFile struct {
+	logger log.Logger
+	path   string
+
+	mu      sync.Mutex
+	modTime time.Time
+	lists   map[string][]fileResource
+}
+
+// fileResource is a resource of the resource file. Resource IDs do not contain the location,
+// which is required to select the metrics endpoint.
+type fileResource struct {
+	ID       string `yaml:"id"`
+	Location string `yaml:"location"`
+}
+
+// newResourceFile reads the resource file. Invalid files are rejected to fail on startup.
+func newResourceFile(logger log.Logger, path string) (*resourceFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading resource file: %w", err)
+	}
+
+	file := &resourceFile{logger: logger, path: path}
+	if err = file.reload(info.ModTime()); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// resources returns the resources of the list with the given name. The file is reloaded, if it has been changed.
+func (f *resourceFile) resources(name string) ([]fileResource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if info, err := os.Stat(f.path); err != nil {
+		_ = level.Warn(f.logger).Log("msg", "error reading resource file, using previous resources", "path", f.path, "err", err)
+	} else if !info.ModTime().Equal(f.modTime) {
+		if err = f.reload(info.ModTime()); err != nil {
+			_ = level.Warn(f.logger).Log("msg", "error reloading resource file, using previous resources", "path", f.path, "err", err)
+		}
+	}
+
+	resources, ok := f.lists[name]
+	if !ok {
+		return nil, fmt.Errorf("'resourceFile' parameter references unknown resource list %q", name)
+	}
+
+	return resources, nil
+}
+
+// reload reads and validates the resource file. The caller must hold the lock, unless the file is not shared yet.
+func (f *resourceFile) reload(modTime time.Time) error {
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("error reading resource file: %w", err)
+	}
+
+	var lists map[string][]fileResource
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	if err = decoder.Decode(&lists); err != nil {
+		return fmt.Errorf("error parsing resource file: %w", err)
+	}
+
+	for name, resources := range lists {
+		for i, resource := range resources {
+			if _, err = arm.ParseResourceID(resource.ID); err != nil {
+				return fmt.Errorf("error parsing resource file: resource %d of list %q: %w", i, name, err)
+			}
+
+			if resource.Location == "" {
+				return fmt.Errorf("error parsing resource file: resource %s of list %q must set location", resource.ID, name)
+			}
+		}
+	}
+
+	f.lists = lists
+	f.modTime = modTime
+
+	_ = level.Info(f.logger).Log("msg", "loaded resource file", "path", f.path, "lists", len(lists))
+
+	return nil
+}
+
+// resourcesFromFile returns the resources of the resource list referenced by the resourceFile parameter,
+// grouped by location and subscription like the result of a Resource Graph query.
+func (r *Request) resourcesFromFile() (*Resources, error) {
+	if r.probe.resourceFile == nil {
+		return nil, errors.New("'resourceFile' parameter requires --probe.resource-file")
+	}
+
+	fileResources, err := r.probe.resourceFile.resources(r.config.ResourceFile)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := &Resources{
+		Resources:        make(map[string]map[string][]string),
+		AdditionalLabels: make(map[string]map[string]string),
+	}
+
+	for _, fileResource := range fileResources {
+		resourceID, err := arm.ParseResourceID(fileResource.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing resource ID %s: %w", fileResource.ID, err)
+		}
+
+		if !strings.EqualFold(resourceID.ResourceType.String(), r.config.ResourceType) {
+			return nil, fmt.Errorf("resource %s of resource list %q is not of type %s", fileResource.ID, r.config.ResourceFile, r.config.ResourceType)
+		}
+
+		location := strings.ToLower(strings.ReplaceAll(fileResource.Location, " ", ""))
+		if resources.Resources[location] == nil {
+			resources.Resources[location] = make(map[string][]string)
+		}
+
+		resources.Resources[location][resourceID.SubscriptionID] = append(resources.Resources[location][resourceID.SubscriptionID], fileResource.ID)
+	}
+
+	if len(resources.Resources) == 0 && !r.config.NoContentOnEmpty {
+		return nil, fmt.Errorf("resource list %q is empty", r.config.ResourceFile)
+	}
+
+	return resources, nil
+}
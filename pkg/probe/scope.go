@@ -0,0 +1,102 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	// scopeResource queries the metrics of the resources returned by Resource Graph. This is the default.
+	scopeResource = "resource"
+	// scopeSubscription queries the metrics of the subscriptions in scope of the probe, e.g. quota and usage metrics.
+	// Azure Monitor aggregates the metrics of all resources of the metric namespace in the region of the probe.
+	scopeSubscription = "subscription"
+)
+
+// scopes contains the supported values of the scope parameter.
+var scopes = []string{scopeResource, scopeSubscription}
+
+// subscriptionResources returns the subscriptions in scope of the probe as resources of the region of the probe.
+// Subscriptions are not enumerated by Resource Graph.
+func (r *Request) subscriptionResources() (*Resources, error) {
+	subscriptions := r.subscriptions()
+	if len(subscriptions) == 0 {
+		return nil, errors.New("'scope' parameter subscription requires at least one subscription")
+	}
+
+	resources := &Resources{
+		Resources:        map[string]map[string][]string{r.config.Region: make(map[string][]string, len(subscriptions))},
+		AdditionalLabels: make(map[string]map[string]string),
+	}
+
+	for _, subscriptionID := range subscriptions {
+		resources.Resources[r.config.Region][subscriptionID] = []string{"/subscriptions/" + subscriptionID}
+	}
+
+	return resources, nil
+}
+
+// fetchSubscriptionMetrics fetches the metrics of the subscriptions by the subscription scope of the per-resource
+// metrics API. The batch metrics API does not support subscriptions. The subscription is the instance of the metrics.
+func (r *Request) fetchSubscriptionMetrics(ctx context.Context, resources *Resources, ch chan<- prometheus.Metric) error {
+	for region, subscriptions := range resources.Resources {
+		subscriptionIDs := maps.Keys(subscriptions)
+		slices.Sort(subscriptionIDs)
+
+		for _, subscriptionID := range subscriptionIDs {
+			if err := r.fetchMetricsOfSubscription(ctx, region, subscriptionID, resources, ch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchMetricsOfSubscription fetches the metrics of a single subscription in the region.
+func (r *Request) fetchMetricsOfSubscription(ctx context.Context, region, subscriptionID string, resources *Resources, ch chan<- prometheus.Metric) error {
+	ctx, span := r.probe.tracer.Start(ctx, "fetchMetricsOfSubscription", trace.WithAttributes(
+		attribute.String("subscription_id", subscriptionID),
+	))
+	defer span.End()
+
+	metricNamespace := r.config.ResourceType
+	if r.config.MetricNamespace != "" {
+		metricNamespace = r.config.MetricNamespace
+	}
+
+	pipeline := r.probe.metricsPipeline(r.credentials, subscriptionID)
+	returnedMetrics := false
+
+	for _, metricQuery := range r.metricQueries() {
+		query := legacyMetricsQuery(metricNamespace, metricQuery)
+		query.Set("region", region)
+
+		value, err := queryLegacyMetricsOfScope(ctx, pipeline, r.credentials.armEndpoint, "/subscriptions/"+subscriptionID, query)
+		if err != nil {
+			return spanError(span, err)
+		}
+
+		returnedMetrics = returnedMetrics || len(value.Values) != 0
+
+		if err = r.collectMetrics(subscriptionID, []azmetrics.MetricData{value}, resources, ch); err != nil {
+			return spanError(span, err)
+		}
+	}
+
+	if !returnedMetrics {
+		r.resourcesWithoutMetrics++
+
+		_ = level.Debug(r).Log("msg", "no metrics returned for subscription", "subscription_id", subscriptionID)
+	}
+
+	return nil
+}
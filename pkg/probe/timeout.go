@@ -2,30 +2,44 @@ package probe
 
 import (
 	"fmt"
+	"math"
+	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/go-kit/log/level"
 )
 
+// DefaultTimeoutHeader is the header used by Prometheus to announce the scrape timeout.
+const DefaultTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
 func (r *Request) getProbeTimeout() time.Duration {
-	var (
-		err     error
-		timeout int64
-	)
-
-	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
-		timeout, err = strconv.ParseInt(v, 10, 64)
-		if err != nil {
-			_ = level.Warn(r.probe.logger).Log("msg", fmt.Sprintf("Couldn't parse X-Prometheus-Scrape-Timeout-Seconds: %q. Defaulting timeout to %d", v, 10))
+	return r.probe.probeTimeout(&r.Request, r.config.Timeout)
+}
+
+// probeTimeout returns the timeout of the probe. The timeout in seconds is read from the timeout header.
+// Scrapers, which don't send a timeout header, can use the 'timeout' parameter instead, which is passed as timeoutParameter.
+func (p *Probe) probeTimeout(request *http.Request, timeoutParameter float64) time.Duration {
+	timeout := timeoutParameter
+
+	if v := request.Header.Get(p.options.TimeoutHeader); v != "" {
+		var err error
+
+		timeout, err = strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(timeout) || math.IsInf(timeout, 0) {
+			_ = level.Warn(p.logger).Log("msg", fmt.Sprintf("Couldn't parse %s: %q. Defaulting timeout to %d", p.options.TimeoutHeader, v, 10))
+
+			timeout = 0
 		}
 	}
 
-	if timeout == 0 {
+	if timeout <= 0 {
 		timeout = 10
 	}
 
-	timeout = timeout*1000 - 500 // Subtract 0.5s to give some buffer for the context deadline
+	// Subtract 0.5s to give some buffer for the context deadline.
+	// Short timeouts keep at least half of their duration, otherwise the probe would time out immediately.
+	probeTimeout := time.Duration(timeout * float64(time.Second))
 
-	return time.Duration(timeout) * time.Millisecond
+	return probeTimeout - min(500*time.Millisecond, probeTimeout/2)
 }
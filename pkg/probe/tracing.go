@@ -0,0 +1,17 @@
+package probe
+
+import (
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the OpenTelemetry tracer of the probe.
+const tracerName = "github.com/jkroepke/azure-monitor-exporter/pkg/probe"
+
+// spanError records the error at the span and returns it.
+func spanError(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	return err
+}
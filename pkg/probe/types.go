@@ -5,27 +5,203 @@ import (
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azlogs"
 	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
 	"github.com/go-kit/log"
 	"github.com/jkroepke/azure-monitor-exporter/pkg/cache"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 type Probe struct {
-	logger log.Logger
-	cred   azcore.TokenCredential
+	logger  log.Logger
+	options Options
 
-	subscriptions []string
+	// defaultContext is used by probes without 'context' parameter. contexts contains the contexts added by AddContext.
+	defaultContext *credentialContext
+	contexts       map[string]*credentialContext
 
-	resourceGraphClient *armresourcegraph.Client
-	azClientOptions     azcore.ClientOptions
+	// subscriptionCredentials override the credential of the context for the metrics of matching subscriptions.
+	subscriptionCredentials []subscriptionCredential
+
+	// resourceFile contains the resource lists of Options.ResourceFile. Nil, if no resource file is configured.
+	resourceFile *resourceFile
+
+	logsClient      *azlogs.Client
+	azClientOptions azcore.ClientOptions
 
 	queryCache         *cache.Cache[Resources]
 	metricsClientCache *cache.Cache[azmetrics.Client]
+	metricsClientGroup singleflight.Group
+
+	// metricsClientsCreated counts the metrics clients created by getMetricsClient.
+	metricsClientsCreated prometheus.Counter
+
+	// resourceGraphTruncated counts the Resource Graph responses with truncated results per resource type.
+	resourceGraphTruncated *prometheus.CounterVec
+
+	// probeErrors counts the probe requests rejected by ServeHTTP per reason.
+	probeErrors *prometheus.CounterVec
+
+	tracer trace.Tracer
+
+	// metricDefinitionsCache contains the metric names of a metric namespace, used by metricName=*.
+	metricDefinitionsCache *cache.Cache[[]string]
+	// metricCache contains the metric results of a metric query, if Config.MetricCacheExpiration is set.
+	metricCache *cache.Cache[[]azmetrics.MetricData]
+}
+
+// credentialContext contains the credential and the subscriptions of a tenant.
+type credentialContext struct {
+	name                string
+	cred                azcore.TokenCredential
+	subscriptions       []string
+	resourceGraphClient *armresourcegraph.Client
+	armPipeline         runtime.Pipeline
+	// armEndpoint is the Azure Resource Manager endpoint of the cloud of the context.
+	armEndpoint string
+}
+
+// subscriptionCredential is the credential of the subscriptions matching the pattern, added by AddSubscriptionCredential.
+type subscriptionCredential struct {
+	name        string
+	pattern     string
+	cred        azcore.TokenCredential
+	armPipeline runtime.Pipeline
+}
+
+type scrapeDescs struct {
+	scrapeDuration         *prometheus.Desc
+	scrapeSuccess          *prometheus.Desc
+	scrapeTimeout          *prometheus.Desc
+	scrapeTimedOut         *prometheus.Desc
+	resourceGraphPageLimit *prometheus.Desc
+	resourcesTotal         *prometheus.Desc
+
+	resourceGraphPartialScopes *prometheus.Desc
+
+	resourceGraphQuotaConsumed *prometheus.Desc
+	resourcesCacheAge          *prometheus.Desc
+	resourceGraphPages         *prometheus.Desc
+	resourceGraphRows          *prometheus.Desc
+
+	nullMetrics             *prometheus.Desc
+	resourcesWithoutMetrics *prometheus.Desc
+	samples                 *prometheus.Desc
+	seriesLimitExceeded     *prometheus.Desc
+
+	timeWindowStart *prometheus.Desc
+	timeWindowEnd   *prometheus.Desc
 
-	scrapeDurationDesc *prometheus.Desc
-	scrapeSuccessDesc  *prometheus.Desc
+	cacheKeyInfo    *prometheus.Desc
+	metricCacheHits *prometheus.Desc
+}
+
+// resourceGraphStats contains statistics about the Resource Graph queries of a single probe.
+type resourceGraphStats struct {
+	quotaConsumed float64
+	// pages and rows are the number of pages and rows fetched from Resource Graph.
+	pages int
+	rows  int
+	// cacheAge is the age of the resources in seconds, if they have been served from the query cache.
+	cacheAge float64
+}
+
+// Options contains the probe settings which are configured globally, e.g. by command line flags.
+type Options struct {
+	// MaxPages limits the number of Resource Graph pages fetched by a probe. 0 means unlimited.
+	MaxPages int
+	// AllowPartialScopes allows Resource Graph to return results of a subset of the subscriptions,
+	// if the number of subscriptions exceeds the limit of a single query.
+	AllowPartialScopes bool
+	// MaxSeries limits the number of samples emitted by a probe. Probes exceeding the limit return partial metrics.
+	// 0 means unlimited.
+	MaxSeries int
+	// MaxSubscriptionIDs limits the number of values of the subscriptionID parameter. 0 means unlimited.
+	MaxSubscriptionIDs int
+	// MaxSubscriptionsPerProbe rejects probes, which cover more subscriptions. 0 means unlimited.
+	MaxSubscriptionsPerProbe int
+	// RequireSubscriptionIDs rejects probes without subscriptionID parameter, if the credential context has no subscriptions,
+	// e.g. because the subscription discovery is disabled. Without, such probes query all subscriptions of the tenant.
+	RequireSubscriptionIDs bool
+	// DeduplicateResources scrapes a resource only once, even if it appears under multiple subscriptions.
+	DeduplicateResources bool
+	// LegacyMetricsFallback queries metric namespaces, which are not supported by the batch metrics API,
+	// by the per-resource metrics API of Azure Resource Manager. The per-resource API requires one request per resource.
+	LegacyMetricsFallback bool
+
+	// MetricsEndpointTemplate is the format string of the metrics endpoint. %s is replaced by the region.
+	// Defaults to DefaultMetricsEndpointTemplate.
+	MetricsEndpointTemplate string
+
+	// MetricsAudience is the audience of the token of the metrics endpoint, which differs in sovereign clouds,
+	// e.g. https://metrics.monitor.azure.us. Defaults to DefaultMetricsAudience.
+	MetricsAudience string
+
+	// LogsEndpoint is the Log Analytics query endpoint of the /logs probes, which differs in sovereign clouds,
+	// e.g. https://api.loganalytics.us/v1. Defaults to DefaultLogsEndpoint.
+	LogsEndpoint string
+
+	// LogsAudience is the audience of the token of LogsEndpoint. Defaults to DefaultLogsAudience.
+	LogsAudience string
+
+	// ResourceManagerEndpoint is the Azure Resource Manager endpoint of Resource Graph, the metric definitions and the
+	// per-resource metrics API, which differs in sovereign clouds, e.g. https://management.usgovcloudapi.net.
+	// Defaults to the endpoint of cloud.AzurePublic.
+	ResourceManagerEndpoint string
+
+	// ResourceManagerAudience is the audience of the token of ResourceManagerEndpoint. Defaults to the audience of cloud.AzurePublic.
+	ResourceManagerAudience string
+
+	// GlobalMetricsRegion is the region used to query the metrics of resources with the location global.
+	// If empty, probes of global resources fail.
+	GlobalMetricsRegion string
+
+	// QueryCacheJitter randomizes the query cache expiration by up to the given percentage in both directions.
+	QueryCacheJitter float64
+
+	// DefaultInterval is the ISO 8601 metric interval used, if a probe does not define one.
+	DefaultInterval string
+
+	// DefaultAggregation is the comma separated list of aggregations requested, if a probe does not define the aggregation.
+	// If empty, Azure returns the primary aggregation of each metric.
+	DefaultAggregation string
+
+	// MetricNamesPerRequest limits the number of metric names queried by a single Azure Monitor request.
+	// Defaults to DefaultMetricNamesPerRequest.
+	MetricNamesPerRequest int
+
+	// SubscriptionsPerQuery limits the number of subscriptions queried by a single Resource Graph request.
+	// Defaults to DefaultSubscriptionsPerQuery.
+	SubscriptionsPerQuery int
+
+	// UseAzureTimestamps is the default of Config.UseAzureTimestamps.
+	UseAzureTimestamps bool
+
+	// MaxLabelValueLength truncates label values of resource labels and dimensions to the given number of characters.
+	// 0 means unlimited.
+	MaxLabelValueLength int
+
+	// TimeoutHeader is the request header containing the scrape timeout in seconds.
+	// Defaults to DefaultTimeoutHeader.
+	TimeoutHeader string
+
+	// TracerProvider creates the OpenTelemetry spans of the probes and the Azure SDK. Defaults to a no-op tracer provider.
+	// The Azure SDK is not instrumented by a nil or no-op tracer provider.
+	TracerProvider trace.TracerProvider
+
+	// ResourceFile is the path of a YAML file with named resource lists, which are scraped by probes with the
+	// resourceFile parameter instead of a Resource Graph query.
+	ResourceFile string
+
+	// ConstLabels are added to the scrape metrics of all probes.
+	ConstLabels prometheus.Labels
+
+	// TrustProxyHeaders enables the usage of X-Forwarded-For and X-Real-IP to log the client address.
+	TrustProxyHeaders bool
 }
 
 type Request struct {
@@ -34,11 +210,71 @@ type Request struct {
 
 	config *Config
 	probe  *Probe
+	descs  *scrapeDescs
+
+	// credentials is the credential context selected by the 'context' parameter.
+	credentials *credentialContext
+
+	// expandedMetricNames contains all available metric names, if the probe uses metricName=*.
+	expandedMetricNames []string
+
+	// timestampWarned is set after the first warning about old Azure timestamps to log it only once per probe.
+	timestampWarned bool
+
+	// resourceCount is the number of resources returned by Resource Graph or the query cache.
+	resourceCount int
+
+	// succeeded is set, if the probe completed without error, timeout or exceeded series limit.
+	succeeded bool
+
+	// resourcesWithoutMetrics counts the requested resources, which are missing in the response of Azure Monitor.
+	resourcesWithoutMetrics int
+
+	// legacyMetricsAPI is set, once the batch metrics API rejected the metric namespace of the probe.
+	legacyMetricsAPI bool
+
+	// timeWindowResources contains the resources, whose time window has been emitted, if Config.IncludeTimeWindow is set.
+	timeWindowResources map[string]struct{}
+
+	// descCache contains the descriptors of the emitted metrics by fully-qualified name, see metricDesc.
+	descCache map[string]cachedDesc
+	// labelNames and labelValues are the buffers of sortedLabels.
+	labelNames, labelValues []string
+
+	// samples counts the Azure Monitor samples emitted by the probe, excluding the scrape metrics of the exporter.
+	samples int
+
+	// nullMetrics counts the resources without data per lower-case metric name, if Config.SkipNullMetrics is set.
+	nullMetrics map[string]int
+
+	// metricCacheHits counts the metric queries served from the metric cache.
+	metricCacheHits int
+}
+
+// cachedDesc is a descriptor cached by Request.metricDesc together with its variable label names.
+type cachedDesc struct {
+	desc       *prometheus.Desc
+	labelNames []string
+}
+
+type LogsRequest struct {
+	http.Request
+	log.Logger
+
+	config *LogsConfig
+	probe  *Probe
+	descs  *scrapeDescs
 }
 
 type Resources struct {
 	Resources        map[string]map[string][]string
 	AdditionalLabels map[string]map[string]string
+
+	// PageLimitReached is true, if the Resource Graph paging was stopped by Options.MaxPages.
+	PageLimitReached bool
+
+	// PartialScopes is true, if Resource Graph may have skipped subscriptions because of Options.AllowPartialScopes.
+	PartialScopes bool
 }
 
 type Config struct {
@@ -48,8 +284,98 @@ type Config struct {
 	MetricNamespace string
 	MetricNames     []string
 	MetricPrefix    string
+	// Context is the name of the credential context used by the probe. Empty for the default context.
+	Context string `json:",omitempty"`
+	// ResourceFile is the name of the resource list of Options.ResourceFile, which replaces the Resource Graph query.
+	ResourceFile string `json:",omitempty"`
+	// Region overrides the location of all resources to select the metrics endpoint.
+	Region string `json:",omitempty"`
+	// Scope selects, whether the metrics of resources or of the subscriptions are queried.
+	Scope string
+	// Target is not used by the probe. It is added as target label to the scrape metrics to distinguish probe jobs.
+	Target string `json:",omitempty"`
+	// RegionLabel is the name of the label containing the region of the resource.
+	RegionLabel string
+	// NameCase controls the conversion of metric names and namespaces into Prometheus metric names.
+	NameCase string
+	// LabelCollision controls the handling of dimensions colliding with a label of the resource.
+	LabelCollision string
+	// InstanceFormat controls the value of the instance label, e.g. the resource ID or the name of the resource.
+	InstanceFormat string
+	// ResultFormat is the format of the Resource Graph response.
+	ResultFormat armresourcegraph.ResultFormat
 
-	QueryCacheCacheExpiration time.Duration
+	// PreferredAggregations contains the aggregation types in the order of preference.
+	// Only the first available aggregation is emitted.
+	PreferredAggregations []string
+	// MetricAggregations contains the aggregation overrides per lower-case metric name.
+	MetricAggregations map[string]string `json:",omitempty"`
+	// RawTimeSeries emits every data point of the time series instead of the latest value (aggregation=none).
+	RawTimeSeries bool `json:",omitempty"`
+
+	DropSingleValueDimensions bool
+	EmitResourceCount         bool
+	IncludeMetricID           bool
+	// IncludeInterval adds the time grain returned by Azure as interval label.
+	IncludeInterval bool
+	// IncludeTimeWindow emits the start and end of the time window returned by Azure per resource.
+	IncludeTimeWindow bool
+	// EmitResourceInfo emits an info metric with the metadata of each resource.
+	EmitResourceInfo bool
+	// UseAzureTimestamps emits the metrics with the timestamp of the Azure data point instead of the scrape time.
+	// Defaults to Options.UseAzureTimestamps.
+	UseAzureTimestamps *bool `json:",omitempty"`
+	// SkipNullMetrics records the metrics without any data points, which are skipped.
+	SkipNullMetrics bool
+	// NoContentOnEmpty responds with 204 instead of the scrape metrics, if the probe matches no resources.
+	NoContentOnEmpty bool
+	// NoCache skips the query cache read of the probe. The queried resources are still stored in the cache.
+	NoCache bool
+	// IncludeCacheKey emits the short query cache key of the probe as info metric.
+	IncludeCacheKey bool
+	// UseConfiguredNamespace derives the metric names from MetricNamespace instead of the namespace returned by Azure,
+	// which is an arbitrary string for custom metrics.
+	UseConfiguredNamespace bool
+
+	// BooleanMetrics contains the lower-case names of metrics, which are emitted as 0 or 1.
+	// A value greater than or equal to BooleanThreshold results in 1.
+	BooleanMetrics   []string
+	BooleanThreshold float64
+
+	// MetricType is the Prometheus type (gauge or counter) of all metrics without entry in MetricTypes.
+	MetricType string
+	// MetricTypes contains the Prometheus types per lower-case metric name.
+	MetricTypes map[string]string `json:",omitempty"`
+
+	// ConstLabels are added to all metrics of the probe.
+	ConstLabels map[string]string `json:",omitempty"`
+
+	// ValueScale is multiplied with the values of all metrics without entry in MetricValueScales.
+	ValueScale float64
+	// MetricValueScales contains the scales per lower-case metric name.
+	MetricValueScales map[string]float64 `json:",omitempty"`
+
+	// Round is the number of decimal places of the emitted metric values. nil disables rounding.
+	Round *int
+
+	QueryCacheCacheExpiration time.Duration `json:"-"`
+	// MetricCacheExpiration is the lifetime of cached metric results. 0 disables the metric cache.
+	MetricCacheExpiration time.Duration `json:"-"`
+	// MaxAge suppresses metrics, whose latest data point is older. 0 disables the filter.
+	MaxAge time.Duration `json:"-"`
+	// Timeout is the 'timeout' parameter in seconds. The timeout header takes precedence, 0 uses the default timeout.
+	Timeout float64 `json:"-"`
 
 	azmetrics.QueryResourcesOptions
 }
+
+type LogsConfig struct {
+	WorkspaceID  string
+	Query        string
+	Timespan     string
+	MetricPrefix string
+	// Target is added as label to the scrape metrics, see Config.Target.
+	Target string
+	// Timeout is the 'timeout' parameter in seconds. The timeout header takes precedence, 0 uses the default timeout.
+	Timeout float64
+}
@@ -0,0 +1,141 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Client sends samples to a Prometheus remote write endpoint with the remote write protocol 1.0.
+type Client struct {
+	url        string
+	httpClient *http.Client
+}
+
+// New returns a client for the remote write endpoint.
+func New(url string, httpClient *http.Client) *Client {
+	return &Client{url: url, httpClient: httpClient}
+}
+
+// Write sends the metrics to the remote write endpoint. Metrics without timestamp get the given timestamp.
+// Only counters, gauges and untyped metrics are sent, which covers all metrics of a probe.
+func (c *Client) Write(ctx context.Context, metrics []prometheus.Metric, timestamp time.Time) error {
+	metricFamilies, err := gather(metrics)
+	if err != nil {
+		return err
+	}
+
+	writeRequest, err := buildWriteRequest(metricFamilies, timestamp.UnixMilli()).Marshal()
+	if err != nil {
+		return fmt.Errorf("error encoding remote write request: %w", err)
+	}
+
+	body := snappy.Encode(nil, writeRequest)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating remote write request: %w", err)
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending remote write request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		return fmt.Errorf("remote write endpoint responded with %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return nil
+}
+
+// metricsCollector collects a fixed list of metrics. It is unchecked, because the descriptors are not known in advance.
+type metricsCollector []prometheus.Metric
+
+func (metricsCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range c {
+		ch <- metric
+	}
+}
+
+// gather groups the metrics into metric families. Like a scrape, inconsistent or invalid metrics are rejected.
+func gather(metrics []prometheus.Metric) ([]*dto.MetricFamily, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(metricsCollector(metrics)); err != nil {
+		return nil, fmt.Errorf("error registering metrics: %w", err)
+	}
+
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("error gathering metrics: %w", err)
+	}
+
+	return metricFamilies, nil
+}
+
+// buildWriteRequest converts the metric families into the WriteRequest of the remote write protocol.
+func buildWriteRequest(metricFamilies []*dto.MetricFamily, defaultTimestamp int64) *prompb.WriteRequest {
+	writeRequest := &prompb.WriteRequest{}
+
+	for _, metricFamily := range metricFamilies {
+		for _, metric := range metricFamily.GetMetric() {
+			var value float64
+
+			switch metricFamily.GetType() {
+			case dto.MetricType_COUNTER:
+				value = metric.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = metric.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = metric.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			timestamp := defaultTimestamp
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+
+			// The labels of a time series must be sorted by name, including the metric name.
+			labels := make([]prompb.Label, 0, len(metric.GetLabel())+1)
+			labels = append(labels, prompb.Label{Name: model.MetricNameLabel, Value: metricFamily.GetName()})
+
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, prompb.Label{Name: label.GetName(), Value: label.GetValue()})
+			}
+
+			slices.SortFunc(labels, func(a, b prompb.Label) int { return strings.Compare(a.Name, b.Name) })
+
+			writeRequest.Timeseries = append(writeRequest.Timeseries, prompb.TimeSeries{
+				Labels:  labels,
+				Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+			})
+		}
+	}
+
+	return writeRequest
+}
@@ -0,0 +1,85 @@
+package remotewrite
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientWrite(t *testing.T) {
+	t.Parallel()
+
+	var (
+		headers http.Header
+		body    []byte
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ = io.ReadAll(r.Body)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	desc := prometheus.NewDesc("azure_monitor_percentage_cpu_average_percent", "help", []string{"instance"}, nil)
+	timestamp := time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)
+
+	metrics := []prometheus.Metric{
+		prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1.5, "vm0"),
+		prometheus.NewMetricWithTimestamp(timestamp.Add(-time.Minute), prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2, "vm1")),
+	}
+
+	require.NoError(t, New(server.URL, server.Client()).Write(context.Background(), metrics, timestamp))
+
+	assert.Equal(t, "snappy", headers.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", headers.Get("Content-Type"))
+	assert.Equal(t, "0.1.0", headers.Get("X-Prometheus-Remote-Write-Version"))
+
+	writeRequestBytes, err := snappy.Decode(nil, body)
+	require.NoError(t, err)
+
+	var writeRequest prompb.WriteRequest
+	require.NoError(t, writeRequest.Unmarshal(writeRequestBytes))
+
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "azure_monitor_percentage_cpu_average_percent"},
+				{Name: "instance", Value: "vm0"},
+			},
+			Samples: []prompb.Sample{{Value: 1.5, Timestamp: 1704069000000}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "azure_monitor_percentage_cpu_average_percent"},
+				{Name: "instance", Value: "vm1"},
+			},
+			Samples: []prompb.Sample{{Value: 2, Timestamp: 1704068940000}},
+		},
+	}, writeRequest.Timeseries)
+}
+
+func TestClientWriteError(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	desc := prometheus.NewDesc("azure_monitor_up", "help", nil, nil)
+
+	err := New(server.URL, server.Client()).Write(context.Background(),
+		[]prometheus.Metric{prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)}, time.Now())
+	require.EqualError(t, err, "remote write endpoint responded with 400 Bad Request: out of order sample")
+}
@@ -2,11 +2,15 @@ package testutil
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/monitor/query/azmetrics"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -29,7 +33,7 @@ const (
 	  "access_token": "mock_access_token",
 	  "expires_in": 3599,
 	  "ext_expires_in": 3599,
-	  "scope": "https://management.core.windows.net//.default https://metrics.monitor.azure.com/.default",
+	  "scope": "https://management.core.windows.net//.default https://metrics.monitor.azure.com/.default https://api.loganalytics.io/.default",
 	  "token_type": "Bearer"
 	}`
 )
@@ -58,7 +62,12 @@ func MockTransport(
 				recorder := httptest.NewRecorder()
 				recorder.WriteHeader(http.StatusOK)
 
-				resp, err := json.Marshal(resourceGraphResponse)
+				response, err := resourceGraphResultFormat(req, resourceGraphResponse)
+				if err != nil {
+					return nil, err
+				}
+
+				resp, err := json.Marshal(response)
 				if err != nil {
 					return nil, fmt.Errorf("failed to marshal resource graph response: %w", err)
 				}
@@ -67,12 +76,26 @@ func MockTransport(
 
 				return recorder.Result(), nil
 			}
+
+			if strings.HasSuffix(req.URL.Path, "/providers/Microsoft.Insights/metricDefinitions") {
+				recorder := httptest.NewRecorder()
+				recorder.WriteHeader(http.StatusOK)
+
+				resp, err := json.Marshal(metricDefinitions(metricsResponse))
+				if err != nil {
+					return nil, fmt.Errorf("failed to marshal metric definitions response: %w", err)
+				}
+
+				_, _ = recorder.Write(resp)
+
+				return recorder.Result(), nil
+			}
 		default:
 			if strings.HasSuffix(req.Host, "metrics.monitor.azure.com") {
 				recorder := httptest.NewRecorder()
 				recorder.WriteHeader(http.StatusOK)
 
-				resp, err := json.Marshal(metricsResponse)
+				resp, err := json.Marshal(filterMetricResults(metricsResponse, req.URL.Query().Get("metricnames")))
 				if err != nil {
 					return nil, fmt.Errorf("failed to marshal metrics response: %w", err)
 				}
@@ -86,3 +109,127 @@ func MockTransport(
 		return next.RoundTrip(req)
 	}
 }
+
+// resourceGraphResultFormat converts the rows of the resource graph response into the table format, if requested by the query.
+func resourceGraphResultFormat(req *http.Request, response armresourcegraph.QueryResponse) (armresourcegraph.QueryResponse, error) {
+	if req.Body == nil {
+		return response, nil
+	}
+
+	var queryRequest armresourcegraph.QueryRequest
+
+	// The body may already be consumed by another test transport.
+	if err := json.NewDecoder(req.Body).Decode(&queryRequest); errors.Is(err, io.EOF) {
+		return response, nil
+	} else if err != nil {
+		return response, fmt.Errorf("failed to decode resource graph request: %w", err)
+	}
+
+	if queryRequest.Options == nil || queryRequest.Options.ResultFormat == nil ||
+		*queryRequest.Options.ResultFormat != armresourcegraph.ResultFormatTable {
+		return response, nil
+	}
+
+	data, err := json.Marshal(response.Data)
+	if err != nil {
+		return response, fmt.Errorf("failed to marshal resource graph data: %w", err)
+	}
+
+	var rows []map[string]any
+
+	if err = json.Unmarshal(data, &rows); err != nil {
+		return response, fmt.Errorf("failed to unmarshal resource graph data: %w", err)
+	}
+
+	columnNames := make([]string, 0)
+
+	for _, row := range rows {
+		for columnName := range row {
+			if !slices.Contains(columnNames, columnName) {
+				columnNames = append(columnNames, columnName)
+			}
+		}
+	}
+
+	slices.Sort(columnNames)
+
+	table := armresourcegraph.Table{
+		Columns: make([]*armresourcegraph.Column, len(columnNames)),
+		Rows:    make([][]any, len(rows)),
+	}
+
+	for i, columnName := range columnNames {
+		table.Columns[i] = &armresourcegraph.Column{Name: to.Ptr(columnName), Type: to.Ptr(armresourcegraph.ColumnDataTypeString)}
+	}
+
+	for i, row := range rows {
+		table.Rows[i] = make([]any, len(columnNames))
+
+		for j, columnName := range columnNames {
+			table.Rows[i][j] = row[columnName]
+		}
+	}
+
+	response.Data = table
+
+	return response, nil
+}
+
+// metricDefinitions returns a metric definitions response containing all metric names of the metrics response.
+func metricDefinitions(metricsResponse azmetrics.MetricResults) map[string]any {
+	definitions := make([]map[string]any, 0)
+	seen := make(map[string]struct{})
+
+	for _, metricData := range metricsResponse.Values {
+		for _, metric := range metricData.Values {
+			if metric.Name == nil || metric.Name.Value == nil {
+				continue
+			}
+
+			if _, ok := seen[*metric.Name.Value]; ok {
+				continue
+			}
+
+			seen[*metric.Name.Value] = struct{}{}
+
+			definitions = append(definitions, map[string]any{
+				"name": map[string]string{"value": *metric.Name.Value},
+			})
+		}
+	}
+
+	return map[string]any{"value": definitions}
+}
+
+// filterMetricResults returns only the metrics requested by the comma separated metricNames.
+func filterMetricResults(metricsResponse azmetrics.MetricResults, metricNames string) azmetrics.MetricResults {
+	requestedMetricNames := make(map[string]struct{})
+	for _, metricName := range strings.Split(metricNames, ",") {
+		requestedMetricNames[strings.ToLower(metricName)] = struct{}{}
+	}
+
+	filteredResponse := azmetrics.MetricResults{
+		Values: make([]azmetrics.MetricData, len(metricsResponse.Values)),
+	}
+
+	for i, metricData := range metricsResponse.Values {
+		metrics := make([]azmetrics.Metric, 0, len(metricData.Values))
+
+		for _, metric := range metricData.Values {
+			if metric.Name == nil || metric.Name.Value == nil {
+				metrics = append(metrics, metric)
+
+				continue
+			}
+
+			if _, ok := requestedMetricNames[strings.ToLower(*metric.Name.Value)]; ok {
+				metrics = append(metrics, metric)
+			}
+		}
+
+		metricData.Values = metrics
+		filteredResponse.Values[i] = metricData
+	}
+
+	return filteredResponse
+}
@@ -11,14 +11,21 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// DefaultCloud is the cloud label of the transport returned by New.
+const DefaultCloud = "AzurePublic"
+
+// AzureSDKStatistics instruments the HTTP transports of the Azure SDK clients.
+// The metrics are registered once and shared by all transports, each transport is distinguished by the cloud label.
 type AzureSDKStatistics struct {
 	AzureAPIDuration  *prometheus.HistogramVec
 	AzureAPIRateLimit *prometheus.GaugeVec
-	Transport         http.RoundTripper
+	// Transport is the given transport of New, instrumented with the DefaultCloud label.
+	Transport http.RoundTripper
 }
 
 var subscriptionRegexp = regexp.MustCompile(`^(?i)/subscriptions/([^/]+)/?.*$`)
 
+// New registers the metrics and instruments the transport. Additional transports are instrumented by WrapTransport.
 func New(registry prometheus.Registerer, transport http.RoundTripper) *AzureSDKStatistics {
 	stats := &AzureSDKStatistics{}
 	stats.AzureAPIDuration = prometheus.NewHistogramVec(
@@ -27,7 +34,7 @@ func New(registry prometheus.Registerer, transport http.RoundTripper) *AzureSDKS
 			Help:    "A histogram of request latencies.",
 			Buckets: prometheus.DefBuckets,
 		},
-		[]string{"method", "code"},
+		[]string{"cloud", "method", "code"},
 	)
 
 	registry.MustRegister(stats.AzureAPIDuration)
@@ -38,6 +45,7 @@ func New(registry prometheus.Registerer, transport http.RoundTripper) *AzureSDKS
 			Help: "AzureRM API ratelimit",
 		},
 		[]string{
+			"cloud",
 			"endpoint",
 			"subscription_id",
 			"scope",
@@ -47,12 +55,21 @@ func New(registry prometheus.Registerer, transport http.RoundTripper) *AzureSDKS
 
 	registry.MustRegister(stats.AzureAPIRateLimit)
 
-	stats.Transport = stats.scrapeRateLimits(promhttp.InstrumentRoundTripperDuration(stats.AzureAPIDuration, transport))
+	stats.Transport = stats.WrapTransport(DefaultCloud, transport)
 
 	return stats
 }
 
-func (s *AzureSDKStatistics) scrapeRateLimits(next http.RoundTripper) promhttp.RoundTripperFunc {
+// WrapTransport instruments the transport of a cloud. The metrics of all transports of the same cloud are aggregated.
+func (s *AzureSDKStatistics) WrapTransport(cloud string, transport http.RoundTripper) http.RoundTripper {
+	return s.scrapeRateLimits(cloud,
+		promhttp.InstrumentRoundTripperDuration(s.AzureAPIDuration.MustCurryWith(prometheus.Labels{"cloud": cloud}), transport),
+	)
+}
+
+func (s *AzureSDKStatistics) scrapeRateLimits(cloud string, next http.RoundTripper) promhttp.RoundTripperFunc {
+	rateLimit := s.AzureAPIRateLimit.MustCurryWith(prometheus.Labels{"cloud": cloud})
+
 	return func(req *http.Request) (*http.Response, error) {
 		resp, err := next.RoundTrip(req)
 		if err != nil {
@@ -71,43 +88,43 @@ func (s *AzureSDKStatistics) scrapeRateLimits(next http.RoundTripper) promhttp.R
 		}
 
 		if strings.HasPrefix(req.URL.RawPath, "/providers/microsoft.resourcegraph/") {
-			s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+			collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 				"x-ms-user-quota-remaining", "resourcegraph", "quota")
 		}
 
-		s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+		collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 			"x-ms-ratelimit-remaining-microsoft.consumption-tenant-requests", "consumption", "tenant-requests")
 
 		// subscription rate limits
-		s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+		collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 			"x-ms-ratelimit-remaining-subscription-reads", "subscription", "reads")
-		s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+		collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 			"x-ms-ratelimit-remaining-subscription-writes", "subscription", "writes")
-		s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+		collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 			"x-ms-ratelimit-remaining-subscription-resource-requests", "subscription", "resourceRequests")
-		s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+		collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 			"x-ms-ratelimit-remaining-subscription-resource-entities-read", "subscription", "resource-entities-read")
 
 		// tenant rate limits
-		s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+		collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 			"x-ms-ratelimit-remaining-tenant-reads", "tenant", "reads")
-		s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+		collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 			"x-ms-ratelimit-remaining-tenant-writes", "tenant", "writes")
-		s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+		collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 			"x-ms-ratelimit-remaining-tenant-resource-requests", "tenant", "resource-requests")
-		s.collectAzureAPIRateLimitMetric(resp, hostname, subscriptionID,
+		collectAzureAPIRateLimitMetric(rateLimit, resp, hostname, subscriptionID,
 			"x-ms-ratelimit-remaining-tenant-resource-entities-read", "tenant", "resource-entities-read")
 
 		return resp, nil
 	}
 }
 
-func (s *AzureSDKStatistics) collectAzureAPIRateLimitMetric(r *http.Response, hostname, subscriptionID, headerName, scopeLabel, typeLabel string) {
+func collectAzureAPIRateLimitMetric(rateLimit *prometheus.GaugeVec, r *http.Response, hostname, subscriptionID, headerName, scopeLabel, typeLabel string) {
 	headerValue := r.Header.Get(headerName)
 
 	if value, err := strconv.ParseInt(headerValue, 10, 64); err == nil {
 		// single value
-		s.AzureAPIRateLimit.With(prometheus.Labels{
+		rateLimit.With(prometheus.Labels{
 			"endpoint":        hostname,
 			"subscription_id": subscriptionID,
 			"scope":           scopeLabel,
@@ -121,7 +138,7 @@ func (s *AzureSDKStatistics) collectAzureAPIRateLimitMetric(r *http.Response, ho
 				quotaValue := parts[1]
 
 				if value, err = strconv.ParseInt(quotaValue, 10, 64); err == nil {
-					s.AzureAPIRateLimit.With(prometheus.Labels{
+					rateLimit.With(prometheus.Labels{
 						"endpoint":        hostname,
 						"subscription_id": subscriptionID,
 						"scope":           scopeLabel,
@@ -0,0 +1,28 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jkroepke/azure-monitor-exporter/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTracerProvider(t *testing.T) {
+	t.Parallel()
+
+	tracerProvider, shutdown, err := tracing.NewTracerProvider(context.Background(), "http://localhost:4318")
+	require.NoError(t, err)
+	assert.NotNil(t, tracerProvider)
+	require.NoError(t, shutdown(context.Background()))
+}
+
+func TestNewTracerProviderWithoutEndpoint(t *testing.T) {
+	t.Parallel()
+
+	tracerProvider, shutdown, err := tracing.NewTracerProvider(context.Background(), "")
+	require.NoError(t, err)
+	assert.Nil(t, tracerProvider)
+	require.NoError(t, shutdown(context.Background()))
+}